@@ -4,11 +4,11 @@ import (
 	"archive/zip"
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"mime/multipart"
 	"net"
 	"net/http"
@@ -17,7 +17,6 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
-	"runtime/debug"
 	"sort"
 	"strconv"
 	"strings"
@@ -26,11 +25,28 @@ import (
 
 	apputils "main/utils"
 	"main/utils/ampapi"
+	"main/utils/amurl"
+	"main/utils/batch"
+	"main/utils/events"
+	"main/utils/history"
 	"main/utils/lyrics"
+	"main/utils/manifest"
+	"main/utils/naming"
+	"main/utils/plan"
+	"main/utils/playlistfile"
+	"main/utils/progress"
+	"main/utils/quality"
+	"main/utils/remux"
 	"main/utils/runv2"
 	"main/utils/runv3"
+	"main/utils/sanitize"
+	"main/utils/server"
+	"main/utils/sidecar"
+	"main/utils/snapshot"
 	"main/utils/structs"
 	"main/utils/task"
+	"main/utils/verify"
+	"main/utils/watch"
 
 	"github.com/fatih/color"
 	"github.com/grafov/m3u8"
@@ -41,29 +57,195 @@ import (
 )
 
 var (
-	forbiddenNames = regexp.MustCompile(`[/\\<>:"|?*]`)
-	dl_atmos       bool
-	dl_aac         bool
-	dl_select      bool
-	dl_song        bool
-	artist_select  bool
-	debug_mode     bool
-	alac_max       *int
-	atmos_max      *int
-	mv_max         *int
-	mv_audio_type  *string
-	aac_type       *string
-	Config         structs.ConfigSet
-	counter        structs.Counter
-	okDict         = make(map[string][]int)
-	lastDownloadedPaths []string
-	activeProgress func(phase string, done, total int64)
-	downloadedMetaMu sync.Mutex
-	downloadedMeta   = make(map[string]AudioMeta)
-	searchMetaMu     sync.Mutex
-	searchMetaByID   = make(map[string]AudioMeta)
+	Config          structs.ConfigSet
+	downloadHistory *history.Store
+	searchMetaMu    sync.Mutex
+	searchMetaByID  = make(map[string]AudioMeta)
 )
 
+// Session carries the options and results of one download job, so jobs with different
+// options (e.g. the bot's per-chat formats) can run side by side.
+type Session struct {
+	Config    structs.ConfigSet
+	Atmos     bool
+	AAC       bool
+	Select    bool
+	Song      bool
+	AllAlbums bool
+	Debug     bool
+	Sync      bool
+	Tracks    []int
+	// Codecs lists the codecs each release is downloaded in, e.g. alac, atmos and aac-binaural.
+	Codecs   []string
+	Progress func(phase string, done, total int64)
+	Events   *events.Emitter
+	// Context, when set, stops the session from starting further tracks once it is canceled.
+	Context context.Context
+	// Plan is set for dry runs: everything is resolved and recorded in it, but nothing is downloaded or written.
+	Plan *plan.Plan
+
+	// URLArtistName and URLArtistID name the artist whose page is being downloaded,
+	// for {UrlArtistName} and {ArtistId} in artist-folder-format.
+	URLArtistName string
+	URLArtistID   string
+
+	// syncFiles maps the track IDs of a playlist being synced to the files of its previous sync.
+	syncFiles map[string]string
+	// shared holds what the codec passes of one release fetch only once.
+	shared *releaseCache
+
+	*sessionResults
+}
+
+// sessionResults is shared by a session and the sessions derived from it.
+type sessionResults struct {
+	mu            sync.Mutex
+	counter       structs.Counter
+	okDict        map[string][]int
+	paths         []string
+	meta          map[string]AudioMeta
+	progressLines *progress.Lines
+	codecCounts   map[string]structs.Counter
+	codecOrder    []string
+	presetCounts  map[string]int
+	presetOrder   []string
+}
+
+// releaseCache keeps responses, covers and lyrics fetched by the first codec pass of a release.
+type releaseCache struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func newReleaseCache() *releaseCache {
+	return &releaseCache{values: make(map[string][]byte)}
+}
+
+// get returns the cached value of key. A nil cache never has a value.
+func (c *releaseCache) get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.values[key]
+	return value, ok
+}
+
+func (c *releaseCache) put(key string, value []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.values[key] = value
+	c.mu.Unlock()
+}
+
+// NewSession returns a session working on its own copy of cfg.
+func NewSession(cfg structs.ConfigSet) *Session {
+	return &Session{
+		Config: cfg,
+		sessionResults: &sessionResults{
+			okDict:        make(map[string][]int),
+			meta:          make(map[string]AudioMeta),
+			progressLines: progress.NewLines(os.Stdout),
+		},
+	}
+}
+
+// derive returns a copy of s with its own options that still reports into the results of s.
+func (s *Session) derive() *Session {
+	d := *s
+	return &d
+}
+
+// Counter returns a snapshot of the session counters.
+func (s *Session) Counter() structs.Counter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counter
+}
+
+// ResetCounter clears the counters before the queue is retried.
+func (s *Session) ResetCounter() {
+	s.mu.Lock()
+	s.counter = structs.Counter{}
+	s.codecCounts = nil
+	s.codecOrder = nil
+	s.presetCounts = nil
+	s.presetOrder = nil
+	s.mu.Unlock()
+}
+
+// countPreference counts a track downloaded in the given quality-preference option.
+func (s *Session) countPreference(preference string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.presetCounts == nil {
+		s.presetCounts = make(map[string]int)
+	}
+	if _, ok := s.presetCounts[preference]; !ok {
+		s.presetOrder = append(s.presetOrder, preference)
+	}
+	s.presetCounts[preference]++
+}
+
+// PreferenceCounters returns how many tracks were downloaded in each quality-preference option,
+// in the order the options were first used.
+func (s *Session) PreferenceCounters() ([]string, map[string]int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[string]int, len(s.presetCounts))
+	for preference, n := range s.presetCounts {
+		counts[preference] = n
+	}
+	return append([]string{}, s.presetOrder...), counts
+}
+
+// addCodecCounts adds the counts of one codec pass to the per-codec summary.
+func (s *Session) addCodecCounts(codec string, before structs.Counter, after structs.Counter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.codecCounts == nil {
+		s.codecCounts = make(map[string]structs.Counter)
+	}
+	c, ok := s.codecCounts[codec]
+	if !ok {
+		s.codecOrder = append(s.codecOrder, codec)
+	}
+	c.Total += after.Total - before.Total
+	c.Success += after.Success - before.Success
+	c.Unavailable += after.Unavailable - before.Unavailable
+	c.NotSong += after.NotSong - before.NotSong
+	c.Error += after.Error - before.Error
+	s.codecCounts[codec] = c
+}
+
+// CodecCounters returns the per-codec counters of a --codecs run, in the order the codecs were given.
+func (s *Session) CodecCounters() ([]string, map[string]structs.Counter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[string]structs.Counter, len(s.codecCounts))
+	for codec, c := range s.codecCounts {
+		counts[codec] = c
+	}
+	return append([]string{}, s.codecOrder...), counts
+}
+
+// Paths returns the files downloaded by the session so far.
+func (s *Session) Paths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.paths...)
+}
+
+func (s *Session) DownloadedMeta(path string) (AudioMeta, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	meta, ok := s.meta[path]
+	return meta, ok
+}
+
 type AudioMeta struct {
 	TrackID   string
 	Title     string
@@ -108,14 +290,23 @@ func loadConfig() error {
 	if len(Config.Storefront) != 2 {
 		Config.Storefront = "us"
 	}
+	for i, storefront := range Config.FallbackStorefronts {
+		Config.FallbackStorefronts[i] = strings.ToLower(strings.TrimSpace(storefront))
+	}
+	if _, err := quality.Parse(Config.QualityPreference); err != nil {
+		return fmt.Errorf("quality-preference: %w", err)
+	}
 	return nil
 }
 
-func recordDownloadedTrack(track *task.Track) {
+func (s *Session) recordDownloadedTrack(track *task.Track) {
 	if track == nil || track.SavePath == "" {
 		return
 	}
-	lastDownloadedPaths = append(lastDownloadedPaths, track.SavePath)
+	s.mu.Lock()
+	s.paths = append(s.paths, track.SavePath)
+	s.mu.Unlock()
+	s.Events.Emit(trackEvent(events.TrackFinished, track))
 	meta := AudioMeta{
 		TrackID:   strings.TrimSpace(track.ID),
 		Title:     strings.TrimSpace(track.Resp.Attributes.Name),
@@ -133,26 +324,98 @@ func recordDownloadedTrack(track *task.Track) {
 		}
 	}
 	if meta.Title != "" || meta.Performer != "" {
-		downloadedMetaMu.Lock()
-		downloadedMeta[track.SavePath] = meta
-		downloadedMetaMu.Unlock()
+		s.mu.Lock()
+		s.meta[track.SavePath] = meta
+		s.mu.Unlock()
 	}
+	recordHistory(track)
 }
 
-func getDownloadedMeta(path string) (AudioMeta, bool) {
-	downloadedMetaMu.Lock()
-	defer downloadedMetaMu.Unlock()
-	meta, ok := downloadedMeta[path]
-	return meta, ok
+// verifyLibrary checks the downloaded files under root for --verify and returns how many are broken.
+// With redownload, broken files found in the download history are deleted and returned as queue entries.
+func verifyLibrary(root string, redownload bool) (int, []batch.Entry) {
+	byPath := make(map[string]history.Entry)
+	for _, entry := range downloadHistory.Entries() {
+		byPath[entry.Path] = entry
+	}
+	checked, broken := 0, 0
+	var queue []batch.Entry
+	err := verify.Walk(root, verify.DefaultTolerance, func(report verify.Report) {
+		checked++
+		if report.OK() {
+			return
+		}
+		broken++
+		fmt.Println("\u26A0", report)
+		if !redownload {
+			return
+		}
+		path, _ := filepath.Abs(report.Path)
+		entry, ok := byPath[path]
+		if !ok {
+			fmt.Println("  not in the download history, download it again by hand")
+			return
+		}
+		if err := os.Remove(report.Path); err != nil {
+			fmt.Println("  failed to delete:", err)
+			return
+		}
+		if _, err := downloadHistory.ForgetPath(entry.Path); err != nil {
+			fmt.Println("  failed to update the download history:", err)
+		}
+		song := amurl.Resource{Kind: amurl.Song, Storefront: Config.Storefront, ID: entry.TrackID}
+		queue = append(queue, batch.Entry{URL: song.URL(), Codec: strings.ToLower(entry.Codec)})
+	})
+	if err != nil {
+		fmt.Printf("Failed to read %s: %v\n", root, err)
+	}
+	fmt.Printf("Verified %d files, %d broken\n", checked, broken)
+	if len(queue) > 0 {
+		fmt.Printf("Downloading %d broken tracks again\n", len(queue))
+	}
+	return broken, queue
 }
 
-func clearDownloadState() {
-	lastDownloadedPaths = nil
-	downloadedMetaMu.Lock()
-	downloadedMeta = make(map[string]AudioMeta)
-	downloadedMetaMu.Unlock()
-	defer clearDownloadState()
-	debug.FreeOSMemory()
+func recordHistory(track *task.Track) {
+	if downloadHistory == nil {
+		return
+	}
+	entry := history.Entry{
+		TrackID: track.ID,
+		ISRC:    track.Resp.Attributes.Isrc,
+		AlbumID: trackAlbumID(track),
+		Name:    track.Resp.Attributes.Name,
+		Artist:  track.Resp.Attributes.ArtistName,
+		Codec:   track.Codec,
+		Quality: track.Quality,
+		Path:    track.SavePath,
+	}
+	if abs, err := filepath.Abs(track.SavePath); err == nil {
+		entry.Path = abs
+	}
+	sum, size, err := history.Checksum(track.SavePath)
+	if err != nil {
+		fmt.Println("Failed to checksum track:", err)
+	} else {
+		entry.Checksum = sum
+		entry.Size = size
+	}
+	if err := downloadHistory.Record(entry); err != nil {
+		fmt.Println("Failed to save download history:", err)
+	}
+}
+
+func trackAlbumID(track *task.Track) string {
+	if track.PreType == "albums" {
+		return track.PreID
+	}
+	if track.AlbumData.ID != "" {
+		return track.AlbumData.ID
+	}
+	if len(track.Resp.Relationships.Albums.Data) > 0 {
+		return track.Resp.Relationships.Albums.Data[0].ID
+	}
+	return ""
 }
 
 func setSearchMeta(trackID string, title string, performer string) {
@@ -183,108 +446,317 @@ func popSearchMeta(trackID string) (AudioMeta, bool) {
 	return meta, ok
 }
 
-func LimitString(s string) string {
-	if len([]rune(s)) > Config.LimitMax {
-		return string([]rune(s)[:Config.LimitMax])
+func (s *Session) LimitString(str string) string {
+	if len([]rune(str)) > s.Config.LimitMax {
+		return string([]rune(str)[:s.Config.LimitMax])
 	}
-	return s
+	return str
 }
 
-func isInArray(arr []int, target int) bool {
-	for _, num := range arr {
-		if num == target {
-			return true
-		}
+// codecName names the codec a release is downloaded in: ALAC, ATMOS or AAC, and AAC-LC, AAC-BINAURAL or
+// AAC-DOWNMIX for the other AAC types, so okDict and the download history tell the AAC variants apart.
+func (s *Session) codecName() string {
+	switch {
+	case s.Atmos:
+		return "ATMOS"
+	case s.AAC && s.Config.AacType != "" && s.Config.AacType != "aac":
+		return strings.ToUpper(s.Config.AacType)
+	case s.AAC:
+		return "AAC"
 	}
-	return false
+	return "ALAC"
 }
 
-func fileExists(path string) (bool, error) {
-	f, err := os.Stat(path)
-	if err == nil {
-		return !f.IsDir(), nil
-	} else if os.IsNotExist(err) {
-		return false, nil
+// okKey keys okDict by collection and codec, so the same album queued in two codecs is tracked separately.
+func okKey(id string, codec string) string {
+	return id + "|" + codec
+}
+
+// countTrack increments one of the counter fields; tracks of a collection may finish concurrently.
+func (s *Session) countTrack(field *int) {
+	s.mu.Lock()
+	*field++
+	s.mu.Unlock()
+}
+
+func (s *Session) markTrackDone(key string, num int) {
+	s.mu.Lock()
+	s.okDict[key] = append(s.okDict[key], num)
+	s.mu.Unlock()
+}
+
+// reportError counts a failure in field and reports it as an error event of the given type.
+func (s *Session) reportError(track *task.Track, field *int, errType string, err error) {
+	s.countTrack(field)
+	ev := events.Event{Type: events.Error, ErrorType: errType}
+	if track != nil {
+		ev = trackEvent(events.Error, track)
+		ev.ErrorType = errType
 	}
-	return false, err
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	s.Events.Emit(ev)
 }
 
-func checkUrl(url string) (string, string) {
-	pat := regexp.MustCompile(`^(?:https:\/\/(?:beta\.music|music|classical\.music)\.apple\.com\/(\w{2})(?:\/album|\/album\/.+))\/(?:id)?(\d[^\D]+)(?:$|\?)`)
-	matches := pat.FindAllStringSubmatch(url, -1)
+func trackEvent(eventType string, track *task.Track) events.Event {
+	return events.Event{
+		Type:    eventType,
+		TrackID: track.ID,
+		Name:    track.Resp.Attributes.Name,
+		Artist:  track.Resp.Attributes.ArtistName,
+		Album:   track.Resp.Attributes.AlbumName,
+		Codec:   track.Codec,
+		Quality: track.Quality,
+		Path:    track.SavePath,
+	}
+}
 
-	if matches == nil {
-		return "", ""
-	} else {
-		return matches[0][1], matches[0][2]
+// tagString joins the configured choices for Apple Digital Master, explicit and clean releases, for {Tag}.
+func (s *Session) tagString(master bool, contentRating string) string {
+	tags := []string{}
+	if master && s.Config.AppleMasterChoice != "" {
+		tags = append(tags, s.Config.AppleMasterChoice)
 	}
+	if contentRating == "explicit" && s.Config.ExplicitChoice != "" {
+		tags = append(tags, s.Config.ExplicitChoice)
+	}
+	if contentRating == "clean" && s.Config.CleanChoice != "" {
+		tags = append(tags, s.Config.CleanChoice)
+	}
+	return strings.Join(tags, " ")
 }
-func checkUrlMv(url string) (string, string) {
-	pat := regexp.MustCompile(`^(?:https:\/\/(?:beta\.music|music)\.apple\.com\/(\w{2})(?:\/music-video|\/music-video\/.+))\/(?:id)?(\d[^\D]+)(?:$|\?)`)
-	matches := pat.FindAllStringSubmatch(url, -1)
 
-	if matches == nil {
-		return "", ""
-	} else {
-		return matches[0][1], matches[0][2]
+func flagVar(set bool) string {
+	if set {
+		return "1"
 	}
+	return ""
 }
-func checkUrlSong(url string) (string, string) {
-	pat := regexp.MustCompile(`^(?:https:\/\/(?:beta\.music|music|classical\.music)\.apple\.com\/(\w{2})(?:\/song|\/song\/.+))\/(?:id)?(\d[^\D]+)(?:$|\?)`)
-	matches := pat.FindAllStringSubmatch(url, -1)
 
-	if matches == nil {
-		return "", ""
+// artistVars returns the variables of artist-folder-format. The artist of the page being
+// downloaded takes precedence over the given one.
+func (s *Session) artistVars(artistName string, artistID string) naming.Vars {
+	vars := naming.Vars{
+		"ArtistName":    s.LimitString(artistName),
+		"UrlArtistName": s.LimitString(artistName),
+		"ArtistId":      artistID,
+	}
+	if s.URLArtistName != "" {
+		vars["UrlArtistName"] = s.LimitString(s.URLArtistName)
+		vars["ArtistId"] = s.URLArtistID
+	}
+	return vars
+}
+
+// albumVars returns the naming variables of an album, shared by its folder and its tracks.
+func (s *Session) albumVars(album ampapi.AlbumRespData, quality string, codec string) naming.Vars {
+	attrs := album.Attributes
+	artistID := ""
+	if len(album.Relationships.Artists.Data) > 0 {
+		artistID = album.Relationships.Artists.Data[0].ID
+	}
+	vars := s.artistVars(attrs.ArtistName, artistID)
+	master := attrs.IsAppleDigitalMaster || attrs.IsMasteredForItunes
+	discTotal := 1
+	if tracks := album.Relationships.Tracks.Data; len(tracks) > 0 {
+		discTotal = tracks[len(tracks)-1].Attributes.DiscNumber
+	}
+	releaseYear := attrs.ReleaseDate
+	if len(releaseYear) > 4 {
+		releaseYear = releaseYear[:4]
+	}
+	for key, value := range map[string]string{
+		"AlbumName":   s.LimitString(attrs.Name),
+		"AlbumId":     album.ID,
+		"ReleaseDate": attrs.ReleaseDate,
+		"ReleaseYear": releaseYear,
+		"UPC":         attrs.Upc,
+		"RecordLabel": attrs.RecordLabel,
+		"Copyright":   attrs.Copyright,
+		"Quality":     quality,
+		"Codec":       codec,
+		"Tag":         s.tagString(master, attrs.ContentRating),
+		"Explicit":    flagVar(attrs.ContentRating == "explicit"),
+		"Clean":       flagVar(attrs.ContentRating == "clean"),
+		"AppleMaster": flagVar(master),
+		"TrackTotal":  strconv.Itoa(attrs.TrackCount),
+		"DiscTotal":   strconv.Itoa(discTotal),
+	} {
+		vars[key] = value
+	}
+	return vars
+}
+
+// playlistVars returns the naming variables of a playlist or station, shared by its folder and its tracks.
+func (s *Session) playlistVars(artistName string, name string, id string, quality string, codec string, tag string, trackTotal int) naming.Vars {
+	vars := s.artistVars(artistName, "")
+	for key, value := range map[string]string{
+		"PlaylistName": s.LimitString(name),
+		"PlaylistId":   id,
+		"Quality":      quality,
+		"Codec":        codec,
+		"Tag":          tag,
+		"TrackTotal":   strconv.Itoa(trackTotal),
+		"DiscTotal":    "1",
+	} {
+		vars[key] = value
+	}
+	return vars
+}
+
+// trackVars returns the naming variables of a track, on top of the variables of its album or playlist.
+func (s *Session) trackVars(track *task.Track, quality string) naming.Vars {
+	attrs := track.Resp.Attributes
+	var vars naming.Vars
+	if track.AlbumData.ID != "" {
+		vars = s.albumVars(track.AlbumData, quality, track.Codec)
 	} else {
-		return matches[0][1], matches[0][2]
+		vars = s.playlistVars("Apple Music", track.PlaylistData.Attributes.Name, track.PreID, quality, track.Codec, "", track.TaskTotal)
+	}
+	if track.PreType != "albums" {
+		vars["PlaylistName"] = s.LimitString(track.PlaylistData.Attributes.Name)
+		vars["PlaylistId"] = track.PreID
+	}
+	for key, value := range map[string]string{
+		"SongId":      track.ID,
+		"SongNumer":   fmt.Sprintf("%02d", track.TaskNum),
+		"SongNumber":  strconv.Itoa(track.TaskNum),
+		"SongName":    s.LimitString(attrs.Name),
+		"ArtistName":  s.LimitString(attrs.ArtistName),
+		"DiscNumber":  strconv.Itoa(attrs.DiscNumber),
+		"TrackNumber": strconv.Itoa(attrs.TrackNumber),
+		"TrackTotal":  strconv.Itoa(track.TaskTotal),
+		"Tag":         s.tagString(attrs.IsAppleDigitalMaster, attrs.ContentRating),
+		"Explicit":    flagVar(attrs.ContentRating == "explicit"),
+		"Clean":       flagVar(attrs.ContentRating == "clean"),
+		"AppleMaster": flagVar(attrs.IsAppleDigitalMaster),
+	} {
+		vars[key] = value
+	}
+	if track.DiscTotal > 0 {
+		vars["DiscTotal"] = strconv.Itoa(track.DiscTotal)
+	}
+	return vars
+}
+
+// folderName expands a folder format. The result is made valid for the filesystem by names().Component.
+func folderName(format string, vars naming.Vars) string {
+	return strings.TrimSpace(naming.Expand(format, vars))
+}
+
+// names returns the sanitizer for the configured filesystem profile.
+func (s *Session) names() *sanitize.Sanitizer {
+	return sanitize.New(s.Config.FilenameProfile, s.Config.MaxNameBytes, s.Config.MaxPathBytes)
+}
+
+// assignNameSuffixes appends the track ID to the file name of tracks that would overwrite an earlier
+// track of the same collection. Names are compared before the quality is known and across the whole
+// collection, so a track gets the same name whichever tracks are selected.
+func (s *Session) assignNameSuffixes(tracks []task.Track) {
+	names := make([]string, len(tracks))
+	ids := make([]string, len(tracks))
+	for i := range tracks {
+		vars := s.trackVars(&tracks[i], "")
+		delete(vars, "Quality")
+		names[i] = s.names().Component(naming.Expand(s.Config.SongFileFormat, vars))
+		ids[i] = tracks[i].ID
+	}
+	for i, name := range s.names().Unique(names, ids) {
+		tracks[i].NameSuffix = strings.TrimPrefix(name, names[i])
+	}
+}
+
+// planTrack records what a dry run would do with track.
+func (s *Session) planTrack(track *task.Track, path string, status string, reason string) {
+	s.Plan.Add(plan.Item{
+		Kind:       track.Type,
+		Collection: filepath.Base(track.SaveDir),
+		TrackID:    track.ID,
+		Name:       track.Resp.Attributes.Name,
+		Artist:     track.Resp.Attributes.ArtistName,
+		Codec:      track.Codec,
+		Quality:    track.Quality,
+		Path:       path,
+		Status:     status,
+		Reason:     reason,
+	})
+}
+
+// skipArchived reports whether track is already in the download history in its codec and marks doneKey if so.
+func (s *Session) skipArchived(track *task.Track, doneKey string) bool {
+	// a synced playlist keeps every track in its own folder and renames moved ones below, so tracks archived
+	// elsewhere or at their previous position must not be skipped here
+	if s.syncFiles != nil {
+		return false
+	}
+	entry, ok := downloadHistory.Lookup(track.ID, track.Resp.Attributes.Isrc, track.Codec)
+	if !ok {
+		return false
 	}
+	fmt.Println("Track already archived:", entry.Path)
+	if s.Plan != nil {
+		s.planTrack(track, entry.Path, plan.Archived, "")
+	}
+	s.countTrack(&s.counter.Success)
+	s.markTrackDone(doneKey, track.TaskNum)
+	return true
 }
-func checkUrlPlaylist(url string) (string, string) {
-	pat := regexp.MustCompile(`^(?:https:\/\/(?:beta\.music|music|classical\.music)\.apple\.com\/(\w{2})(?:\/playlist|\/playlist\/.+))\/(?:id)?(pl\.[\w-]+)(?:$|\?)`)
-	matches := pat.FindAllStringSubmatch(url, -1)
 
-	if matches == nil {
-		return "", ""
-	} else {
-		return matches[0][1], matches[0][2]
+// mkdirAll creates a save folder unless this is a dry run.
+func (s *Session) mkdirAll(path string) {
+	if s.Plan == nil {
+		os.MkdirAll(path, os.ModePerm)
 	}
 }
 
-func checkUrlStation(url string) (string, string) {
-	pat := regexp.MustCompile(`^(?:https:\/\/(?:beta\.music|music)\.apple\.com\/(\w{2})(?:\/station|\/station\/.+))\/(?:id)?(ra\.[\w-]+)(?:$|\?)`)
-	matches := pat.FindAllStringSubmatch(url, -1)
+func (s *Session) isTrackDone(key string, num int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return isInArray(s.okDict[key], num)
+}
 
-	if matches == nil {
-		return "", ""
-	} else {
-		return matches[0][1], matches[0][2]
+func isInArray(arr []int, target int) bool {
+	for _, num := range arr {
+		if num == target {
+			return true
+		}
 	}
+	return false
 }
 
-func checkUrlArtist(url string) (string, string) {
-	pat := regexp.MustCompile(`^(?:https:\/\/(?:beta\.music|music|classical\.music)\.apple\.com\/(\w{2})(?:\/artist|\/artist\/.+))\/(?:id)?(\d[^\D]+)(?:$|\?)`)
-	matches := pat.FindAllStringSubmatch(url, -1)
-
-	if matches == nil {
-		return "", ""
-	} else {
-		return matches[0][1], matches[0][2]
+func fileExists(path string) (bool, error) {
+	f, err := os.Stat(path)
+	if err == nil {
+		return !f.IsDir(), nil
+	} else if os.IsNotExist(err) {
+		return false, nil
 	}
+	return false, err
 }
-func getUrlSong(songUrl string, token string) (string, error) {
-	storefront, songId := checkUrlSong(songUrl)
-	manifest, err := ampapi.GetSongResp(storefront, songId, Config.Language, token)
+
+func (s *Session) getUrlSong(songUrl string, token string) (string, error) {
+	res, err := amurl.Parse(songUrl, amurl.Song)
+	if err != nil {
+		return "", err
+	}
+	storefront, songId := res.StorefrontOr(s.Config.Storefront), res.ID
+	manifest, err := ampapi.GetSongResp(storefront, songId, s.Config.Language, token)
 	if err != nil {
 		fmt.Println("\u26A0 Failed to get manifest:", err)
-		counter.NotSong++
+		s.countTrack(&s.counter.NotSong)
 		return "", err
 	}
 	albumId := manifest.Data[0].Relationships.Albums.Data[0].ID
 	songAlbumUrl := fmt.Sprintf("https://music.apple.com/%s/album/1/%s?i=%s", storefront, albumId, songId)
 	return songAlbumUrl, nil
 }
-func getUrlArtistName(artistUrl string, token string) (string, string, error) {
-	storefront, artistId := checkUrlArtist(artistUrl)
+func (s *Session) getUrlArtistName(artistUrl string, token string) (string, string, error) {
+	res, err := amurl.Parse(artistUrl, amurl.Artist)
+	if err != nil {
+		return "", "", err
+	}
+	storefront, artistId := res.StorefrontOr(s.Config.Storefront), res.ID
 	req, err := http.NewRequest("GET", fmt.Sprintf("https://amp-api.music.apple.com/v1/catalog/%s/artists/%s", storefront, artistId), nil)
 	if err != nil {
 		return "", "", err
@@ -293,7 +765,7 @@ func getUrlArtistName(artistUrl string, token string) (string, string, error) {
 	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
 	req.Header.Set("Origin", "https://music.apple.com")
 	query := url.Values{}
-	query.Set("l", Config.Language)
+	query.Set("l", s.Config.Language)
 	req.URL.RawQuery = query.Encode()
 	do, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -311,55 +783,66 @@ func getUrlArtistName(artistUrl string, token string) (string, string, error) {
 	return obj.Data[0].Attributes.Name, obj.Data[0].ID, nil
 }
 
-func checkArtist(artistUrl string, token string, relationship string) ([]string, error) {
-	storefront, artistId := checkUrlArtist(artistUrl)
-	Num := 0
-	//id := 1
+func (s *Session) checkArtist(artistUrl string, token string, relationship string) ([]string, error) {
+	res, err := amurl.Parse(artistUrl, amurl.Artist)
+	if err != nil {
+		return nil, err
+	}
+	storefront, artistId := res.StorefrontOr(s.Config.Storefront), res.ID
+	releases, err := ampapi.GetArtistReleases(storefront, artistId, relationship, s.Config.Language, token)
+	if err != nil {
+		return nil, err
+	}
+	header := []string{"", "Album Name", "Date", "Album ID"}
+	if relationship == "music-videos" {
+		header = []string{"", "MV Name", "Date", "MV ID"}
+	}
+	return s.selectReleases(releases, header, relationship), nil
+}
+
+// checkCollection lists the albums and playlists of a curator, record label or room and returns the selected URLs.
+func (s *Session) checkCollection(collectionUrl string, token string) ([]string, error) {
+	res, err := amurl.Parse(collectionUrl, "")
+	if err != nil {
+		return nil, err
+	}
+	storefront := res.StorefrontOr(s.Config.Storefront)
+	var releases []ampapi.ArtistRelease
+	switch res.Kind {
+	case amurl.Curator:
+		releases, err = ampapi.GetCuratorPlaylists(storefront, res.ID, s.Config.Language, token)
+	case amurl.RecordLabel:
+		releases, err = ampapi.GetRecordLabelReleases(storefront, res.ID, s.Config.Language, token)
+	case amurl.Room:
+		releases, err = ampapi.GetRoomContents(storefront, res.ID, s.Config.Language, token)
+	default:
+		return nil, fmt.Errorf("%s is not a curator, record label or room", collectionUrl)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var urls []string
+	for _, link := range s.selectReleases(releases, []string{"", "Name", "Date", "ID"}, res.Kind+" releases") {
+		// rooms can also list songs and music videos; keep what downloads as a release
+		if kind := urlKind(link); kind == amurl.Album || kind == amurl.Playlist || kind == amurl.MusicVideo {
+			urls = append(urls, link)
+		}
+	}
+	return urls, nil
+}
+
+// selectReleases prints releases as a numbered table and returns the URLs the user picks,
+// or all of them with --all.
+func (s *Session) selectReleases(releases []ampapi.ArtistRelease, header []string, what string) []string {
 	var args []string
 	var urls []string
 	var options [][]string
-	for {
-		req, err := http.NewRequest("GET", fmt.Sprintf("https://amp-api.music.apple.com/v1/catalog/%s/artists/%s/%s?limit=100&offset=%d&l=%s", storefront, artistId, relationship, Num, Config.Language), nil)
-		if err != nil {
-			return nil, err
-		}
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-		req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
-		req.Header.Set("Origin", "https://music.apple.com")
-		do, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return nil, err
-		}
-		defer do.Body.Close()
-		if do.StatusCode != http.StatusOK {
-			return nil, errors.New(do.Status)
-		}
-		obj := new(structs.AutoGeneratedArtist)
-		err = json.NewDecoder(do.Body).Decode(&obj)
-		if err != nil {
-			return nil, err
-		}
-		for _, album := range obj.Data {
-			options = append(options, []string{album.Attributes.Name, album.Attributes.ReleaseDate, album.ID, album.Attributes.URL})
-		}
-		Num = Num + 100
-		if len(obj.Next) == 0 {
-			break
-		}
+	for _, release := range releases {
+		options = append(options, []string{release.Name, release.ReleaseDate, release.ID, release.URL})
 	}
-	sort.Slice(options, func(i, j int) bool {
-		// 将日期字符串解析为 time.Time 类型进行比较
-		dateI, _ := time.Parse("2006-01-02", options[i][1])
-		dateJ, _ := time.Parse("2006-01-02", options[j][1])
-		return dateI.Before(dateJ) // 返回 true 表示 i 在 j 前面
-	})
 
 	table := tablewriter.NewWriter(os.Stdout)
-	if relationship == "albums" {
-		table.SetHeader([]string{"", "Album Name", "Date", "Album ID"})
-	} else if relationship == "music-videos" {
-		table.SetHeader([]string{"", "MV Name", "Date", "MV ID"})
-	}
+	table.SetHeader(header)
 	table.SetRowLine(false)
 	table.SetHeaderColor(tablewriter.Colors{},
 		tablewriter.Colors{tablewriter.FgRedColor, tablewriter.Bold},
@@ -376,12 +859,12 @@ func checkArtist(artistUrl string, token string, relationship string) ([]string,
 		table.Append(options[i])
 	}
 	table.Render()
-	if artist_select {
+	if s.AllAlbums {
 		fmt.Println("You have selected all options:")
-		return urls, nil
+		return urls
 	}
 	reader := bufio.NewReader(os.Stdin)
-	fmt.Println("Please select from the " + relationship + " options above (multiple options separated by commas, ranges supported, or type 'all' to select all)")
+	fmt.Println("Please select from the " + what + " options above (multiple options separated by commas, ranges supported, or type 'all' to select all)")
 	cyanColor := color.New(color.FgCyan)
 	cyanColor.Print("Enter your choice: ")
 	input, _ := reader.ReadString('\n')
@@ -389,7 +872,7 @@ func checkArtist(artistUrl string, token string, relationship string) ([]string,
 	input = strings.TrimSpace(input)
 	if input == "all" {
 		fmt.Println("You have selected all options:")
-		return urls, nil
+		return urls
 	}
 
 	selectedOptions := [][]string{}
@@ -436,19 +919,22 @@ func checkArtist(artistUrl string, token string, relationship string) ([]string,
 			fmt.Println("Invalid option:", opt)
 		}
 	}
-	return args, nil
+	return args
 }
 
-func writeCover(sanAlbumFolder, name string, url string) (string, error) {
+func (s *Session) writeCover(sanAlbumFolder, name string, url string) (string, error) {
 	originalUrl := url
 	var ext string
 	var covPath string
-	if Config.CoverFormat == "original" {
+	if s.Config.CoverFormat == "original" {
 		ext = strings.Split(url, "/")[len(strings.Split(url, "/"))-2]
 		ext = ext[strings.LastIndex(ext, ".")+1:]
 		covPath = filepath.Join(sanAlbumFolder, name+"."+ext)
 	} else {
-		covPath = filepath.Join(sanAlbumFolder, name+"."+Config.CoverFormat)
+		covPath = filepath.Join(sanAlbumFolder, name+"."+s.Config.CoverFormat)
+	}
+	if s.Plan != nil {
+		return covPath, nil
 	}
 	exists, err := fileExists(covPath)
 	if err != nil {
@@ -458,13 +944,17 @@ func writeCover(sanAlbumFolder, name string, url string) (string, error) {
 	if exists {
 		_ = os.Remove(covPath)
 	}
-	if Config.CoverFormat == "png" {
+	coverKey := "cover/" + originalUrl + "/" + s.Config.CoverFormat + "/" + s.Config.CoverSize
+	if data, ok := s.shared.get(coverKey); ok {
+		return covPath, os.WriteFile(covPath, data, 0644)
+	}
+	if s.Config.CoverFormat == "png" {
 		re := regexp.MustCompile(`\{w\}x\{h\}`)
 		parts := re.Split(url, 2)
 		url = parts[0] + "{w}x{h}" + strings.Replace(parts[1], ".jpg", ".png", 1)
 	}
-	url = strings.Replace(url, "{w}x{h}", Config.CoverSize, 1)
-	if Config.CoverFormat == "original" {
+	url = strings.Replace(url, "{w}x{h}", s.Config.CoverSize, 1)
+	if s.Config.CoverFormat == "original" {
 		url = strings.Replace(url, "is1-ssl.mzstatic.com/image/thumb", "a5.mzstatic.com/us/r1000/0", 1)
 		url = url[:strings.LastIndex(url, "/")]
 	}
@@ -479,12 +969,12 @@ func writeCover(sanAlbumFolder, name string, url string) (string, error) {
 	}
 	defer do.Body.Close()
 	if do.StatusCode != http.StatusOK {
-		if Config.CoverFormat == "original" {
+		if s.Config.CoverFormat == "original" {
 			fmt.Println("Failed to get cover, falling back to " + ext + " url.")
 			splitByDot := strings.Split(originalUrl, ".")
 			last := splitByDot[len(splitByDot)-1]
 			fallback := originalUrl[:len(originalUrl)-len(last)] + ext
-			fallback = strings.Replace(fallback, "{w}x{h}", Config.CoverSize, 1)
+			fallback = strings.Replace(fallback, "{w}x{h}", s.Config.CoverSize, 1)
 			fmt.Println("Fallback URL:", fallback)
 			req, err = http.NewRequest("GET", fallback, nil)
 			if err != nil {
@@ -506,18 +996,31 @@ func writeCover(sanAlbumFolder, name string, url string) (string, error) {
 			return "", errors.New(do.Status)
 		}
 	}
-	f, err := os.Create(covPath)
+	data, err := io.ReadAll(do.Body)
 	if err != nil {
 		return "", err
 	}
-	defer f.Close()
-	_, err = io.Copy(f, do.Body)
-	if err != nil {
+	if err := os.WriteFile(covPath, data, 0644); err != nil {
 		return "", err
 	}
+	s.shared.put(coverKey, data)
 	return covPath, nil
 }
 
+// getLyrics fetches the lyrics of track, or reuses the ones fetched by an earlier codec pass.
+func (s *Session) getLyrics(track *task.Track, token string, mediaUserToken string) (string, error) {
+	key := "lyrics/" + track.ID + "/" + s.Config.LrcType + "/" + s.Config.LrcFormat
+	if data, ok := s.shared.get(key); ok {
+		return string(data), nil
+	}
+	lrc, err := lyrics.Get(track.Storefront, track.ID, s.Config.LrcType, s.Config.Language, s.Config.LrcFormat, token, mediaUserToken)
+	if err != nil {
+		return "", err
+	}
+	s.shared.put(key, []byte(lrc))
+	return lrc, nil
+}
+
 func writeLyrics(sanAlbumFolder, filename string, lrc string) error {
 	lyricspath := filepath.Join(sanAlbumFolder, filename)
 	f, err := os.Create(lyricspath)
@@ -541,25 +1044,25 @@ func contains(slice []string, item string) bool {
 	return false
 }
 
-func setDlFlags(quality string) {
-	dl_atmos = false
-	dl_aac = false
+func (s *Session) setDlFlags(quality string) {
+	s.Atmos = false
+	s.AAC = false
 
 	switch quality {
 	case "atmos":
-		dl_atmos = true
+		s.Atmos = true
 		fmt.Println("Quality set to: Dolby Atmos")
 	case "aac":
-		dl_aac = true
-		*aac_type = "aac"
+		s.AAC = true
+		s.Config.AacType = "aac"
 		fmt.Println("Quality set to: High-Quality (AAC)")
 	case "alac":
 		fmt.Println("Quality set to: Lossless (ALAC)")
 	}
 }
 
-func handleSearch(searchType string, queryParts []string, token string) (string, error) {
-	selection, err := apputils.HandleSearch(searchType, queryParts, token, Config.Storefront, Config.Language)
+func (s *Session) handleSearch(searchType string, queryParts []string, token string) (string, error) {
+	selection, err := apputils.HandleSearch(searchType, queryParts, token, s.Config.Storefront, s.Config.Language)
 	if err != nil {
 		return "", err
 	}
@@ -567,30 +1070,144 @@ func handleSearch(searchType string, queryParts []string, token string) (string,
 		return "", nil
 	}
 	if selection.IsSong {
-		dl_song = true
+		s.Song = true
 	}
 	if selection.Quality != "" && selection.Quality != "default" {
-		setDlFlags(selection.Quality)
+		s.setDlFlags(selection.Quality)
 	}
 	return selection.URL, nil
 }
 
-func convertIfNeeded(track *task.Track, lrc string) {
+func (s *Session) convertIfNeeded(track *task.Track, lrc string, progress apputils.ProgressFunc) {
 	coverPath := ""
-	if strings.EqualFold(Config.ConvertFormat, "flac") && track.SaveDir != "" {
+	if strings.EqualFold(s.Config.ConvertFormat, "flac") && track.SaveDir != "" {
 		coverPath = findCoverFile(track.SaveDir)
 	}
-	apputils.ConvertIfNeeded(track, lrc, &Config, coverPath, activeProgress)
+	srcPath := track.SavePath
+	apputils.ConvertIfNeeded(track, lrc, &s.Config, coverPath, progress)
+	if track.SavePath != srcPath {
+		ev := trackEvent(events.Converted, track)
+		ev.Format = strings.ToLower(s.Config.ConvertFormat)
+		s.Events.Emit(ev)
+	}
+}
+
+
+// trackProgressFunc returns the progress callback for a track. With several download workers the
+// terminal progress bars would interleave, so each track then reports labelled progress lines instead.
+func (s *Session) trackProgressFunc(track *task.Track) func(phase string, done, total int64) {
+	var report func(phase string, done, total int64)
+	if s.Progress != nil {
+		report = s.Progress
+	} else if s.Config.DownloadConcurrency > 1 {
+		report = s.progressLines.Task(fmt.Sprintf("%02d/%02d %s", track.TaskNum, track.TaskTotal, s.LimitString(track.Resp.Attributes.Name)))
+	}
+	emit := s.Events.Progress(events.Event{TrackID: track.ID, Name: track.Resp.Attributes.Name})
+	if emit == nil {
+		return report
+	}
+	if report == nil {
+		return emit
+	}
+	return func(phase string, done, total int64) {
+		report(phase, done, total)
+		emit(phase, done, total)
+	}
+}
+
+// ripTracks downloads tracks with up to download-concurrency workers.
+func (s *Session) ripTracks(tracks []*task.Track, token string, mediaUserToken string) {
+	workers := s.Config.DownloadConcurrency
+	if workers > len(tracks) {
+		workers = len(tracks)
+	}
+	if workers <= 1 {
+		for _, track := range tracks {
+			s.ripTrack(track, token, mediaUserToken)
+		}
+		return
+	}
+	jobs := make(chan *task.Track)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for track := range jobs {
+				s.ripTrack(track, token, mediaUserToken)
+			}
+		}()
+	}
+	for _, track := range tracks {
+		jobs <- track
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// trackError is a failed download attempt. ripTrack retries it unless it is permanent.
+type trackError struct {
+	kind      string
+	err       error
+	permanent bool
+}
+
+func (e *trackError) Error() string {
+	return e.err.Error()
+}
+
+// ripTrack downloads a track, retrying failed attempts up to Config.Retries times with exponential backoff.
+func (s *Session) ripTrack(track *task.Track, token string, mediaUserToken string) {
+	if s.canceled() {
+		return
+	}
+	s.countTrack(&s.counter.Total)
+	// a quality-preference fallback moves the track to the codec and folder it chose, so every attempt
+	// starts again from the ones of the pass
+	codec, saveDir := track.Codec, track.SaveDir
+	for attempt := 0; ; attempt++ {
+		track.Codec, track.SaveDir = codec, saveDir
+		err := s.downloadTrack(track, token, mediaUserToken)
+		if err == nil {
+			return
+		}
+		var failed *trackError
+		if !errors.As(err, &failed) {
+			failed = &trackError{kind: events.ErrDownload, err: err}
+		}
+		if failed.permanent || attempt >= s.Config.Retries || s.canceled() {
+			s.reportError(track, &s.counter.Error, failed.kind, failed.err)
+			return
+		}
+		delay := retryDelay(attempt)
+		fmt.Printf("Retrying %s in %s (attempt %d of %d)\n", track.Resp.Attributes.Name, delay, attempt+2, s.Config.Retries+1)
+		time.Sleep(delay)
+	}
+}
+
+// canceled reports whether the session's context was canceled.
+func (s *Session) canceled() bool {
+	return s.Context != nil && s.Context.Err() != nil
 }
 
+// retryDelay returns the backoff before retry attempt+1: 2s, 4s, 8s, ... capped at one minute.
+func retryDelay(attempt int) time.Duration {
+	delay := 2 * time.Second << attempt
+	if delay <= 0 || delay > time.Minute {
+		return time.Minute
+	}
+	return delay
+}
 
-func ripTrack(track *task.Track, token string, mediaUserToken string) {
+// downloadTrack makes one attempt at downloading a track. Failures worth retrying are returned as a *trackError,
+// all other outcomes are counted here.
+func (s *Session) downloadTrack(track *task.Track, token string, mediaUserToken string) error {
 	var err error
-	counter.Total++
 	fmt.Printf("Track %d of %d: %s\n", track.TaskNum, track.TaskTotal, track.Type)
+	trackProgress := s.trackProgressFunc(track)
 
 	//提前获取到的播放列表下track所在的专辑信息
-	if track.PreType == "playlists" && Config.UseSongInfoForPlaylist {
+	if track.PreType == "playlists" && s.Config.UseSongInfoForPlaylist {
 		track.GetAlbumData(token)
 	}
 
@@ -598,135 +1215,145 @@ func ripTrack(track *task.Track, token string, mediaUserToken string) {
 	if track.Type == "music-videos" {
 		if len(mediaUserToken) <= 50 {
 			fmt.Println("meida-user-token is not set, skip MV dl")
-			counter.Success++
-			return
-		}
-		if _, err := exec.LookPath("mp4decrypt"); err != nil {
-			fmt.Println("mp4decrypt is not found, skip MV dl")
-			counter.Success++
-			return
+			s.countTrack(&s.counter.Success)
+			return nil
 		}
-		err := mvDownloader(track.ID, track.SaveDir, token, track.Storefront, mediaUserToken, track)
+		err := s.mvDownloader(track.ID, track.SaveDir, token, track.Storefront, mediaUserToken, track)
 		if err != nil {
 			fmt.Println("\u26A0 Failed to dl MV:", err)
-			counter.Error++
-			return
+			return &trackError{kind: events.ErrDownload, err: err}
+		}
+		s.countTrack(&s.counter.Success)
+		return nil
+	}
+
+	// the queue retries tracks by the codec of the pass, which a quality-preference fallback does not change
+	doneKey := okKey(track.PreID, track.Codec)
+	if s.skipArchived(track, doneKey) {
+		return nil
+	}
+
+	fallback := ""
+	if chain := s.qualityChain(); len(chain) > 1 {
+		choice, option, ok := s.chooseQuality(track, chain, mediaUserToken)
+		if !ok {
+			fmt.Println("Unavailable")
+			if s.Plan != nil {
+				s.planTrack(track, "", plan.Unavailable, "no quality-preference option available")
+			}
+			s.reportError(track, &s.counter.Unavailable, events.ErrUnavailable, errors.New("Unavailable"))
+			return nil
+		}
+		if option != chain[0] {
+			fmt.Println("Falling back to", option)
+			fallback = "falls back to " + option.String()
+		}
+		// the rest of the download runs with the codec settings of the chosen option
+		primary := s
+		s = choice
+		track.Preference = option.String()
+		if codec := s.codecName(); codec != track.Codec {
+			// a fallback is saved, named and recorded as the codec it really is
+			if rel, err := filepath.Rel(primary.saveFolder(), track.SaveDir); err == nil && !strings.HasPrefix(rel, "..") {
+				track.SaveDir = filepath.Join(s.saveFolder(), rel)
+				s.mkdirAll(track.SaveDir)
+			}
+			track.Codec = codec
+			if s.skipArchived(track, doneKey) {
+				return nil
+			}
 		}
-		counter.Success++
-		return
 	}
 
 	needDlAacLc := false
-	if dl_aac && Config.AacType == "aac-lc" {
+	if s.AAC && s.Config.AacType == "aac-lc" {
 		needDlAacLc = true
 	}
 	if track.WebM3u8 == "" && !needDlAacLc {
-		if dl_atmos {
+		if s.Atmos {
 			fmt.Println("Unavailable")
-			counter.Unavailable++
-			return
+			if s.Plan != nil {
+				s.planTrack(track, "", plan.Unavailable, "no atmos variant")
+			}
+			s.reportError(track, &s.counter.Unavailable, events.ErrUnavailable, errors.New("Unavailable"))
+			return nil
 		}
 		fmt.Println("Unavailable, trying to dl aac-lc")
 		needDlAacLc = true
 	}
 	needCheck := false
 
-	if Config.GetM3u8Mode == "all" {
+	if s.Config.GetM3u8Mode == "all" {
 		needCheck = true
-	} else if Config.GetM3u8Mode == "hires" && contains(track.Resp.Attributes.AudioTraits, "hi-res-lossless") {
+	} else if s.Config.GetM3u8Mode == "hires" && contains(track.Resp.Attributes.AudioTraits, "hi-res-lossless") {
 		needCheck = true
 	}
 	var EnhancedHls_m3u8 string
 	if needCheck && !needDlAacLc {
-		EnhancedHls_m3u8, _ = checkM3u8(track.ID, "song")
+		EnhancedHls_m3u8, _ = s.checkM3u8(track.ID, "song")
 		if strings.HasSuffix(EnhancedHls_m3u8, ".m3u8") {
 			track.DeviceM3u8 = EnhancedHls_m3u8
 			track.M3u8 = EnhancedHls_m3u8
 		}
 	}
 	var Quality string
-	if strings.Contains(Config.SongFileFormat, "Quality") {
-		if dl_atmos {
-			Quality = fmt.Sprintf("%dKbps", Config.AtmosMax-2000)
+	if strings.Contains(s.Config.SongFileFormat, "Quality") || s.Plan != nil {
+		if s.Atmos {
+			Quality = fmt.Sprintf("%dKbps", s.Config.AtmosMax-2000)
 		} else if needDlAacLc {
 			Quality = "256Kbps"
 		} else {
-			_, Quality, err = extractMedia(track.M3u8, true)
+			_, Quality, err = s.extractMedia(track.M3u8, true)
 			if err != nil {
 				fmt.Println("Failed to extract quality from manifest.\n", err)
-				counter.Error++
-				return
+				return &trackError{kind: events.ErrManifest, err: err}
 			}
 		}
 	}
 	track.Quality = Quality
+	s.Events.Emit(trackEvent(events.TrackResolved, track))
 
-	stringsToJoin := []string{}
-	if track.Resp.Attributes.IsAppleDigitalMaster {
-		if Config.AppleMasterChoice != "" {
-			stringsToJoin = append(stringsToJoin, Config.AppleMasterChoice)
-		}
-	}
-	if track.Resp.Attributes.ContentRating == "explicit" {
-		if Config.ExplicitChoice != "" {
-			stringsToJoin = append(stringsToJoin, Config.ExplicitChoice)
-		}
-	}
-	if track.Resp.Attributes.ContentRating == "clean" {
-		if Config.CleanChoice != "" {
-			stringsToJoin = append(stringsToJoin, Config.CleanChoice)
-		}
-	}
-	Tag_string := strings.Join(stringsToJoin, " ")
-
-	songName := strings.NewReplacer(
-		"{SongId}", track.ID,
-		"{SongNumer}", fmt.Sprintf("%02d", track.TaskNum),
-		"{SongName}", LimitString(track.Resp.Attributes.Name),
-		"{ArtistName}", LimitString(track.Resp.Attributes.ArtistName),
-		"{DiscNumber}", fmt.Sprintf("%0d", track.Resp.Attributes.DiscNumber),
-		"{TrackNumber}", fmt.Sprintf("%0d", track.Resp.Attributes.TrackNumber),
-		"{Quality}", Quality,
-		"{Tag}", Tag_string,
-		"{Codec}", track.Codec,
-	).Replace(Config.SongFileFormat)
+	songName := naming.Expand(s.Config.SongFileFormat, s.trackVars(track, Quality))
 	fmt.Println(songName)
-	filename := fmt.Sprintf("%s.m4a", forbiddenNames.ReplaceAllString(songName, "_"))
+	baseName := s.names().Base(track.SaveDir, songName, track.NameSuffix+".m4a", track.NameSuffix+"."+s.Config.LrcFormat) + track.NameSuffix
+	filename := baseName + ".m4a"
 	track.SaveName = filename
 	trackPath := filepath.Join(track.SaveDir, track.SaveName)
-	lrcFilename := fmt.Sprintf("%s.%s", forbiddenNames.ReplaceAllString(songName, "_"), Config.LrcFormat)
+	lrcFilename := baseName + "." + s.Config.LrcFormat
 
 	// Determine possible post-conversion target file (so we can skip re-download)
 	var convertedPath string
-	conversionEnabled := Config.ConvertAfterDownload &&
-		Config.ConvertFormat != "" &&
-		strings.ToLower(Config.ConvertFormat) != "copy"
+	conversionEnabled := s.Config.ConvertAfterDownload &&
+		s.Config.ConvertFormat != "" &&
+		strings.ToLower(s.Config.ConvertFormat) != "copy"
 	considerConverted := false
 	if conversionEnabled {
-		convertedPath = strings.TrimSuffix(trackPath, filepath.Ext(trackPath)) + "." + strings.ToLower(Config.ConvertFormat)
-		if !Config.ConvertKeepOriginal {
+		convertedPath = strings.TrimSuffix(trackPath, filepath.Ext(trackPath)) + "." + strings.ToLower(s.Config.ConvertFormat)
+		if !s.Config.ConvertKeepOriginal {
 			considerConverted = true
 		}
 	}
 	//get lrc
 	var lrc string = ""
-	if Config.EmbedLrc || Config.SaveLrcFile {
-		lrcStr, err := lyrics.Get(track.Storefront, track.ID, Config.LrcType, Config.Language, Config.LrcFormat, token, mediaUserToken)
+	if (s.Config.EmbedLrc || s.Config.SaveLrcFile) && s.Plan == nil {
+		lrcStr, err := s.getLyrics(track, token, mediaUserToken)
 		if err != nil {
 			fmt.Println(err)
 		} else {
-			if Config.SaveLrcFile {
+			if s.Config.SaveLrcFile {
 				err := writeLyrics(track.SaveDir, lrcFilename, lrcStr)
 				if err != nil {
 					fmt.Printf("Failed to write lyrics")
 				}
 			}
-			if Config.EmbedLrc {
+			if s.Config.EmbedLrc {
 				lrc = lrcStr
 			}
 		}
 	}
 
+	s.moveSynced(track, trackPath)
+
 	// Existence check now considers converted output (if original was deleted)
 	existsOriginal, err := fileExists(trackPath)
 	if err != nil {
@@ -734,6 +1361,10 @@ func ripTrack(track *task.Track, token string, mediaUserToken string) {
 	}
 	if existsOriginal {
 		fmt.Println("Track already exists locally.")
+		if s.Plan != nil {
+			s.planTrack(track, trackPath, plan.Exists, "")
+			return nil
+		}
 		track.SavePath = trackPath
 		track.SaveName = filepath.Base(trackPath)
 		if conversionEnabled {
@@ -743,173 +1374,227 @@ func ripTrack(track *task.Track, token string, mediaUserToken string) {
 					track.SavePath = convertedPath
 					track.SaveName = filepath.Base(convertedPath)
 				} else {
-					convertIfNeeded(track, lrc)
+					s.convertIfNeeded(track, lrc, trackProgress)
 				}
 			} else {
-				convertIfNeeded(track, lrc)
+				s.convertIfNeeded(track, lrc, trackProgress)
 			}
 		}
-		recordDownloadedTrack(track)
-		counter.Success++
-		okDict[track.PreID] = append(okDict[track.PreID], track.TaskNum)
-		return
+		s.recordDownloadedTrack(track)
+		s.countTrack(&s.counter.Success)
+		s.markTrackDone(doneKey, track.TaskNum)
+		return nil
 	}
 	if considerConverted {
 		existsConverted, err2 := fileExists(convertedPath)
 		if err2 == nil && existsConverted {
 			fmt.Println("Converted track already exists locally.")
+			if s.Plan != nil {
+				s.planTrack(track, convertedPath, plan.Exists, "")
+				return nil
+			}
 			track.SavePath = convertedPath
 			track.SaveName = filepath.Base(convertedPath)
-			recordDownloadedTrack(track)
-			counter.Success++
-			okDict[track.PreID] = append(okDict[track.PreID], track.TaskNum)
-			return
+			s.recordDownloadedTrack(track)
+			s.countTrack(&s.counter.Success)
+			s.markTrackDone(doneKey, track.TaskNum)
+			return nil
 		}
 	}
 
+	if s.Plan != nil {
+		reason := fallback
+		if needDlAacLc && !s.AAC {
+			reason = "falls back to aac-lc"
+		}
+		if conversionEnabled && considerConverted {
+			trackPath = convertedPath
+		}
+		s.planTrack(track, trackPath, plan.Download, reason)
+		return nil
+	}
 	if needDlAacLc {
 		if len(mediaUserToken) <= 50 {
 			fmt.Println("Invalid media-user-token")
-			counter.Error++
-			return
+			return &trackError{kind: events.ErrToken, err: errors.New("invalid media-user-token"), permanent: true}
 		}
-		_, err := runv3.Run(track.ID, trackPath, token, mediaUserToken, false, "", activeProgress)
+		_, err := runv3.Run(track.ID, trackPath, token, mediaUserToken, false, "", trackProgress)
 		if err != nil {
 			fmt.Println("Failed to dl aac-lc:", err)
 			if err.Error() == "Unavailable" {
-				counter.Unavailable++
-				return
+				s.reportError(track, &s.counter.Unavailable, events.ErrUnavailable, err)
+				return nil
 			}
-			counter.Error++
-			return
+			return &trackError{kind: events.ErrDownload, err: err}
+		}
+		if track.Quality == "" {
+			track.Quality = "256Kbps"
 		}
+		track.Variant = manifest.Variant{Codec: "mp4a.40.2", Audio: "aac-lc", Bandwidth: 256000}
 	} else {
-		trackM3u8Url, _, err := extractMedia(track.M3u8, false)
+		trackM3u8Url, trackQuality, variant, err := s.extractVariant(track.M3u8, false)
 		if err != nil {
 			fmt.Println("\u26A0 Failed to extract info from manifest:", err)
-			counter.Unavailable++
-			return
+			s.reportError(track, &s.counter.Unavailable, events.ErrManifest, err)
+			return nil
 		}
+		if track.Quality == "" {
+			track.Quality = trackQuality
+		}
+		track.Variant = variant
 		//边下载边解密
-		err = runv2.Run(track.ID, trackM3u8Url, trackPath, Config, activeProgress)
+		err = runv2.Run(track.ID, trackM3u8Url, trackPath, s.Config, trackProgress)
 		if err != nil {
 			fmt.Println("Failed to run v2:", err)
-			counter.Error++
-			return
+			return &trackError{kind: events.ErrDownload, err: err}
 		}
 	}
-	//这里利用MP4box将fmp4转化为mp4，并添加ilst box与cover，方便后面的mp4tag添加更多自定义标签
-	tags := []string{
-		"tool=",
-		"artist=AppleMusic",
+	if s.Config.VerifyDownloads {
+		expected := time.Duration(track.Resp.Attributes.DurationInMillis) * time.Millisecond
+		if report := verify.File(trackPath, expected, verify.DefaultTolerance); !report.OK() {
+			problems := strings.Join(report.Problems, "; ")
+			fmt.Println("\u26A0 Downloaded file failed verification:", problems)
+			_ = os.Remove(trackPath)
+			return &trackError{kind: events.ErrVerify, err: errors.New("verification failed: " + problems)}
+		}
 	}
-	if Config.EmbedCover {
-		if (strings.Contains(track.PreID, "pl.") || strings.Contains(track.PreID, "ra.")) && Config.DlAlbumcoverForPlaylist {
-			track.CoverPath, err = writeCover(track.SaveDir, track.ID, track.Resp.Attributes.Artwork.URL)
+	//将fmp4转化为mp4，并添加ilst box与cover，方便后面的mp4tag添加更多自定义标签
+	var tags remux.Tags
+	if s.Config.EmbedCover {
+		if (strings.Contains(track.PreID, "pl.") || strings.Contains(track.PreID, "ra.")) && s.Config.DlAlbumcoverForPlaylist {
+			track.CoverPath, err = s.writeCover(track.SaveDir, track.ID, track.Resp.Attributes.Artwork.URL)
 			if err != nil {
 				fmt.Println("Failed to write cover.")
 			}
 		}
-		tags = append(tags, fmt.Sprintf("cover=%s", track.CoverPath))
+		tags.Cover = track.CoverPath
 	}
-	tagsString := strings.Join(tags, ":")
-	cmd := exec.Command("MP4Box", "-itags", tagsString, trackPath)
-	if err := cmd.Run(); err != nil {
+	if err := remux.File(trackPath, tags); err != nil {
 		fmt.Printf("Embed failed: %v\n", err)
-		counter.Error++
-		return
+		return &trackError{kind: events.ErrTagging, err: err}
 	}
-	if (strings.Contains(track.PreID, "pl.") || strings.Contains(track.PreID, "ra.")) && Config.DlAlbumcoverForPlaylist {
+	if (strings.Contains(track.PreID, "pl.") || strings.Contains(track.PreID, "ra.")) && s.Config.DlAlbumcoverForPlaylist {
 		if err := os.Remove(track.CoverPath); err != nil {
 			fmt.Printf("Error deleting file: %s\n", track.CoverPath)
-			counter.Error++
-			return
+			return &trackError{kind: events.ErrTagging, err: err}
 		}
 	}
 	track.SavePath = trackPath
-	err = writeMP4Tags(track, lrc)
+	err = s.writeMP4Tags(track, lrc)
 	if err != nil {
 		fmt.Println("\u26A0 Failed to write tags in media:", err)
-		counter.Unavailable++
-		return
+		s.reportError(track, &s.counter.Unavailable, events.ErrTagging, err)
+		return nil
 	}
 
 	// CONVERSION FEATURE hook
-	convertIfNeeded(track, lrc)
+	s.convertIfNeeded(track, lrc, trackProgress)
+
+	s.recordDownloadedTrack(track)
+	s.countTrack(&s.counter.Success)
+	if track.Preference != "" {
+		s.countPreference(track.Preference)
+	}
+	s.markTrackDone(doneKey, track.TaskNum)
+	return nil
+}
 
-	recordDownloadedTrack(track)
-	counter.Success++
-	okDict[track.PreID] = append(okDict[track.PreID], track.TaskNum)
+// qualityChain returns the quality-preference options from the codec the run asks for on.
+// It is empty when quality-preference is unset or does not list that codec.
+func (s *Session) qualityChain() []quality.Option {
+	chain, err := quality.Parse(s.Config.QualityPreference)
+	if err != nil {
+		return nil
+	}
+	codec := quality.ALAC
+	if s.Atmos {
+		codec = quality.Atmos
+	} else if s.AAC {
+		codec = s.Config.AacType
+	}
+	return quality.From(chain, codec)
+}
+
+// chooseQuality returns a session set up for the first option of chain that track is available in.
+func (s *Session) chooseQuality(track *task.Track, chain []quality.Option, mediaUserToken string) (*Session, quality.Option, bool) {
+	for _, option := range chain {
+		d := s.derive()
+		d.Atmos = option.Codec == quality.Atmos
+		d.AAC = option.IsAAC()
+		switch {
+		case option.Codec == quality.ALAC && option.Max > 0:
+			d.Config.AlacMax = option.Max
+		case option.Codec == quality.Atmos && option.Max > 0:
+			d.Config.AtmosMax = option.Max
+		case option.IsAAC():
+			d.Config.AacType = option.Codec
+		}
+		if option.Codec == quality.AACLC {
+			// aac-lc comes from the web stream every track has, but needs a media-user-token
+			if len(mediaUserToken) > 50 {
+				return d, option, true
+			}
+			continue
+		}
+		if track.WebM3u8 == "" {
+			continue
+		}
+		if _, _, err := d.extractMedia(track.M3u8, true); err == nil {
+			return d, option, true
+		}
+	}
+	return nil, quality.Option{}, false
 }
 
-func ripStation(albumId string, token string, storefront string, mediaUserToken string) error {
+func (s *Session) ripStation(albumId string, token string, storefront string, mediaUserToken string) error {
 	station := task.NewStation(storefront, albumId)
-	err := station.GetResp(mediaUserToken, token, Config.Language)
+	err := station.GetResp(mediaUserToken, token, s.Config.Language)
 	if err != nil {
 		return err
 	}
 	fmt.Println(" -", station.Type)
 	meta := station.Resp
 
-	var Codec string
-	if dl_atmos {
-		Codec = "ATMOS"
-	} else if dl_aac {
-		Codec = "AAC"
-	} else {
-		Codec = "ALAC"
-	}
+	Codec := s.codecName()
 	station.Codec = Codec
 	var singerFoldername string
-	if Config.ArtistFolderFormat != "" {
-		singerFoldername = strings.NewReplacer(
-			"{ArtistName}", "Apple Music Station",
-			"{ArtistId}", "",
-			"{UrlArtistName}", "Apple Music Station",
-		).Replace(Config.ArtistFolderFormat)
-		if strings.HasSuffix(singerFoldername, ".") {
-			singerFoldername = strings.ReplaceAll(singerFoldername, ".", "")
-		}
-		singerFoldername = strings.TrimSpace(singerFoldername)
+	if s.Config.ArtistFolderFormat != "" {
+		singerFoldername = folderName(s.Config.ArtistFolderFormat, naming.Vars{
+			"ArtistName":    "Apple Music Station",
+			"ArtistId":      "",
+			"UrlArtistName": "Apple Music Station",
+		})
 		fmt.Println(singerFoldername)
 	}
-	singerFolder := filepath.Join(Config.AlacSaveFolder, forbiddenNames.ReplaceAllString(singerFoldername, "_"))
-	if dl_atmos {
-		singerFolder = filepath.Join(Config.AtmosSaveFolder, forbiddenNames.ReplaceAllString(singerFoldername, "_"))
+	singerFolder := filepath.Join(s.Config.AlacSaveFolder, s.names().Component(singerFoldername))
+	if s.Atmos {
+		singerFolder = filepath.Join(s.Config.AtmosSaveFolder, s.names().Component(singerFoldername))
 	}
-	if dl_aac {
-		singerFolder = filepath.Join(Config.AacSaveFolder, forbiddenNames.ReplaceAllString(singerFoldername, "_"))
+	if s.AAC {
+		singerFolder = filepath.Join(s.Config.AacSaveFolder, s.names().Component(singerFoldername))
 	}
-	os.MkdirAll(singerFolder, os.ModePerm)
+	s.mkdirAll(singerFolder)
 	station.SaveDir = singerFolder
 
-	playlistFolder := strings.NewReplacer(
-		"{ArtistName}", "Apple Music Station",
-		"{PlaylistName}", LimitString(station.Name),
-		"{PlaylistId}", station.ID,
-		"{Quality}", "",
-		"{Codec}", Codec,
-		"{Tag}", "",
-	).Replace(Config.PlaylistFolderFormat)
-	if strings.HasSuffix(playlistFolder, ".") {
-		playlistFolder = strings.ReplaceAll(playlistFolder, ".", "")
-	}
-	playlistFolder = strings.TrimSpace(playlistFolder)
-	playlistFolderPath := filepath.Join(singerFolder, forbiddenNames.ReplaceAllString(playlistFolder, "_"))
-	os.MkdirAll(playlistFolderPath, os.ModePerm)
+	stationVars := s.playlistVars("Apple Music Station", station.Name, station.ID, "", Codec, "", len(station.Tracks))
+	stationVars["UrlArtistName"] = "Apple Music Station"
+	stationVars["ArtistId"] = ""
+	playlistFolder := folderName(s.Config.PlaylistFolderFormat, stationVars)
+	playlistFolderPath := filepath.Join(singerFolder, s.names().Component(playlistFolder))
+	s.mkdirAll(playlistFolderPath)
 	station.SaveName = playlistFolder
 	fmt.Println(playlistFolder)
 
-	covPath, err := writeCover(playlistFolderPath, "cover", meta.Data[0].Attributes.Artwork.URL)
+	covPath, err := s.writeCover(playlistFolderPath, "cover", meta.Data[0].Attributes.Artwork.URL)
 	if err != nil {
 		fmt.Println("Failed to write cover.")
 	}
 	station.CoverPath = covPath
 
-	if Config.SaveAnimatedArtwork && meta.Data[0].Attributes.EditorialVideo.MotionSquare.Video != "" {
+	if s.Config.SaveAnimatedArtwork && s.Plan == nil && meta.Data[0].Attributes.EditorialVideo.MotionSquare.Video != "" {
 		fmt.Println("Found Animation Artwork.")
 
-		motionvideoUrlSquare, err := extractVideo(meta.Data[0].Attributes.EditorialVideo.MotionSquare.Video)
+		motionvideoUrlSquare, err := s.extractVideo(meta.Data[0].Attributes.EditorialVideo.MotionSquare.Video)
 		if err != nil {
 			fmt.Println("no motion video square.\n", err)
 		} else {
@@ -930,7 +1615,7 @@ func ripStation(albumId string, token string, storefront string, mediaUserToken
 			}
 		}
 
-		if Config.EmbyAnimatedArtwork {
+		if s.Config.EmbyAnimatedArtwork {
 			cmd3 := exec.Command("ffmpeg", "-i", filepath.Join(playlistFolderPath, "square_animated_artwork.mp4"), "-vf", "scale=440:-1", "-r", "24", "-f", "gif", filepath.Join(playlistFolderPath, "folder.jpg"))
 			if err := cmd3.Run(); err != nil {
 				fmt.Printf("animated artwork square to gif err: %v\n", err)
@@ -938,36 +1623,44 @@ func ripStation(albumId string, token string, storefront string, mediaUserToken
 		}
 	}
 	if station.Type == "stream" {
-		counter.Total++
-		if isInArray(okDict[station.ID], 1) {
-			counter.Success++
+		s.countTrack(&s.counter.Total)
+		if s.isTrackDone(okKey(station.ID, Codec), 1) {
+			s.countTrack(&s.counter.Success)
 			return nil
 		}
-		songName := strings.NewReplacer(
-			"{SongId}", station.ID,
-			"{SongNumer}", "01",
-			"{SongName}", LimitString(station.Name),
-			"{ArtistName}", "Apple Music Station",
-			"{DiscNumber}", "1",
-			"{TrackNumber}", "1",
-			"{Quality}", "256Kbps",
-			"{Tag}", "",
-			"{Codec}", "AAC",
-		).Replace(Config.SongFileFormat)
+		streamVars := s.playlistVars("Apple Music Station", station.Name, station.ID, "256Kbps", "AAC", "", 1)
+		for key, value := range map[string]string{
+			"SongId":      station.ID,
+			"SongNumer":   "01",
+			"SongNumber":  "1",
+			"SongName":    s.LimitString(station.Name),
+			"DiscNumber":  "1",
+			"TrackNumber": "1",
+		} {
+			streamVars[key] = value
+		}
+		songName := naming.Expand(s.Config.SongFileFormat, streamVars)
 		fmt.Println(songName)
-		trackPath := filepath.Join(playlistFolderPath, fmt.Sprintf("%s.m4a", forbiddenNames.ReplaceAllString(songName, "_")))
+		trackPath := filepath.Join(playlistFolderPath, s.names().Base(playlistFolderPath, songName, ".m4a")+".m4a")
 		exists, _ := fileExists(trackPath)
 		if exists {
-			counter.Success++
-			okDict[station.ID] = append(okDict[station.ID], 1)
+			s.countTrack(&s.counter.Success)
+			s.markTrackDone(okKey(station.ID, Codec), 1)
 
 			fmt.Println("Radio already exists locally.")
+			if s.Plan != nil {
+				s.Plan.Add(plan.Item{Kind: "stations", TrackID: station.ID, Name: station.Name, Codec: "AAC", Quality: "256Kbps", Path: trackPath, Status: plan.Exists})
+			}
+			return nil
+		}
+		if s.Plan != nil {
+			s.Plan.Add(plan.Item{Kind: "stations", TrackID: station.ID, Name: station.Name, Codec: "AAC", Quality: "256Kbps", Path: trackPath, Status: plan.Download})
 			return nil
 		}
 		assetsUrl, serverUrl, err := ampapi.GetStationAssetsUrlAndServerUrl(station.ID, mediaUserToken, token)
 		if err != nil {
 			fmt.Println("Failed to get station assets url.", err)
-			counter.Error++
+			s.reportError(nil, &s.counter.Error, events.ErrDownload, err)
 			return err
 		}
 		trackM3U8 := strings.ReplaceAll(assetsUrl, "index.m3u8", "256/prog_index.m3u8")
@@ -975,30 +1668,28 @@ func ripStation(albumId string, token string, storefront string, mediaUserToken
 		err = runv3.ExtMvData(keyAndUrls, trackPath)
 		if err != nil {
 			fmt.Println("Failed to download station stream.", err)
-			counter.Error++
+			s.reportError(nil, &s.counter.Error, events.ErrDownload, err)
 			return err
 		}
-		tags := []string{
-			"tool=",
-			"disk=1/1",
-			"track=1",
-			"tracknum=1/1",
-			fmt.Sprintf("artist=%s", "Apple Music Station"),
-			fmt.Sprintf("performer=%s", "Apple Music Station"),
-			fmt.Sprintf("album_artist=%s", "Apple Music Station"),
-			fmt.Sprintf("album=%s", station.Name),
-			fmt.Sprintf("title=%s", station.Name),
-		}
-		if Config.EmbedCover {
-			tags = append(tags, fmt.Sprintf("cover=%s", station.CoverPath))
-		}
-		tagsString := strings.Join(tags, ":")
-		cmd := exec.Command("MP4Box", "-itags", tagsString, trackPath)
-		if err := cmd.Run(); err != nil {
+		tags := remux.Tags{
+			Title:       station.Name,
+			Artist:      "Apple Music Station",
+			Album:       station.Name,
+			AlbumArtist: "Apple Music Station",
+			Track:       1,
+			TrackTotal:  1,
+			Disc:        1,
+			DiscTotal:   1,
+			Custom:      map[string]string{"PERFORMER": "Apple Music Station"},
+		}
+		if s.Config.EmbedCover {
+			tags.Cover = station.CoverPath
+		}
+		if err := remux.File(trackPath, tags); err != nil {
 			fmt.Printf("Embed failed: %v\n", err)
 		}
-		counter.Success++
-		okDict[station.ID] = append(okDict[station.ID], 1)
+		s.countTrack(&s.counter.Success)
+		s.markTrackDone(okKey(station.ID, Codec), 1)
 		return nil
 	}
 
@@ -1007,6 +1698,7 @@ func ripStation(albumId string, token string, storefront string, mediaUserToken
 		station.Tracks[i].SaveDir = playlistFolderPath
 		station.Tracks[i].Codec = Codec
 	}
+	s.assignNameSuffixes(station.Tracks)
 
 	trackTotal := len(station.Tracks)
 	arr := make([]int, trackTotal)
@@ -1015,27 +1707,228 @@ func ripStation(albumId string, token string, storefront string, mediaUserToken
 	}
 	var selected []int
 
-	if true {
+	if len(s.Tracks) > 0 {
+		selected = s.Tracks
+	} else {
 		selected = arr
 	}
+	var tracks []*task.Track
 	for i := range station.Tracks {
 		i++
 		if isInArray(selected, i) {
-			ripTrack(&station.Tracks[i-1], token, mediaUserToken)
+			tracks = append(tracks, &station.Tracks[i-1])
 		}
 	}
+	s.ripTracks(tracks, token, mediaUserToken)
+	if s.Config.SavePlaylistM3u8 {
+		s.writePlaylistFile(playlistFolderPath, station.Tracks, nil)
+	}
 	return nil
 }
 
-func ripAlbum(albumId string, token string, storefront string, mediaUserToken string, urlArg_i string) error {
+// writeSidecars writes album.nfo and album.json into the album folder and artist.nfo into the artist folder
+// for save-nfo and save-album-json. artist.nfo is only written when the album has its own artist folder.
+func (s *Session) writeSidecars(albumFolder string, artistFolder string, hasArtistFolder bool, data ampapi.AlbumRespData, cover string, artistCover string) {
+	if (!s.Config.SaveNfo && !s.Config.SaveAlbumJson) || s.Plan != nil {
+		return
+	}
+	album := sidecar.NewAlbum(data)
+	if err := sidecar.WriteAlbum(albumFolder, album, cover, s.Config.SaveNfo, s.Config.SaveAlbumJson); err != nil {
+		fmt.Println("Failed to write album sidecars:", err)
+	}
+	if !s.Config.SaveNfo || !hasArtistFolder || len(album.Artists) == 0 {
+		return
+	}
+	if err := sidecar.WriteArtist(artistFolder, album.Artists[0], artistCover); err != nil {
+		fmt.Println("Failed to write artist.nfo:", err)
+	}
+}
+
+// loadAlbum fetches the album response, or reuses the one fetched by an earlier codec pass.
+func (s *Session) loadAlbum(album *task.Album, token string) error {
+	if s.shared == nil {
+		return album.GetResp(token, s.Config.Language)
+	}
+	key := "album/" + album.Storefront + "/" + album.ID + "/" + s.Config.Language
+	var resp ampapi.AlbumResp
+	if data, ok := s.shared.get(key); ok && json.Unmarshal(data, &resp) == nil {
+		album.SetResp(resp, s.Config.Language)
+		return nil
+	}
+	fetched, err := ampapi.GetAlbumResp(album.Storefront, album.ID, s.Config.Language, token)
+	if err != nil {
+		return errors.New("error getting album response")
+	}
+	// cached as JSON so every pass gets its own copy to modify
+	if data, err := json.Marshal(fetched); err == nil {
+		s.shared.put(key, data)
+	}
+	album.SetResp(*fetched, s.Config.Language)
+	return nil
+}
+
+// loadPlaylist fetches the playlist response, or reuses the one fetched by an earlier codec pass.
+// Library playlists are read from the user's library and their tracks mapped to catalog songs.
+func (s *Session) loadPlaylist(playlist *task.Playlist, token string) error {
+	res, err := amurl.Parse(playlist.ID, "")
+	library := err == nil && res.Library
+	if s.shared == nil && !library {
+		return playlist.GetResp(token, s.Config.Language)
+	}
+	key := "playlist/" + playlist.Storefront + "/" + playlist.ID + "/" + s.Config.Language
+	var resp ampapi.PlaylistResp
+	if data, ok := s.shared.get(key); ok && json.Unmarshal(data, &resp) == nil {
+		playlist.SetResp(resp, s.Config.Language)
+		return nil
+	}
+	var fetched *ampapi.PlaylistResp
+	if library {
+		var skipped int
+		fetched, skipped, err = ampapi.GetLibraryPlaylistResp(playlist.Storefront, playlist.ID, s.Config.Language, token, s.Config.MediaUserToken)
+		if err == nil && skipped > 0 {
+			fmt.Printf("%d uploaded tracks have no Apple Music match and are skipped\n", skipped)
+		}
+	} else {
+		fetched, err = ampapi.GetPlaylistResp(playlist.Storefront, playlist.ID, s.Config.Language, token)
+	}
+	if err != nil {
+		return errors.New("error getting playlist response")
+	}
+	if data, err := json.Marshal(fetched); err == nil {
+		s.shared.put(key, data)
+	}
+	playlist.SetResp(*fetched, s.Config.Language)
+	return nil
+}
+
+// albumFromStorefronts loads an album its own storefront does not have from the first fallback storefront that has it.
+func (s *Session) albumFromStorefronts(albumId string, token string, storefront string) *task.Album {
+	for _, fallback := range s.Config.FallbackStorefronts {
+		if fallback == storefront {
+			continue
+		}
+		album := task.NewAlbum(fallback, albumId)
+		if s.loadAlbum(album, token) == nil {
+			fmt.Printf("Album not available in %s, using storefront %s\n", strings.ToUpper(storefront), strings.ToUpper(fallback))
+			return album
+		}
+	}
+	return nil
+}
+
+// fillFromStorefronts replaces the tracks of album that cannot be streamed in its storefront, and adds the
+// tracks the storefront leaves out, with the same tracks from the fallback storefronts. Tracks are matched
+// by ISRC or by disc and track number on the album with the same UPC, and keep their place on the album.
+func (s *Session) fillFromStorefronts(album *task.Album, token string) {
+	if len(s.Config.FallbackStorefronts) == 0 {
+		return
+	}
+	data := &album.Resp.Data[0]
+	tracks := data.Relationships.Tracks.Data
+	type position struct{ disc, track int }
+	listed := make(map[position]bool)
+	isrcs := make(map[string]bool)
+	var unavailable []int
+	for i, track := range tracks {
+		listed[position{track.Attributes.DiscNumber, track.Attributes.TrackNumber}] = true
+		if track.Attributes.Isrc != "" {
+			isrcs[track.Attributes.Isrc] = true
+		}
+		if track.Attributes.ExtendedAssetUrls.EnhancedHls == "" && track.Type == "songs" {
+			unavailable = append(unavailable, i)
+		}
+	}
+	missing := data.Attributes.TrackCount - len(tracks)
+	if len(unavailable) == 0 && missing <= 0 {
+		return
+	}
+	// storefront each filled track is downloaded from, by track ID
+	filled := make(map[string]string)
+	for _, fallback := range s.Config.FallbackStorefronts {
+		if fallback == album.Storefront {
+			continue
+		}
+		if len(unavailable) == 0 && missing <= 0 {
+			break
+		}
+		var altTracks []ampapi.TrackRespData
+		if altID, err := ampapi.GetAlbumIDByUPC(fallback, data.Attributes.Upc, token); err == nil {
+			if alt, err := ampapi.GetAlbumResp(fallback, altID, album.Language, token); err == nil {
+				altTracks = alt.Data[0].Relationships.Tracks.Data
+			}
+		}
+		var still []int
+		for _, i := range unavailable {
+			alt, ok := ampapi.MatchTrack(altTracks, tracks[i])
+			if !ok && tracks[i].Attributes.Isrc != "" {
+				if songs, err := ampapi.GetSongsByISRC(fallback, tracks[i].Attributes.Isrc, album.Language, token); err == nil {
+					alt, ok = ampapi.MatchTrack(songs.Data, tracks[i])
+				}
+			}
+			if !ok {
+				still = append(still, i)
+				continue
+			}
+			// keep the numbering of the album being downloaded
+			alt.Attributes.DiscNumber = tracks[i].Attributes.DiscNumber
+			alt.Attributes.TrackNumber = tracks[i].Attributes.TrackNumber
+			tracks[i] = alt
+			filled[alt.ID] = fallback
+		}
+		unavailable = still
+		for _, alt := range altTracks {
+			if missing <= 0 {
+				break
+			}
+			pos := position{alt.Attributes.DiscNumber, alt.Attributes.TrackNumber}
+			if listed[pos] || isrcs[alt.Attributes.Isrc] || alt.Attributes.ExtendedAssetUrls.EnhancedHls == "" {
+				continue
+			}
+			tracks = append(tracks, alt)
+			listed[pos] = true
+			if alt.Attributes.Isrc != "" {
+				isrcs[alt.Attributes.Isrc] = true
+			}
+			filled[alt.ID] = fallback
+			missing--
+		}
+	}
+	if len(filled) == 0 {
+		return
+	}
+	sort.SliceStable(tracks, func(i, j int) bool {
+		a, b := tracks[i].Attributes, tracks[j].Attributes
+		if a.DiscNumber != b.DiscNumber {
+			return a.DiscNumber < b.DiscNumber
+		}
+		return a.TrackNumber < b.TrackNumber
+	})
+	data.Relationships.Tracks.Data = tracks
+	album.Tracks = nil
+	album.SetResp(album.Resp, album.Language)
+	for i := range album.Tracks {
+		if fallback, ok := filled[album.Tracks[i].ID]; ok {
+			album.Tracks[i].Storefront = fallback
+			fmt.Printf("Track %d filled from storefront %s\n", album.Tracks[i].TaskNum, strings.ToUpper(fallback))
+		}
+	}
+}
+
+func (s *Session) ripAlbum(albumId string, token string, storefront string, mediaUserToken string, urlArg_i string) error {
 	album := task.NewAlbum(storefront, albumId)
-	err := album.GetResp(token, Config.Language)
+	err := s.loadAlbum(album, token)
+	if err != nil {
+		if alt := s.albumFromStorefronts(albumId, token, storefront); alt != nil {
+			album, storefront, err = alt, alt.Storefront, nil
+		}
+	}
 	if err != nil {
 		fmt.Println("Failed to get album response.")
 		return err
 	}
+	s.fillFromStorefronts(album, token)
 	meta := album.Resp
-	if debug_mode {
+	if s.Debug {
 		fmt.Println(meta.Data[0].Attributes.ArtistName)
 		fmt.Println(meta.Data[0].Attributes.Name)
 
@@ -1055,13 +1948,13 @@ func ripAlbum(albumId string, token string, storefront string, mediaUserToken st
 				m3u8Url = manifest.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls
 			}
 			needCheck := false
-			if Config.GetM3u8Mode == "all" {
+			if s.Config.GetM3u8Mode == "all" {
 				needCheck = true
-			} else if Config.GetM3u8Mode == "hires" && contains(track.Attributes.AudioTraits, "hi-res-lossless") {
+			} else if s.Config.GetM3u8Mode == "hires" && contains(track.Attributes.AudioTraits, "hi-res-lossless") {
 				needCheck = true
 			}
 			if needCheck {
-				fullM3u8Url, err := checkM3u8(track.ID, "song")
+				fullM3u8Url, err := s.checkM3u8(track.ID, "song")
 				if err == nil && strings.HasSuffix(fullM3u8Url, ".m3u8") {
 					m3u8Url = fullM3u8Url
 				} else {
@@ -1069,7 +1962,7 @@ func ripAlbum(albumId string, token string, storefront string, mediaUserToken st
 				}
 			}
 
-			_, _, err = extractMedia(m3u8Url, true)
+			_, _, err = s.extractMedia(m3u8Url, true)
 			if err != nil {
 				fmt.Printf("Failed to extract quality info for track %d: %v\n", trackNum, err)
 				continue
@@ -1077,50 +1970,27 @@ func ripAlbum(albumId string, token string, storefront string, mediaUserToken st
 		}
 		return nil
 	}
-	var Codec string
-	if dl_atmos {
-		Codec = "ATMOS"
-	} else if dl_aac {
-		Codec = "AAC"
-	} else {
-		Codec = "ALAC"
-	}
+	Codec := s.codecName()
 	album.Codec = Codec
 	var singerFoldername string
-	if Config.ArtistFolderFormat != "" {
-		if len(meta.Data[0].Relationships.Artists.Data) > 0 {
-			singerFoldername = strings.NewReplacer(
-				"{UrlArtistName}", LimitString(meta.Data[0].Attributes.ArtistName),
-				"{ArtistName}", LimitString(meta.Data[0].Attributes.ArtistName),
-				"{ArtistId}", meta.Data[0].Relationships.Artists.Data[0].ID,
-			).Replace(Config.ArtistFolderFormat)
-		} else {
-			singerFoldername = strings.NewReplacer(
-				"{UrlArtistName}", LimitString(meta.Data[0].Attributes.ArtistName),
-				"{ArtistName}", LimitString(meta.Data[0].Attributes.ArtistName),
-				"{ArtistId}", "",
-			).Replace(Config.ArtistFolderFormat)
-		}
-		if strings.HasSuffix(singerFoldername, ".") {
-			singerFoldername = strings.ReplaceAll(singerFoldername, ".", "")
-		}
-		singerFoldername = strings.TrimSpace(singerFoldername)
+	if s.Config.ArtistFolderFormat != "" {
+		singerFoldername = folderName(s.Config.ArtistFolderFormat, s.albumVars(meta.Data[0], "", Codec))
 		fmt.Println(singerFoldername)
 	}
-	singerFolder := filepath.Join(Config.AlacSaveFolder, forbiddenNames.ReplaceAllString(singerFoldername, "_"))
-	if dl_atmos {
-		singerFolder = filepath.Join(Config.AtmosSaveFolder, forbiddenNames.ReplaceAllString(singerFoldername, "_"))
+	singerFolder := filepath.Join(s.Config.AlacSaveFolder, s.names().Component(singerFoldername))
+	if s.Atmos {
+		singerFolder = filepath.Join(s.Config.AtmosSaveFolder, s.names().Component(singerFoldername))
 	}
-	if dl_aac {
-		singerFolder = filepath.Join(Config.AacSaveFolder, forbiddenNames.ReplaceAllString(singerFoldername, "_"))
+	if s.AAC {
+		singerFolder = filepath.Join(s.Config.AacSaveFolder, s.names().Component(singerFoldername))
 	}
-	os.MkdirAll(singerFolder, os.ModePerm)
+	s.mkdirAll(singerFolder)
 	album.SaveDir = singerFolder
 	var Quality string
-	if strings.Contains(Config.AlbumFolderFormat, "Quality") {
-		if dl_atmos {
-			Quality = fmt.Sprintf("%dKbps", Config.AtmosMax-2000)
-		} else if dl_aac && Config.AacType == "aac-lc" {
+	if strings.Contains(s.Config.AlbumFolderFormat, "Quality") {
+		if s.Atmos {
+			Quality = fmt.Sprintf("%dKbps", s.Config.AtmosMax-2000)
+		} else if s.AAC && s.Config.AacType == "aac-lc" {
 			Quality = "256Kbps"
 		} else {
 			manifest1, err := ampapi.GetSongResp(storefront, meta.Data[0].Relationships.Tracks.Data[0].ID, album.Language, token)
@@ -1133,19 +2003,19 @@ func ripAlbum(albumId string, token string, storefront string, mediaUserToken st
 				} else {
 					needCheck := false
 
-					if Config.GetM3u8Mode == "all" {
+					if s.Config.GetM3u8Mode == "all" {
 						needCheck = true
-					} else if Config.GetM3u8Mode == "hires" && contains(meta.Data[0].Relationships.Tracks.Data[0].Attributes.AudioTraits, "hi-res-lossless") {
+					} else if s.Config.GetM3u8Mode == "hires" && contains(meta.Data[0].Relationships.Tracks.Data[0].Attributes.AudioTraits, "hi-res-lossless") {
 						needCheck = true
 					}
 					var EnhancedHls_m3u8 string
 					if needCheck {
-						EnhancedHls_m3u8, _ = checkM3u8(meta.Data[0].Relationships.Tracks.Data[0].ID, "album")
+						EnhancedHls_m3u8, _ = s.checkM3u8(meta.Data[0].Relationships.Tracks.Data[0].ID, "album")
 						if strings.HasSuffix(EnhancedHls_m3u8, ".m3u8") {
 							manifest1.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls = EnhancedHls_m3u8
 						}
 					}
-					_, Quality, err = extractMedia(manifest1.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls, true)
+					_, Quality, err = s.extractMedia(manifest1.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls, true)
 					if err != nil {
 						fmt.Println("Failed to extract quality from manifest.\n", err)
 					}
@@ -1153,62 +2023,29 @@ func ripAlbum(albumId string, token string, storefront string, mediaUserToken st
 			}
 		}
 	}
-	stringsToJoin := []string{}
-	if meta.Data[0].Attributes.IsAppleDigitalMaster || meta.Data[0].Attributes.IsMasteredForItunes {
-		if Config.AppleMasterChoice != "" {
-			stringsToJoin = append(stringsToJoin, Config.AppleMasterChoice)
-		}
-	}
-	if meta.Data[0].Attributes.ContentRating == "explicit" {
-		if Config.ExplicitChoice != "" {
-			stringsToJoin = append(stringsToJoin, Config.ExplicitChoice)
-		}
-	}
-	if meta.Data[0].Attributes.ContentRating == "clean" {
-		if Config.CleanChoice != "" {
-			stringsToJoin = append(stringsToJoin, Config.CleanChoice)
-		}
-	}
-	Tag_string := strings.Join(stringsToJoin, " ")
-	var albumFolderName string
-	albumFolderName = strings.NewReplacer(
-		"{ReleaseDate}", meta.Data[0].Attributes.ReleaseDate,
-		"{ReleaseYear}", meta.Data[0].Attributes.ReleaseDate[:4],
-		"{ArtistName}", LimitString(meta.Data[0].Attributes.ArtistName),
-		"{AlbumName}", LimitString(meta.Data[0].Attributes.Name),
-		"{UPC}", meta.Data[0].Attributes.Upc,
-		"{RecordLabel}", meta.Data[0].Attributes.RecordLabel,
-		"{Copyright}", meta.Data[0].Attributes.Copyright,
-		"{AlbumId}", albumId,
-		"{Quality}", Quality,
-		"{Codec}", Codec,
-		"{Tag}", Tag_string,
-	).Replace(Config.AlbumFolderFormat)
-
-	if strings.HasSuffix(albumFolderName, ".") {
-		albumFolderName = strings.ReplaceAll(albumFolderName, ".", "")
-	}
-	albumFolderName = strings.TrimSpace(albumFolderName)
-	albumFolderPath := filepath.Join(singerFolder, forbiddenNames.ReplaceAllString(albumFolderName, "_"))
-	os.MkdirAll(albumFolderPath, os.ModePerm)
+	albumFolderName := folderName(s.Config.AlbumFolderFormat, s.albumVars(meta.Data[0], Quality, Codec))
+	albumFolderPath := filepath.Join(singerFolder, s.names().Component(albumFolderName))
+	s.mkdirAll(albumFolderPath)
 	album.SaveName = albumFolderName
 	fmt.Println(albumFolderName)
-	if Config.SaveArtistCover && len(meta.Data[0].Relationships.Artists.Data) > 0{
+	var artistCovPath string
+	if s.Config.SaveArtistCover && len(meta.Data[0].Relationships.Artists.Data) > 0{
 		if meta.Data[0].Relationships.Artists.Data[0].Attributes.Artwork.Url != "" {
-			_, err = writeCover(singerFolder, "folder", meta.Data[0].Relationships.Artists.Data[0].Attributes.Artwork.Url)
+			artistCovPath, err = s.writeCover(singerFolder, "folder", meta.Data[0].Relationships.Artists.Data[0].Attributes.Artwork.Url)
 			if err != nil {
 				fmt.Println("Failed to write artist cover.")
 			}
 		}
 	}
-	covPath, err := writeCover(albumFolderPath, "cover", meta.Data[0].Attributes.Artwork.URL)
+	covPath, err := s.writeCover(albumFolderPath, "cover", meta.Data[0].Attributes.Artwork.URL)
 	if err != nil {
 		fmt.Println("Failed to write cover.")
 	}
-	if Config.SaveAnimatedArtwork && meta.Data[0].Attributes.EditorialVideo.MotionDetailSquare.Video != "" {
+	s.writeSidecars(albumFolderPath, singerFolder, singerFoldername != "", meta.Data[0], covPath, artistCovPath)
+	if s.Config.SaveAnimatedArtwork && s.Plan == nil && meta.Data[0].Attributes.EditorialVideo.MotionDetailSquare.Video != "" {
 		fmt.Println("Found Animation Artwork.")
 
-		motionvideoUrlSquare, err := extractVideo(meta.Data[0].Attributes.EditorialVideo.MotionDetailSquare.Video)
+		motionvideoUrlSquare, err := s.extractVideo(meta.Data[0].Attributes.EditorialVideo.MotionDetailSquare.Video)
 		if err != nil {
 			fmt.Println("no motion video square.\n", err)
 		} else {
@@ -1229,14 +2066,14 @@ func ripAlbum(albumId string, token string, storefront string, mediaUserToken st
 			}
 		}
 
-		if Config.EmbyAnimatedArtwork {
+		if s.Config.EmbyAnimatedArtwork {
 			cmd3 := exec.Command("ffmpeg", "-i", filepath.Join(albumFolderPath, "square_animated_artwork.mp4"), "-vf", "scale=440:-1", "-r", "24", "-f", "gif", filepath.Join(albumFolderPath, "folder.jpg"))
 			if err := cmd3.Run(); err != nil {
 				fmt.Printf("animated artwork square to gif err: %v\n", err)
 			}
 		}
 
-		motionvideoUrlTall, err := extractVideo(meta.Data[0].Attributes.EditorialVideo.MotionDetailTall.Video)
+		motionvideoUrlTall, err := s.extractVideo(meta.Data[0].Attributes.EditorialVideo.MotionDetailTall.Video)
 		if err != nil {
 			fmt.Println("no motion video tall.\n", err)
 		} else {
@@ -1262,18 +2099,19 @@ func ripAlbum(albumId string, token string, storefront string, mediaUserToken st
 		album.Tracks[i].SaveDir = albumFolderPath
 		album.Tracks[i].Codec = Codec
 	}
+	s.assignNameSuffixes(album.Tracks)
 	trackTotal := len(meta.Data[0].Relationships.Tracks.Data)
 	arr := make([]int, trackTotal)
 	for i := 0; i < trackTotal; i++ {
 		arr[i] = i + 1
 	}
 
-	if dl_song {
+	if s.Song {
 		if urlArg_i == "" {
 		} else {
 			for i := range album.Tracks {
 				if urlArg_i == album.Tracks[i].ID {
-					ripTrack(&album.Tracks[i], token, mediaUserToken)
+					s.ripTrack(&album.Tracks[i], token, mediaUserToken)
 					return nil
 				}
 			}
@@ -1281,34 +2119,50 @@ func ripAlbum(albumId string, token string, storefront string, mediaUserToken st
 		return nil
 	}
 	var selected []int
-	if !dl_select {
+	if len(s.Tracks) > 0 {
+		selected = s.Tracks
+	} else if !s.Select {
 		selected = arr
 	} else {
 		selected = album.ShowSelect()
 	}
+	var tracks []*task.Track
 	for i := range album.Tracks {
 		i++
-		if isInArray(okDict[albumId], i) {
-			counter.Total++
-			counter.Success++
+		if s.isTrackDone(okKey(albumId, Codec), i) {
+			s.countTrack(&s.counter.Total)
+			s.countTrack(&s.counter.Success)
 			continue
 		}
 		if isInArray(selected, i) {
-			ripTrack(&album.Tracks[i-1], token, mediaUserToken)
-		}
-	}
+			tracks = append(tracks, &album.Tracks[i-1])
+		}
+	}
+	s.ripTracks(tracks, token, mediaUserToken)
+	if s.Config.SaveAlbumM3u8 {
+		s.writePlaylistFile(albumFolderPath, album.Tracks, nil)
+	}
+	s.writeManifest(albumFolderPath, manifest.Manifest{
+		Type:       "album",
+		ID:         albumId,
+		UPC:        meta.Data[0].Attributes.Upc,
+		Name:       meta.Data[0].Attributes.Name,
+		Artist:     meta.Data[0].Attributes.ArtistName,
+		Storefront: storefront,
+		Codec:      Codec,
+	}, album.Tracks)
 	return nil
 
 }
-func ripPlaylist(playlistId string, token string, storefront string, mediaUserToken string) error {
+func (s *Session) ripPlaylist(playlistId string, token string, storefront string, mediaUserToken string) error {
 	playlist := task.NewPlaylist(storefront, playlistId)
-	err := playlist.GetResp(token, Config.Language)
+	err := s.loadPlaylist(playlist, token)
 	if err != nil {
 		fmt.Println("Failed to get playlist response.")
 		return err
 	}
 	meta := playlist.Resp
-	if debug_mode {
+	if s.Debug {
 		fmt.Println(meta.Data[0].Attributes.ArtistName)
 		fmt.Println(meta.Data[0].Attributes.Name)
 
@@ -1328,13 +2182,13 @@ func ripPlaylist(playlistId string, token string, storefront string, mediaUserTo
 				m3u8Url = manifest.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls
 			}
 			needCheck := false
-			if Config.GetM3u8Mode == "all" {
+			if s.Config.GetM3u8Mode == "all" {
 				needCheck = true
-			} else if Config.GetM3u8Mode == "hires" && contains(track.Attributes.AudioTraits, "hi-res-lossless") {
+			} else if s.Config.GetM3u8Mode == "hires" && contains(track.Attributes.AudioTraits, "hi-res-lossless") {
 				needCheck = true
 			}
 			if needCheck {
-				fullM3u8Url, err := checkM3u8(track.ID, "song")
+				fullM3u8Url, err := s.checkM3u8(track.ID, "song")
 				if err == nil && strings.HasSuffix(fullM3u8Url, ".m3u8") {
 					m3u8Url = fullM3u8Url
 				} else {
@@ -1342,7 +2196,7 @@ func ripPlaylist(playlistId string, token string, storefront string, mediaUserTo
 				}
 			}
 
-			_, _, err = extractMedia(m3u8Url, true)
+			_, _, err = s.extractMedia(m3u8Url, true)
 			if err != nil {
 				fmt.Printf("Failed to extract quality info for track %d: %v\n", trackNum, err)
 				continue
@@ -1350,43 +2204,32 @@ func ripPlaylist(playlistId string, token string, storefront string, mediaUserTo
 		}
 		return nil
 	}
-	var Codec string
-	if dl_atmos {
-		Codec = "ATMOS"
-	} else if dl_aac {
-		Codec = "AAC"
-	} else {
-		Codec = "ALAC"
-	}
+	Codec := s.codecName()
 	playlist.Codec = Codec
 	var singerFoldername string
-	if Config.ArtistFolderFormat != "" {
-		singerFoldername = strings.NewReplacer(
-			"{ArtistName}", "Apple Music",
-			"{ArtistId}", "",
-			"{UrlArtistName}", "Apple Music",
-		).Replace(Config.ArtistFolderFormat)
-		if strings.HasSuffix(singerFoldername, ".") {
-			singerFoldername = strings.ReplaceAll(singerFoldername, ".", "")
-		}
-		singerFoldername = strings.TrimSpace(singerFoldername)
+	if s.Config.ArtistFolderFormat != "" {
+		singerFoldername = folderName(s.Config.ArtistFolderFormat, naming.Vars{
+			"ArtistName":    "Apple Music",
+			"ArtistId":      "",
+			"UrlArtistName": "Apple Music",
+		})
 		fmt.Println(singerFoldername)
 	}
-	singerFolder := filepath.Join(Config.AlacSaveFolder, forbiddenNames.ReplaceAllString(singerFoldername, "_"))
-	if dl_atmos {
-		singerFolder = filepath.Join(Config.AtmosSaveFolder, forbiddenNames.ReplaceAllString(singerFoldername, "_"))
+	singerFolder := filepath.Join(s.Config.AlacSaveFolder, s.names().Component(singerFoldername))
+	if s.Atmos {
+		singerFolder = filepath.Join(s.Config.AtmosSaveFolder, s.names().Component(singerFoldername))
 	}
-	if dl_aac {
-		singerFolder = filepath.Join(Config.AacSaveFolder, forbiddenNames.ReplaceAllString(singerFoldername, "_"))
+	if s.AAC {
+		singerFolder = filepath.Join(s.Config.AacSaveFolder, s.names().Component(singerFoldername))
 	}
-	os.MkdirAll(singerFolder, os.ModePerm)
+	s.mkdirAll(singerFolder)
 	playlist.SaveDir = singerFolder
 
 	var Quality string
-	if strings.Contains(Config.AlbumFolderFormat, "Quality") {
-		if dl_atmos {
-			Quality = fmt.Sprintf("%dKbps", Config.AtmosMax-2000)
-		} else if dl_aac && Config.AacType == "aac-lc" {
+	if strings.Contains(s.Config.AlbumFolderFormat, "Quality") {
+		if s.Atmos {
+			Quality = fmt.Sprintf("%dKbps", s.Config.AtmosMax-2000)
+		} else if s.AAC && s.Config.AacType == "aac-lc" {
 			Quality = "256Kbps"
 		} else {
 			manifest1, err := ampapi.GetSongResp(storefront, meta.Data[0].Relationships.Tracks.Data[0].ID, playlist.Language, token)
@@ -1399,19 +2242,19 @@ func ripPlaylist(playlistId string, token string, storefront string, mediaUserTo
 				} else {
 					needCheck := false
 
-					if Config.GetM3u8Mode == "all" {
+					if s.Config.GetM3u8Mode == "all" {
 						needCheck = true
-					} else if Config.GetM3u8Mode == "hires" && contains(meta.Data[0].Relationships.Tracks.Data[0].Attributes.AudioTraits, "hi-res-lossless") {
+					} else if s.Config.GetM3u8Mode == "hires" && contains(meta.Data[0].Relationships.Tracks.Data[0].Attributes.AudioTraits, "hi-res-lossless") {
 						needCheck = true
 					}
 					var EnhancedHls_m3u8 string
 					if needCheck {
-						EnhancedHls_m3u8, _ = checkM3u8(meta.Data[0].Relationships.Tracks.Data[0].ID, "album")
+						EnhancedHls_m3u8, _ = s.checkM3u8(meta.Data[0].Relationships.Tracks.Data[0].ID, "album")
 						if strings.HasSuffix(EnhancedHls_m3u8, ".m3u8") {
 							manifest1.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls = EnhancedHls_m3u8
 						}
 					}
-					_, Quality, err = extractMedia(manifest1.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls, true)
+					_, Quality, err = s.extractMedia(manifest1.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls, true)
 					if err != nil {
 						fmt.Println("Failed to extract quality from manifest.\n", err)
 					}
@@ -1419,40 +2262,17 @@ func ripPlaylist(playlistId string, token string, storefront string, mediaUserTo
 			}
 		}
 	}
-	stringsToJoin := []string{}
-	if meta.Data[0].Attributes.IsAppleDigitalMaster || meta.Data[0].Attributes.IsMasteredForItunes {
-		if Config.AppleMasterChoice != "" {
-			stringsToJoin = append(stringsToJoin, Config.AppleMasterChoice)
-		}
-	}
-	if meta.Data[0].Attributes.ContentRating == "explicit" {
-		if Config.ExplicitChoice != "" {
-			stringsToJoin = append(stringsToJoin, Config.ExplicitChoice)
-		}
-	}
-	if meta.Data[0].Attributes.ContentRating == "clean" {
-		if Config.CleanChoice != "" {
-			stringsToJoin = append(stringsToJoin, Config.CleanChoice)
-		}
-	}
-	Tag_string := strings.Join(stringsToJoin, " ")
-	playlistFolder := strings.NewReplacer(
-		"{ArtistName}", "Apple Music",
-		"{PlaylistName}", LimitString(meta.Data[0].Attributes.Name),
-		"{PlaylistId}", playlistId,
-		"{Quality}", Quality,
-		"{Codec}", Codec,
-		"{Tag}", Tag_string,
-	).Replace(Config.PlaylistFolderFormat)
-	if strings.HasSuffix(playlistFolder, ".") {
-		playlistFolder = strings.ReplaceAll(playlistFolder, ".", "")
-	}
-	playlistFolder = strings.TrimSpace(playlistFolder)
-	playlistFolderPath := filepath.Join(singerFolder, forbiddenNames.ReplaceAllString(playlistFolder, "_"))
-	os.MkdirAll(playlistFolderPath, os.ModePerm)
+	master := meta.Data[0].Attributes.IsAppleDigitalMaster || meta.Data[0].Attributes.IsMasteredForItunes
+	playlistVars := s.playlistVars("Apple Music", meta.Data[0].Attributes.Name, playlistId, Quality, Codec,
+		s.tagString(master, meta.Data[0].Attributes.ContentRating), len(playlist.Tracks))
+	playlistVars["UrlArtistName"] = "Apple Music"
+	playlistVars["ArtistId"] = ""
+	playlistFolder := folderName(s.Config.PlaylistFolderFormat, playlistVars)
+	playlistFolderPath := filepath.Join(singerFolder, s.names().Component(playlistFolder))
+	s.mkdirAll(playlistFolderPath)
 	playlist.SaveName = playlistFolder
 	fmt.Println(playlistFolder)
-	covPath, err := writeCover(playlistFolderPath, "cover", meta.Data[0].Attributes.Artwork.URL)
+	covPath, err := s.writeCover(playlistFolderPath, "cover", meta.Data[0].Attributes.Artwork.URL)
 	if err != nil {
 		fmt.Println("Failed to write cover.")
 	}
@@ -1462,11 +2282,12 @@ func ripPlaylist(playlistId string, token string, storefront string, mediaUserTo
 		playlist.Tracks[i].SaveDir = playlistFolderPath
 		playlist.Tracks[i].Codec = Codec
 	}
+	s.assignNameSuffixes(playlist.Tracks)
 
-	if Config.SaveAnimatedArtwork && meta.Data[0].Attributes.EditorialVideo.MotionDetailSquare.Video != "" {
+	if s.Config.SaveAnimatedArtwork && s.Plan == nil && meta.Data[0].Attributes.EditorialVideo.MotionDetailSquare.Video != "" {
 		fmt.Println("Found Animation Artwork.")
 
-		motionvideoUrlSquare, err := extractVideo(meta.Data[0].Attributes.EditorialVideo.MotionDetailSquare.Video)
+		motionvideoUrlSquare, err := s.extractVideo(meta.Data[0].Attributes.EditorialVideo.MotionDetailSquare.Video)
 		if err != nil {
 			fmt.Println("no motion video square.\n", err)
 		} else {
@@ -1487,14 +2308,14 @@ func ripPlaylist(playlistId string, token string, storefront string, mediaUserTo
 			}
 		}
 
-		if Config.EmbyAnimatedArtwork {
+		if s.Config.EmbyAnimatedArtwork {
 			cmd3 := exec.Command("ffmpeg", "-i", filepath.Join(playlistFolderPath, "square_animated_artwork.mp4"), "-vf", "scale=440:-1", "-r", "24", "-f", "gif", filepath.Join(playlistFolderPath, "folder.jpg"))
 			if err := cmd3.Run(); err != nil {
 				fmt.Printf("animated artwork square to gif err: %v\n", err)
 			}
 		}
 
-		motionvideoUrlTall, err := extractVideo(meta.Data[0].Attributes.EditorialVideo.MotionDetailTall.Video)
+		motionvideoUrlTall, err := s.extractVideo(meta.Data[0].Attributes.EditorialVideo.MotionDetailTall.Video)
 		if err != nil {
 			fmt.Println("no motion video tall.\n", err)
 		} else {
@@ -1522,26 +2343,313 @@ func ripPlaylist(playlistId string, token string, storefront string, mediaUserTo
 	}
 	var selected []int
 
-	if !dl_select {
+	if s.Sync {
+		selected = arr
+	} else if len(s.Tracks) > 0 {
+		selected = s.Tracks
+	} else if !s.Select {
 		selected = arr
 	} else {
 		selected = playlist.ShowSelect()
 	}
+	var tracks []*task.Track
 	for i := range playlist.Tracks {
 		i++
-		if isInArray(okDict[playlistId], i) {
-			counter.Total++
-			counter.Success++
+		if s.isTrackDone(okKey(playlistId, Codec), i) {
+			s.countTrack(&s.counter.Total)
+			s.countTrack(&s.counter.Success)
 			continue
 		}
 		if isInArray(selected, i) {
-			ripTrack(&playlist.Tracks[i-1], token, mediaUserToken)
+			tracks = append(tracks, &playlist.Tracks[i-1])
+		}
+	}
+	var syncErr error
+	if s.Sync {
+		syncErr = s.syncPlaylist(playlist, playlistFolderPath, tracks, token, mediaUserToken)
+	} else {
+		s.ripTracks(tracks, token, mediaUserToken)
+		if s.Config.SavePlaylistM3u8 {
+			s.writePlaylistFile(playlistFolderPath, playlist.Tracks, nil)
+		}
+	}
+	s.writeManifest(playlistFolderPath, manifest.Manifest{
+		Type:       "playlist",
+		ID:         playlistId,
+		Name:       meta.Data[0].Attributes.Name,
+		Artist:     meta.Data[0].Attributes.ArtistName,
+		Storefront: storefront,
+		Codec:      Codec,
+	}, playlist.Tracks)
+	return syncErr
+}
+
+// writeManifest records the tracks of a release saved in folder in its manifest and checksum file for
+// save-manifest. Entries of earlier runs are kept for tracks this run skipped.
+func (s *Session) writeManifest(folder string, release manifest.Manifest, tracks []task.Track) {
+	if !s.Config.SaveManifest || s.Plan != nil {
+		return
+	}
+	m, err := manifest.Load(folder)
+	if err != nil {
+		fmt.Println("Failed to read manifest:", err)
+		m = &manifest.Manifest{}
+	}
+	m.Type, m.ID, m.UPC, m.Name, m.Artist = release.Type, release.ID, release.UPC, release.Name, release.Artist
+	m.Storefront, m.Codec = release.Storefront, release.Codec
+	for i := range tracks {
+		track := &tracks[i]
+		if track.SavePath == "" {
+			continue
+		}
+		rel, ok := inFolder(folder, track.SavePath)
+		if !ok {
+			continue
 		}
+		sum, size, err := history.Checksum(track.SavePath)
+		if err != nil {
+			fmt.Println("Failed to checksum track:", err)
+			continue
+		}
+		entry := manifest.Track{
+			ID:       track.ID,
+			ISRC:     track.Resp.Attributes.Isrc,
+			Position: track.TaskNum,
+			Name:     track.Resp.Attributes.Name,
+			Artist:   track.Resp.Attributes.ArtistName,
+			Quality:  track.Quality,
+			Variant:  track.Variant,
+			File:     filepath.ToSlash(rel),
+			Size:     size,
+			SHA256:   sum,
+		}
+		if release.Type == "album" {
+			entry.Disc = track.Resp.Attributes.DiscNumber
+			entry.Position = track.Resp.Attributes.TrackNumber
+		}
+		if track.Storefront != "" && track.Storefront != release.Storefront {
+			entry.Storefront = track.Storefront
+		}
+		m.Add(entry)
+	}
+	if err := m.Save(folder); err != nil {
+		fmt.Println("Failed to write manifest:", err)
 	}
+}
+
+// syncPlaylist makes folder mirror the current playlist: new tracks are downloaded, tracks whose position
+// changed are renamed and renumbered, and tracks no longer in the playlist are archived, deleted or kept
+// according to sync-removed. The track order is saved as a snapshot for the next sync.
+func (s *Session) syncPlaylist(playlist *task.Playlist, folder string, tracks []*task.Track, token string, mediaUserToken string) error {
+	snapPath := snapshot.Path(folder)
+	prev, err := snapshot.Load(snapPath)
+	if err != nil {
+		return fmt.Errorf("failed to read sync snapshot: %w", err)
+	}
+	ids := make([]string, len(playlist.Tracks))
+	for i := range playlist.Tracks {
+		ids[i] = playlist.Tracks[i].ID
+	}
+	diff := prev.Compare(ids)
+	fmt.Printf("Sync: %d added, %d removed, %d moved\n", len(diff.Added), len(diff.Removed), len(diff.Moved))
+
+	sync := s.derive()
+	sync.syncFiles = make(map[string]string)
+	for _, track := range prev.Tracks {
+		if track.File != "" {
+			sync.syncFiles[track.ID] = filepath.Join(folder, track.File)
+		}
+	}
+	if s.Plan == nil {
+		s.removeSynced(folder, diff.Removed)
+		sync.stageMoved(diff.Moved)
+	}
+	sync.ripTracks(tracks, token, mediaUserToken)
+	if s.Plan != nil {
+		return nil
+	}
+
+	next := &snapshot.Snapshot{
+		PlaylistID: playlist.ID,
+		Name:       playlist.Resp.Data[0].Attributes.Name,
+		Codec:      playlist.Codec,
+	}
+	for i := range playlist.Tracks {
+		track := &playlist.Tracks[i]
+		file := track.SavePath
+		if file == "" {
+			file = sync.syncFiles[track.ID]
+		}
+		entry := snapshot.Track{ID: track.ID, Name: track.Resp.Attributes.Name, Position: track.TaskNum}
+		if file != "" {
+			if exists, _ := fileExists(file); exists {
+				entry.File, _ = filepath.Rel(folder, file)
+			}
+		}
+		next.Tracks = append(next.Tracks, entry)
+	}
+	if err := next.Save(snapPath); err != nil {
+		return fmt.Errorf("failed to save sync snapshot: %w", err)
+	}
+	s.writePlaylistFile(folder, playlist.Tracks, sync.syncFiles)
 	return nil
 }
 
-func writeMP4Tags(track *task.Track, lrc string) error {
+// writePlaylistFile saves an extended M3U named after folder that lists tracks in order. Tracks this run did
+// not download are taken from known, which maps track IDs to files, or from the download history. Files
+// outside folder, such as tracks kept in their album folders, are only listed with use-songinfo-for-playlist.
+func (s *Session) writePlaylistFile(folder string, tracks []task.Track, known map[string]string) {
+	if s.Plan != nil {
+		return
+	}
+	var entries []playlistfile.Entry
+	for i := range tracks {
+		track := &tracks[i]
+		file := track.SavePath
+		if file == "" {
+			file = known[track.ID]
+		}
+		if file == "" {
+			if entry, ok := downloadHistory.Lookup(track.ID, track.Resp.Attributes.Isrc, track.Codec); ok {
+				file = entry.Path
+			}
+		}
+		if file == "" {
+			continue
+		}
+		if exists, _ := fileExists(file); !exists {
+			continue
+		}
+		if _, ok := inFolder(folder, file); !ok && !s.Config.UseSongInfoForPlaylist {
+			continue
+		}
+		entries = append(entries, playlistfile.Entry{
+			Path:     file,
+			Duration: time.Duration(track.Resp.Attributes.DurationInMillis) * time.Millisecond,
+			Artist:   track.Resp.Attributes.ArtistName,
+			Title:    track.Resp.Attributes.Name,
+		})
+	}
+	if len(entries) == 0 {
+		return
+	}
+	if err := playlistfile.Write(filepath.Join(folder, filepath.Base(folder)+".m3u8"), entries); err != nil {
+		fmt.Println("Failed to write playlist file:", err)
+	}
+}
+
+// inFolder returns path relative to folder, and whether path lies inside folder.
+func inFolder(folder string, path string) (string, bool) {
+	rel, err := filepath.Rel(folder, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// removeSynced handles the files of tracks that were removed from a synced playlist.
+func (s *Session) removeSynced(folder string, removed []snapshot.Track) {
+	mode := strings.ToLower(s.Config.SyncRemoved)
+	if mode == "keep" {
+		return
+	}
+	for _, track := range removed {
+		if track.File == "" {
+			continue
+		}
+		path := filepath.Join(folder, track.File)
+		if exists, _ := fileExists(path); !exists {
+			continue
+		}
+		if mode == "delete" {
+			if err := os.Remove(path); err != nil {
+				fmt.Println("Failed to delete removed track:", err)
+				continue
+			}
+			fmt.Println("Deleted removed track:", track.File)
+			continue
+		}
+		archiveDir := filepath.Join(folder, "Removed")
+		os.MkdirAll(archiveDir, os.ModePerm)
+		if err := os.Rename(path, filepath.Join(archiveDir, filepath.Base(path))); err != nil {
+			fmt.Println("Failed to archive removed track:", err)
+			continue
+		}
+		fmt.Println("Archived removed track:", track.File)
+	}
+}
+
+// stageMoved renames the files of tracks whose position changed to temporary names, so moveSynced can give
+// each its new name even when that is the old name of another moved track.
+func (s *Session) stageMoved(moved []snapshot.Track) {
+	for _, track := range moved {
+		old, ok := s.syncFiles[track.ID]
+		if !ok {
+			continue
+		}
+		if exists, _ := fileExists(old); !exists {
+			continue
+		}
+		staged := filepath.Join(filepath.Dir(old), ".sync-"+track.ID+filepath.Ext(old))
+		if err := os.Rename(old, staged); err != nil {
+			fmt.Println("Failed to move track out of the way:", err)
+			continue
+		}
+		oldLrc := strings.TrimSuffix(old, filepath.Ext(old)) + "." + s.Config.LrcFormat
+		if exists, _ := fileExists(oldLrc); exists {
+			_ = os.Rename(oldLrc, strings.TrimSuffix(staged, filepath.Ext(staged))+"."+s.Config.LrcFormat)
+		}
+		// a track that is not renamed below is saved in the snapshot under its temporary name
+		s.syncFiles[track.ID] = staged
+	}
+}
+
+// moveSynced renames the file a track had at the previous sync to its new path and
+// updates the playlist track number in its tags.
+func (s *Session) moveSynced(track *task.Track, trackPath string) {
+	old, ok := s.syncFiles[track.ID]
+	if !ok || s.Plan != nil {
+		return
+	}
+	target := strings.TrimSuffix(trackPath, filepath.Ext(trackPath)) + filepath.Ext(old)
+	if old == target {
+		return
+	}
+	if exists, _ := fileExists(old); !exists {
+		return
+	}
+	if exists, _ := fileExists(target); exists {
+		fmt.Printf("Cannot move %s: %s already exists\n", filepath.Base(old), filepath.Base(target))
+		return
+	}
+	if err := os.Rename(old, target); err != nil {
+		fmt.Println("Failed to rename moved track:", err)
+		return
+	}
+	fmt.Printf("Moved %s -> %s\n", filepath.Base(old), filepath.Base(target))
+	oldLrc := strings.TrimSuffix(old, filepath.Ext(old)) + "." + s.Config.LrcFormat
+	if exists, _ := fileExists(oldLrc); exists {
+		_ = os.Rename(oldLrc, strings.TrimSuffix(trackPath, filepath.Ext(trackPath))+"."+s.Config.LrcFormat)
+	}
+	if strings.ToLower(filepath.Ext(target)) != ".m4a" || s.Config.UseSongInfoForPlaylist {
+		return
+	}
+	mp4, err := mp4tag.Open(target)
+	if err != nil {
+		fmt.Println("Failed to renumber moved track:", err)
+		return
+	}
+	defer mp4.Close()
+	err = mp4.Write(&mp4tag.MP4Tags{
+		TrackNumber: int16(track.TaskNum),
+		TrackTotal:  int16(track.TaskTotal),
+	}, []string{})
+	if err != nil {
+		fmt.Println("Failed to renumber moved track:", err)
+	}
+}
+
+func (s *Session) writeMP4Tags(track *task.Track, lrc string) error {
 	t := &mp4tag.MP4Tags{
 		Title:      track.Resp.Attributes.Name,
 		TitleSort:  track.Resp.Attributes.Name,
@@ -1564,6 +2672,10 @@ func writeMP4Tags(track *task.Track, lrc string) error {
 		AlbumSort:    track.Resp.Attributes.AlbumName,
 	}
 
+	if track.Preference != "" {
+		t.Custom["QUALITY"] = strings.TrimSpace(track.Preference + " " + track.Quality)
+	}
+
 	if track.PreType == "albums" {
 		albumID, err := strconv.ParseUint(track.PreID, 10, 32)
 		if err != nil {
@@ -1580,7 +2692,7 @@ func writeMP4Tags(track *task.Track, lrc string) error {
 		t.ItunesArtistID = int32(artistID)
 	}
 
-	if (track.PreType == "playlists" || track.PreType == "stations") && !Config.UseSongInfoForPlaylist {
+	if (track.PreType == "playlists" || track.PreType == "stations") && !s.Config.UseSongInfoForPlaylist {
 		t.DiscNumber = 1
 		t.DiscTotal = 1
 		t.TrackNumber = int16(track.TaskNum)
@@ -1589,7 +2701,7 @@ func writeMP4Tags(track *task.Track, lrc string) error {
 		t.AlbumSort = track.PlaylistData.Attributes.Name
 		t.AlbumArtist = track.PlaylistData.Attributes.ArtistName
 		t.AlbumArtistSort = track.PlaylistData.Attributes.ArtistName
-	} else if (track.PreType == "playlists" || track.PreType == "stations") && Config.UseSongInfoForPlaylist {
+	} else if (track.PreType == "playlists" || track.PreType == "stations") && s.Config.UseSongInfoForPlaylist {
 		t.DiscTotal = int16(track.DiscTotal)
 		t.TrackTotal = int16(track.AlbumData.Attributes.TrackCount)
 		t.AlbumArtist = track.AlbumData.Attributes.ArtistName
@@ -1618,229 +2730,784 @@ func writeMP4Tags(track *task.Track, lrc string) error {
 		t.ItunesAdvisory = mp4tag.ItunesAdvisoryNone
 	}
 
-	mp4, err := mp4tag.Open(track.SavePath)
-	if err != nil {
-		return err
+	mp4, err := mp4tag.Open(track.SavePath)
+	if err != nil {
+		return err
+	}
+	defer mp4.Close()
+	err = mp4.Write(t, []string{})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func main() {
+	err := loadConfig()
+	if err != nil {
+		fmt.Printf("load Config failed: %v", err)
+		os.Exit(exitUsage)
+	}
+	token, err := ampapi.GetToken()
+	if err != nil {
+		if Config.AuthorizationToken != "" && Config.AuthorizationToken != "your-authorization-token" {
+			token = strings.Replace(Config.AuthorizationToken, "Bearer ", "", -1)
+		} else {
+			fmt.Println("Failed to get token.")
+			os.Exit(exitUsage)
+		}
+	}
+	var search_type string
+	var history_cmd string
+	var input_file string
+	var bot_mode bool
+	var json_output bool
+	var retries int
+	var dry_run bool
+	var plan_file string
+	var sync_mode bool
+	var watch_mode bool
+	var serve_mode bool
+	var codecs_list string
+	var library_kind string
+	var verify_dir string
+	var redownload bool
+	var dl_atmos, dl_aac, dl_select, dl_song, artist_select, debug_mode bool
+	pflag.StringVar(&search_type, "search", "", "Search for 'album', 'song', or 'artist'. Provide query after flags.")
+	pflag.StringVar(&history_cmd, "history", "", "Query the download history: 'list', or 'forget' followed by track IDs, album IDs or ISRCs")
+	pflag.BoolVar(&bot_mode, "bot", false, "Run Telegram bot mode")
+	pflag.BoolVar(&serve_mode, "serve", false, "Run a local HTTP API that queues downloads, listening on serve-listen")
+	pflag.BoolVar(&json_output, "json", false, "Write newline-delimited JSON events to stdout, other output goes to stderr")
+	pflag.IntVar(&retries, "retries", Config.Retries, "Retry a failed track up to N times with exponential backoff")
+	pflag.BoolVar(&dry_run, "dry-run", false, "Resolve everything and print the download plan without downloading or writing files")
+	pflag.StringVar(&plan_file, "plan-file", "", "Write the dry-run plan as JSON to this file (implies --dry-run)")
+	pflag.BoolVar(&sync_mode, "sync", false, "Mirror playlists: download added tracks, renumber moved ones and handle removed ones per sync-removed")
+	pflag.BoolVar(&watch_mode, "watch", false, "Watch the artists in watch-artists and download their new albums and music videos")
+	pflag.StringVar(&input_file, "input-file", "", "Read URLs from a file, one per line with optional codec=, tracks=, storefront= and output= overrides")
+	pflag.StringVar(&library_kind, "library", "", "Download your library with the media-user-token: 'albums', 'playlists', 'songs', or 'all' for albums and playlists")
+	pflag.StringVar(&verify_dir, "verify", "", "Check the downloaded files in a folder and report broken ones")
+	pflag.BoolVar(&redownload, "redownload", false, "With --verify, delete broken files found in the download history and download them again")
+	pflag.StringVar(&codecs_list, "codecs", "", "Download each release in several codecs in one pass, e.g. alac,atmos,aac-binaural")
+	pflag.BoolVar(&dl_atmos, "atmos", false, "Enable atmos download mode")
+	pflag.BoolVar(&dl_aac, "aac", false, "Enable adm-aac download mode")
+	pflag.BoolVar(&dl_select, "select", false, "Enable selective download")
+	pflag.BoolVar(&dl_song, "song", false, "Enable single song download mode")
+	pflag.BoolVar(&artist_select, "all-album", false, "Download all artist albums")
+	pflag.BoolVar(&artist_select, "all", false, "Download everything an artist, curator, record label or room lists without asking")
+	pflag.BoolVar(&debug_mode, "debug", false, "Enable debug mode to show audio quality information")
+	alac_max := pflag.Int("alac-max", Config.AlacMax, "Specify the max quality for download alac")
+	atmos_max := pflag.Int("atmos-max", Config.AtmosMax, "Specify the max quality for download atmos")
+	aac_type := pflag.String("aac-type", Config.AacType, "Select AAC type, aac aac-binaural aac-downmix")
+	mv_audio_type := pflag.String("mv-audio-type", Config.MVAudioType, "Select MV audio type, atmos ac3 aac")
+	mv_max := pflag.Int("mv-max", Config.MVMax, "Specify the max quality for download MV")
+
+	pflag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] [url1 url2 ...]\n", "[main | main.exe | go run main.go]")
+		fmt.Fprintf(os.Stderr, "Search Usage: %s --search [album|song|artist] [query]\n", "[main | main.exe | go run main.go]")
+		fmt.Fprintf(os.Stderr, "Batch Usage: %s --input-file urls.txt\n", "[main | main.exe | go run main.go]")
+		fmt.Fprintf(os.Stderr, "History Usage: %s --history [list|forget] [id ...]\n", "[main | main.exe | go run main.go]")
+		fmt.Println("\nOptions:")
+		pflag.PrintDefaults()
+	}
+
+	pflag.Parse()
+	Config.AlacMax = *alac_max
+	Config.AtmosMax = *atmos_max
+	Config.AacType = *aac_type
+	Config.MVAudioType = *mv_audio_type
+	Config.MVMax = *mv_max
+	Config.Retries = retries
+
+	if bot_mode {
+		runTelegramBot(token)
+		return
+	}
+
+	args := pflag.Args()
+	var emitter *events.Emitter
+	if json_output {
+		emitter = events.New(os.Stdout)
+		os.Stdout = os.Stderr
+	}
+	sess := NewSession(Config)
+	sess.Events = emitter
+	sess.Atmos = dl_atmos
+	sess.AAC = dl_aac
+	sess.Select = dl_select
+	sess.Song = dl_song
+	sess.AllAlbums = artist_select
+	sess.Debug = debug_mode
+	sess.Sync = sync_mode
+	if codecs_list != "" {
+		sess.Codecs, err = batch.ParseCodecs(codecs_list)
+		if err != nil {
+			fmt.Println("Invalid --codecs:", err)
+			os.Exit(exitUsage)
+		}
+	}
+
+	if Config.HistoryFile != "" {
+		downloadHistory, err = history.Open(Config.HistoryFile)
+		if err != nil {
+			fmt.Printf("Failed to open download history: %v\n", err)
+			os.Exit(exitUsage)
+		}
+	}
+	if history_cmd != "" {
+		handleHistory(history_cmd, args)
+		return
+	}
+	if serve_mode {
+		runServer(token)
+		return
+	}
+	if watch_mode {
+		if err := sess.watchArtists(token); err != nil {
+			fmt.Println("Watch failed:", err)
+			os.Exit(exitUsage)
+		}
+		return
+	}
+
+	var queue []batch.Entry
+	if verify_dir != "" {
+		broken, requeue := verifyLibrary(verify_dir, redownload)
+		if len(requeue) == 0 {
+			if broken > 0 {
+				os.Exit(exitPartialFailure)
+			}
+			return
+		}
+		queue = append(queue, requeue...)
+	}
+	if search_type != "" {
+		if len(args) == 0 {
+			fmt.Println("Error: --search flag requires a query.")
+			pflag.Usage()
+			os.Exit(exitUsage)
+		}
+		selectedUrl, err := sess.handleSearch(search_type, args, token)
+		if err != nil {
+			fmt.Printf("\nSearch process failed: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		if selectedUrl == "" {
+			fmt.Println("\nExiting.")
+			return
+		}
+		queue = append(queue, batch.Entry{URL: selectedUrl})
+	} else {
+		for _, arg := range args {
+			queue = append(queue, batch.Entry{URL: arg})
+		}
+		if library_kind != "" {
+			libraryEntries, err := sess.libraryEntries(library_kind, token)
+			if err != nil {
+				fmt.Printf("Failed to list library: %v\n", err)
+				os.Exit(exitUsage)
+			}
+			queue = append(queue, libraryEntries...)
+		}
+		if input_file != "" {
+			fileEntries, err := batch.ParseFile(input_file)
+			if err != nil {
+				fmt.Printf("Failed to read input file: %v\n", err)
+				os.Exit(exitUsage)
+			}
+			queue = append(queue, fileEntries...)
+		}
+		if len(queue) == 0 {
+			fmt.Println("No URLs provided. Please provide at least one URL.")
+			pflag.Usage()
+			os.Exit(exitUsage)
+		}
+	}
+
+	if urlKind(queue[0].URL) == amurl.Artist {
+		artistEntry := queue[0]
+		urlArtistName, urlArtistID, err := sess.getUrlArtistName(artistEntry.URL, token)
+		if err != nil {
+			fmt.Println("Failed to get artistname.")
+			os.Exit(exitUsage)
+		}
+		sess.URLArtistName = urlArtistName
+		sess.URLArtistID = urlArtistID
+		albumArgs, err := sess.checkArtist(artistEntry.URL, token, "albums")
+		if err != nil {
+			fmt.Println("Failed to get artist albums.")
+			os.Exit(exitUsage)
+		}
+		mvArgs, err := sess.checkArtist(artistEntry.URL, token, "music-videos")
+		if err != nil {
+			fmt.Println("Failed to get artist music-videos.")
+		}
+		var expanded []batch.Entry
+		for _, artistUrl := range append(albumArgs, mvArgs...) {
+			entry := artistEntry
+			entry.URL = artistUrl
+			expanded = append(expanded, entry)
+		}
+		queue = append(expanded, queue[1:]...)
+	}
+	var expanded []batch.Entry
+	for _, entry := range queue {
+		switch kind := urlKind(entry.URL); kind {
+		case amurl.Curator, amurl.RecordLabel, amurl.Room:
+			urls, err := sess.checkCollection(entry.URL, token)
+			if err != nil {
+				fmt.Printf("Failed to get %s releases: %v\n", kind, err)
+				continue
+			}
+			for _, collectionUrl := range urls {
+				release := entry
+				release.URL = collectionUrl
+				expanded = append(expanded, release)
+			}
+		default:
+			expanded = append(expanded, entry)
+		}
+	}
+	queue = expanded
+	albumTotal := len(queue)
+	if dry_run || plan_file != "" {
+		sess.Plan = &plan.Plan{}
+		for albumNum, entry := range queue {
+			fmt.Printf("Queue %d of %d: ", albumNum+1, albumTotal)
+			sess.ripEntry(entry, token)
+		}
+		sess.Plan.Print(os.Stdout)
+		if plan_file != "" {
+			if err := sess.Plan.WriteFile(plan_file); err != nil {
+				fmt.Printf("Failed to write plan: %v\n", err)
+				os.Exit(exitUsage)
+			}
+			fmt.Println("Plan written to", plan_file)
+		}
+		return
+	}
+	interactive := !json_output && stdinIsTerminal()
+	var counter structs.Counter
+	for {
+		for albumNum, entry := range queue {
+			fmt.Printf("Queue %d of %d: ", albumNum+1, albumTotal)
+			sess.ripEntry(entry, token)
+		}
+		counter = sess.Counter()
+		codecOrder, codecCounts := sess.CodecCounters()
+		summary := events.SummaryEvent(counter)
+		if len(codecOrder) > 0 {
+			summary.Codecs = make(map[string]*events.Counts, len(codecOrder))
+			for _, codec := range codecOrder {
+				c := codecCounts[codec]
+				summary.Codecs[codec] = events.CountsOf(c)
+				fmt.Printf("  %-13s Completed: %d/%d  |  Unavailable: %d  |  Errors: %d\n", codec, c.Success, c.Total, c.Unavailable, c.Error)
+			}
+		}
+		presetOrder, presetCounts := sess.PreferenceCounters()
+		if len(presetOrder) > 0 {
+			summary.Qualities = presetCounts
+			var parts []string
+			for _, preference := range presetOrder {
+				parts = append(parts, fmt.Sprintf("%s: %d", preference, presetCounts[preference]))
+			}
+			fmt.Println("  Quality:", strings.Join(parts, "  |  "))
+		}
+		sess.Events.Emit(summary)
+		fmt.Printf("=======  [\u2714 ] Completed: %d/%d  |  [\u26A0 ] Warnings: %d  |  [\u2716 ] Errors: %d  =======\n", counter.Success, counter.Total, counter.Unavailable+counter.NotSong, counter.Error)
+		if counter.Error == 0 || !interactive {
+			break
+		}
+		fmt.Println("Error detected, press Enter to try again...")
+		fmt.Scanln()
+		fmt.Println("Start trying again...")
+		sess.ResetCounter()
+	}
+	if err := downloadHistory.Close(); err != nil {
+		fmt.Println("Failed to compact download history:", err)
+	}
+	os.Exit(exitCode(counter))
+}
+
+// Exit codes of a download run. Setup errors such as a bad config exit with exitUsage.
+const (
+	exitUsage          = 1
+	exitPartialFailure = 2
+	exitFailure        = 3
+)
+
+// exitCode returns 0 when every track succeeded, exitPartialFailure when only some failed
+// and exitFailure when nothing could be downloaded.
+func exitCode(counter structs.Counter) int {
+	if counter.Error == 0 {
+		return 0
+	}
+	if counter.Success == 0 {
+		return exitFailure
+	}
+	return exitPartialFailure
+}
+
+// stdinIsTerminal reports whether stdin is attached to a terminal, so the retry prompt can wait for input.
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// watchArtists checks the artists in watch-artists every watch-interval minutes and downloads albums
+// and music videos released after the newest one seen before. The first check of an artist only
+// records its current releases.
+func (s *Session) watchArtists(token string) error {
+	if len(s.Config.WatchArtists) == 0 {
+		return errors.New("watch-artists is empty")
+	}
+	if s.Config.WatchStateFile == "" {
+		return errors.New("watch-state-file is not set")
+	}
+	state, err := watch.Load(s.Config.WatchStateFile)
+	if err != nil {
+		return err
+	}
+	interval := time.Duration(s.Config.WatchInterval) * time.Minute
+	if interval <= 0 {
+		interval = 6 * time.Hour
+	}
+	for {
+		if fresh, err := ampapi.GetToken(); err == nil {
+			token = fresh
+		}
+		for _, artist := range s.Config.WatchArtists {
+			res, err := amurl.Parse(artist, amurl.Artist)
+			if err != nil || res.Kind != amurl.Artist {
+				fmt.Printf("Skipping watched artist %q: not an artist link or ID\n", artist)
+				continue
+			}
+			storefront, artistID := res.StorefrontOr(s.Config.Storefront), res.ID
+			if err := s.watchArtist(state, storefront, artistID, token); err != nil {
+				fmt.Printf("Failed to check artist %s: %v\n", artistID, err)
+			}
+			if err := state.Save(); err != nil {
+				fmt.Println("Failed to save watch state:", err)
+			}
+		}
+		fmt.Printf("Next check at %s\n", time.Now().Add(interval).Format("2006-01-02 15:04"))
+		time.Sleep(interval)
+	}
+}
+
+func (s *Session) watchArtist(state *watch.State, storefront string, artistID string, token string) error {
+	artist := state.Artist(artistID)
+	baseline := !artist.Initialized()
+	for _, relationship := range []string{"albums", "music-videos"} {
+		releases, err := ampapi.GetArtistReleases(storefront, artistID, relationship, s.Config.Language, token)
+		if err != nil {
+			return err
+		}
+		cursor := artist.Cursor(relationship)
+		for _, release := range releases {
+			if !watch.Released(release.ReleaseDate, time.Now()) {
+				// releases are sorted by date, so everything from here on is a pre-release
+				break
+			}
+			if !cursor.IsNew(release.ID, release.ReleaseDate) {
+				continue
+			}
+			if !baseline {
+				fmt.Printf("New release from artist %s: %s (%s)\n", artistID, release.Name, release.ReleaseDate)
+				errorsBefore := s.Counter().Error
+				s.ripEntry(batch.Entry{URL: release.URL, Storefront: storefront}, token)
+				if s.Counter().Error > errorsBefore {
+					// leave the cursor before the failed release so it is retried next time
+					break
+				}
+			}
+			cursor.Advance(release.ID, release.ReleaseDate)
+		}
 	}
-	defer mp4.Close()
-	err = mp4.Write(t, []string{})
-	if err != nil {
-		return err
+	if baseline {
+		fmt.Printf("Watching artist %s from %s\n", artistID, artist.Albums.LastRelease)
 	}
+	artist.CheckedAt = time.Now()
 	return nil
 }
 
-func main() {
-	err := loadConfig()
-	if err != nil {
-		fmt.Printf("load Config failed: %v", err)
-		return
+// saveFolder returns the configured folder releases are saved into in the session's codec.
+func (s *Session) saveFolder() string {
+	if s.Atmos {
+		return s.Config.AtmosSaveFolder
 	}
-	token, err := ampapi.GetToken()
-	if err != nil {
-		if Config.AuthorizationToken != "" && Config.AuthorizationToken != "your-authorization-token" {
-			token = strings.Replace(Config.AuthorizationToken, "Bearer ", "", -1)
-		} else {
-			fmt.Println("Failed to get token.")
-			return
-		}
+	if s.AAC {
+		return s.Config.AacSaveFolder
 	}
-	var search_type string
-	var bot_mode bool
-	pflag.StringVar(&search_type, "search", "", "Search for 'album', 'song', or 'artist'. Provide query after flags.")
-	pflag.BoolVar(&bot_mode, "bot", false, "Run Telegram bot mode")
-	pflag.BoolVar(&dl_atmos, "atmos", false, "Enable atmos download mode")
-	pflag.BoolVar(&dl_aac, "aac", false, "Enable adm-aac download mode")
-	pflag.BoolVar(&dl_select, "select", false, "Enable selective download")
-	pflag.BoolVar(&dl_song, "song", false, "Enable single song download mode")
-	pflag.BoolVar(&artist_select, "all-album", false, "Download all artist albums")
-	pflag.BoolVar(&debug_mode, "debug", false, "Enable debug mode to show audio quality information")
-	alac_max = pflag.Int("alac-max", Config.AlacMax, "Specify the max quality for download alac")
-	atmos_max = pflag.Int("atmos-max", Config.AtmosMax, "Specify the max quality for download atmos")
-	aac_type = pflag.String("aac-type", Config.AacType, "Select AAC type, aac aac-binaural aac-downmix")
-	mv_audio_type = pflag.String("mv-audio-type", Config.MVAudioType, "Select MV audio type, atmos ac3 aac")
-	mv_max = pflag.Int("mv-max", Config.MVMax, "Specify the max quality for download MV")
+	return s.Config.AlacSaveFolder
+}
 
-	pflag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options] [url1 url2 ...]\n", "[main | main.exe | go run main.go]")
-		fmt.Fprintf(os.Stderr, "Search Usage: %s --search [album|song|artist] [query]\n", "[main | main.exe | go run main.go]")
-		fmt.Println("\nOptions:")
-		pflag.PrintDefaults()
+// withEntry returns a session with the per-line overrides of a queue entry applied.
+func (s *Session) withEntry(entry batch.Entry) *Session {
+	d := s.derive()
+	switch entry.Codec {
+	case "alac":
+		d.Atmos, d.AAC = false, false
+	case "atmos":
+		d.Atmos, d.AAC = true, false
+	case "aac":
+		d.Atmos, d.AAC = false, true
+	case "aac-lc", "aac-binaural", "aac-downmix":
+		d.Atmos, d.AAC = false, true
+		d.Config.AacType = entry.Codec
 	}
+	d.Tracks = entry.Tracks
+	if entry.Output != "" {
+		d.Config.AlacSaveFolder = entry.Output
+		d.Config.AtmosSaveFolder = entry.Output
+		d.Config.AacSaveFolder = entry.Output
+	}
+	return d
+}
 
-	pflag.Parse()
-	Config.AlacMax = *alac_max
-	Config.AtmosMax = *atmos_max
-	Config.AacType = *aac_type
-	Config.MVAudioType = *mv_audio_type
-	Config.MVMax = *mv_max
-
-	if bot_mode {
-		runTelegramBot(token)
+// ripEntry downloads a queue entry, once per codec of s.Codecs unless the entry sets its own codec.
+// The codec passes of a release share its metadata, cover and lyrics downloads.
+func (s *Session) ripEntry(entry batch.Entry, token string) {
+	if len(s.Codecs) == 0 || entry.Codec != "" || urlKind(entry.URL) == amurl.MusicVideo {
+		s.ripRelease(entry, token)
 		return
 	}
+	// passes that would save into the same folder, such as two AAC types, get a subfolder named after their codec
+	folders := make(map[string]int)
+	for _, codec := range s.Codecs {
+		folders[s.withEntry(batch.Entry{Codec: codec, Output: entry.Output}).saveFolder()]++
+	}
+	shared := newReleaseCache()
+	for _, codec := range s.Codecs {
+		fmt.Printf("[%s] ", codec)
+		pass := entry
+		pass.Codec = codec
+		if folder := s.withEntry(pass).saveFolder(); folders[folder] > 1 {
+			pass.Output = filepath.Join(folder, codec)
+		}
+		d := s.derive()
+		d.shared = shared
+		before := s.Counter()
+		d.ripRelease(pass, token)
+		s.addCodecCounts(codec, before, s.Counter())
+	}
+}
 
-	args := pflag.Args()
+func (s *Session) ripRelease(entry batch.Entry, token string) {
+	s = s.withEntry(entry)
 
-	if search_type != "" {
-		if len(args) == 0 {
-			fmt.Println("Error: --search flag requires a query.")
-			pflag.Usage()
-			return
-		}
-		selectedUrl, err := handleSearch(search_type, args, token)
+	urlRaw := entry.URL
+	res, err := amurl.Parse(urlRaw, amurl.Album)
+	s.Events.Emit(events.Event{Type: events.JobStarted, URL: urlRaw, Kind: res.Kind})
+	if err != nil {
+		fmt.Println("Invalid URL:", err)
+		s.reportError(nil, &s.counter.Error, events.ErrURL, err)
+		return
+	}
+	storefront := entry.StorefrontOr(res.StorefrontOr(s.Config.Storefront))
+	if res.Library && res.Kind != amurl.Playlist {
+		catalogID, err := s.libraryCatalogID(res, token)
 		if err != nil {
-			fmt.Printf("\nSearch process failed: %v\n", err)
+			fmt.Println("Failed to resolve library item:", err)
+			s.reportError(nil, &s.counter.Error, events.ErrManifest, err)
 			return
 		}
-		if selectedUrl == "" {
-			fmt.Println("\nExiting.")
+		res.ID, res.Library = catalogID, false
+	}
+
+	switch res.Kind {
+	case amurl.MusicVideo:
+		fmt.Println("Music Video")
+		if s.Debug {
 			return
 		}
-		os.Args = []string{selectedUrl}
-	} else {
-		if len(args) == 0 {
-			fmt.Println("No URLs provided. Please provide at least one URL.")
-			pflag.Usage()
+		s.countTrack(&s.counter.Total)
+		if len(s.Config.MediaUserToken) <= 50 {
+			fmt.Println(": meida-user-token is not set, skip MV dl")
+			s.countTrack(&s.counter.Success)
 			return
 		}
-		os.Args = args
-	}
-
-	if strings.Contains(os.Args[0], "/artist/") {
-		urlArtistName, urlArtistID, err := getUrlArtistName(os.Args[0], token)
+		mvSaveDir := naming.Expand(s.Config.ArtistFolderFormat, s.artistVars("", ""))
+		if mvSaveDir != "" {
+			mvSaveDir = filepath.Join(s.Config.AlacSaveFolder, s.names().Component(mvSaveDir))
+		} else {
+			mvSaveDir = s.Config.AlacSaveFolder
+		}
+		err := s.mvDownloader(res.ID, mvSaveDir, token, storefront, s.Config.MediaUserToken, nil)
 		if err != nil {
-			fmt.Println("Failed to get artistname.")
+			fmt.Println("\u26A0 Failed to dl MV:", err)
+			s.reportError(nil, &s.counter.Error, events.ErrDownload, err)
 			return
 		}
-		Config.ArtistFolderFormat = strings.NewReplacer(
-			"{UrlArtistName}", LimitString(urlArtistName),
-			"{ArtistId}", urlArtistID,
-		).Replace(Config.ArtistFolderFormat)
-		albumArgs, err := checkArtist(os.Args[0], token, "albums")
+		s.countTrack(&s.counter.Success)
+	case amurl.Song:
+		fmt.Printf("Song->")
+		err := s.ripSong(res.ID, token, storefront, s.Config.MediaUserToken)
 		if err != nil {
-			fmt.Println("Failed to get artist albums.")
+			fmt.Println("Failed to rip song:", err)
+			s.reportError(nil, &s.counter.Error, events.ErrManifest, err)
+		}
+	case amurl.Album:
+		fmt.Println("Album")
+		err := s.ripAlbum(res.ID, token, storefront, s.Config.MediaUserToken, res.TrackID)
+		if err != nil {
+			fmt.Println("Failed to rip album:", err)
+			s.reportError(nil, &s.counter.Error, events.ErrManifest, err)
+		}
+	case amurl.Playlist:
+		fmt.Println("Playlist")
+		err := s.ripPlaylist(res.ID, token, storefront, s.Config.MediaUserToken)
+		if err != nil {
+			fmt.Println("Failed to rip playlist:", err)
+			s.reportError(nil, &s.counter.Error, events.ErrManifest, err)
+		}
+	case amurl.Station:
+		fmt.Printf("Station")
+		if len(s.Config.MediaUserToken) <= 50 {
+			fmt.Println(": meida-user-token is not set, skip station dl")
 			return
 		}
-		mvArgs, err := checkArtist(os.Args[0], token, "music-videos")
+		err := s.ripStation(res.ID, token, storefront, s.Config.MediaUserToken)
 		if err != nil {
-			fmt.Println("Failed to get artist music-videos.")
+			fmt.Println("Failed to rip station:", err)
 		}
-		os.Args = append(albumArgs, mvArgs...)
+	default:
+		fmt.Println("Invalid type")
+		s.reportError(nil, &s.counter.Error, events.ErrURL, fmt.Errorf("%s links are not supported: %s", res.Kind, urlRaw))
 	}
-	albumTotal := len(os.Args)
-	for {
-		for albumNum, urlRaw := range os.Args {
-			fmt.Printf("Queue %d of %d: ", albumNum+1, albumTotal)
-			var storefront, albumId string
+}
 
-			if strings.Contains(urlRaw, "/music-video/") {
-				fmt.Println("Music Video")
-				if debug_mode {
-					continue
-				}
-				counter.Total++
-				if len(Config.MediaUserToken) <= 50 {
-					fmt.Println(": meida-user-token is not set, skip MV dl")
-					counter.Success++
-					continue
-				}
-				if _, err := exec.LookPath("mp4decrypt"); err != nil {
-					fmt.Println(": mp4decrypt is not found, skip MV dl")
-					counter.Success++
-					continue
-				}
-				mvSaveDir := strings.NewReplacer(
-					"{ArtistName}", "",
-					"{UrlArtistName}", "",
-					"{ArtistId}", "",
-				).Replace(Config.ArtistFolderFormat)
-				if mvSaveDir != "" {
-					mvSaveDir = filepath.Join(Config.AlacSaveFolder, forbiddenNames.ReplaceAllString(mvSaveDir, "_"))
-				} else {
-					mvSaveDir = Config.AlacSaveFolder
-				}
-				storefront, albumId = checkUrlMv(urlRaw)
-				err := mvDownloader(albumId, mvSaveDir, token, storefront, Config.MediaUserToken, nil)
-				if err != nil {
-					fmt.Println("\u26A0 Failed to dl MV:", err)
-					counter.Error++
-					continue
-				}
-				counter.Success++
-				continue
+// libraryCatalogID returns the catalog ID of a library album or song, so it downloads like a catalog release.
+func (s *Session) libraryCatalogID(res amurl.Resource, token string) (string, error) {
+	kind := ampapi.LibrarySongs
+	if res.Kind == amurl.Album {
+		kind = ampapi.LibraryAlbums
+	}
+	item, err := ampapi.GetLibraryItem(kind, res.ID, s.Config.Language, token, s.Config.MediaUserToken)
+	if err != nil {
+		return "", err
+	}
+	if item.CatalogID == "" {
+		return "", fmt.Errorf("%q is an upload without an Apple Music match", item.Name)
+	}
+	return item.CatalogID, nil
+}
+
+// libraryEntries lists the library for --library: "albums", "playlists", "songs", or "all" for albums and playlists.
+func (s *Session) libraryEntries(kind string, token string) ([]batch.Entry, error) {
+	var kinds []string
+	switch kind {
+	case ampapi.LibraryAlbums, ampapi.LibraryPlaylists, ampapi.LibrarySongs:
+		kinds = []string{kind}
+	case "all":
+		kinds = []string{ampapi.LibraryAlbums, ampapi.LibraryPlaylists}
+	default:
+		return nil, fmt.Errorf("unknown library type %q, use albums, playlists, songs or all", kind)
+	}
+	var entries []batch.Entry
+	for _, kind := range kinds {
+		items, err := ampapi.GetLibraryItems(kind, s.Config.Language, token, s.Config.MediaUserToken)
+		if err != nil {
+			return nil, err
+		}
+		skipped := 0
+		for _, item := range items {
+			res := amurl.Resource{Storefront: s.Config.Storefront, ID: item.CatalogID}
+			switch kind {
+			case ampapi.LibraryAlbums:
+				res.Kind = amurl.Album
+			case ampapi.LibrarySongs:
+				res.Kind = amurl.Song
+			case ampapi.LibraryPlaylists:
+				res.Kind, res.ID, res.Library = amurl.Playlist, item.ID, true
 			}
-			if strings.Contains(urlRaw, "/song/") {
-				fmt.Printf("Song->")
-				storefront, songId := checkUrlSong(urlRaw)
-				if storefront == "" || songId == "" {
-					fmt.Println("Invalid song URL format.")
-					continue
-				}
-				err := ripSong(songId, token, storefront, Config.MediaUserToken)
-				if err != nil {
-					fmt.Println("Failed to rip song:", err)
-				}
+			if res.ID == "" {
+				skipped++
 				continue
 			}
-			parse, err := url.Parse(urlRaw)
-			if err != nil {
-				log.Fatalf("Invalid URL: %v", err)
-			}
-			var urlArg_i = parse.Query().Get("i")
+			entries = append(entries, batch.Entry{URL: res.URL()})
+		}
+		fmt.Printf("Library %s: %d queued", kind, len(items)-skipped)
+		if skipped > 0 {
+			fmt.Printf(", %d uploads without an Apple Music match skipped", skipped)
+		}
+		fmt.Println()
+	}
+	return entries, nil
+}
 
-			if strings.Contains(urlRaw, "/album/") {
-				fmt.Println("Album")
-				storefront, albumId = checkUrl(urlRaw)
-				err := ripAlbum(albumId, token, storefront, Config.MediaUserToken, urlArg_i)
-				if err != nil {
-					fmt.Println("Failed to rip album:", err)
-				}
-			} else if strings.Contains(urlRaw, "/playlist/") {
-				fmt.Println("Playlist")
-				storefront, albumId = checkUrlPlaylist(urlRaw)
-				err := ripPlaylist(albumId, token, storefront, Config.MediaUserToken)
-				if err != nil {
-					fmt.Println("Failed to rip playlist:", err)
-				}
-			} else if strings.Contains(urlRaw, "/station/") {
-				fmt.Printf("Station")
-				storefront, albumId = checkUrlStation(urlRaw)
-				if len(Config.MediaUserToken) <= 50 {
-					fmt.Println(": meida-user-token is not set, skip station dl")
-					continue
-				}
-				err := ripStation(albumId, token, storefront, Config.MediaUserToken)
-				if err != nil {
-					fmt.Println("Failed to rip station:", err)
-				}
-			} else {
-				fmt.Println("Invalid type")
+// urlKind returns the type of Apple Music page a URL or bare ID points to, or "" when it is not one.
+func urlKind(urlRaw string) string {
+	res, err := amurl.Parse(urlRaw, amurl.Album)
+	if err != nil {
+		return ""
+	}
+	return res.Kind
+}
+
+// runServer serves the HTTP API of --serve. Each job downloads one URL in its own session.
+func runServer(appleToken string) {
+	addr := Config.ServeListen
+	if addr == "" {
+		addr = "127.0.0.1:8787"
+	}
+	srv := server.New(server.Options{
+		Token:   Config.ServeToken,
+		Workers: Config.ServeWorkers,
+		Resolve: serveURL,
+		Run: func(job *server.Job) (server.Result, error) {
+			token := appleToken
+			if fresh, err := ampapi.GetToken(); err == nil {
+				token = fresh
+			}
+			sess := NewSession(Config)
+			sess.Context = job.Context()
+			sess.Progress = job.Progress
+			// serveURL has checked that output stays inside the save folder
+			output, _ := serveOutput(job.Request.Output)
+			if output != "" {
+				output = filepath.Join(sess.withEntry(batch.Entry{Codec: job.Request.Codec}).saveFolder(), output)
 			}
+			sess.ripEntry(batch.Entry{
+				URL:        job.URL,
+				Codec:      job.Request.Codec,
+				Tracks:     job.Request.Tracks,
+				Storefront: job.Request.Storefront,
+				Output:     output,
+			}, token)
+			counter := sess.Counter()
+			result := server.Result{Files: sess.Paths(), Counts: events.CountsOf(counter)}
+			if counter.Error > 0 {
+				return result, fmt.Errorf("%d of %d tracks failed", counter.Error, counter.Total)
+			}
+			return result, nil
+		},
+	})
+	fmt.Println("Serving the download API on http://" + addr)
+	if err := http.ListenAndServe(addr, srv.Handler()); err != nil {
+		fmt.Println("Server failed:", err)
+		os.Exit(exitUsage)
+	}
+}
+
+// serveURL returns the URL a --serve request downloads, building it from an ID and type when no URL is given.
+func serveURL(req server.Request) (string, error) {
+	raw := strings.TrimSpace(req.URL)
+	if raw == "" {
+		if req.ID == "" {
+			return "", errors.New("url or id is required")
 		}
-		fmt.Printf("=======  [\u2714 ] Completed: %d/%d  |  [\u26A0 ] Warnings: %d  |  [\u2716 ] Errors: %d  =======\n", counter.Success, counter.Total, counter.Unavailable+counter.NotSong, counter.Error)
-		if counter.Error == 0 {
-			break
+		switch req.Type {
+		case amurl.Album, amurl.Playlist, amurl.Song, amurl.MusicVideo, amurl.Station:
+			raw = strings.TrimSpace(req.ID)
+		default:
+			return "", errors.New("type must be album, playlist, song, music-video or station when id is given")
 		}
-		fmt.Println("Error detected, press Enter to try again...")
-		fmt.Scanln()
-		fmt.Println("Start trying again...")
-		counter = structs.Counter{}
+	}
+	res, err := amurl.Parse(raw, req.Type)
+	if err != nil {
+		return "", err
+	}
+	switch res.Kind {
+	case amurl.Album, amurl.Playlist, amurl.Song, amurl.MusicVideo, amurl.Station:
+	case amurl.Artist:
+		return "", errors.New("artist URLs are not supported, enqueue the artist's albums instead")
+	default:
+		return "", fmt.Errorf("%s links are not supported", res.Kind)
+	}
+	if res.Storefront == "" {
+		res.Storefront = Config.Storefront
+		if req.Storefront != "" {
+			res.Storefront = req.Storefront
+		}
+	}
+	if req.Codec != "" {
+		if codecs, err := batch.ParseCodecs(req.Codec); err != nil || len(codecs) != 1 {
+			return "", errors.New("codec must be one of alac, atmos, aac, aac-lc, aac-binaural or aac-downmix")
+		}
+	}
+	if _, err := serveOutput(req.Output); err != nil {
+		return "", err
+	}
+	return res.URL(), nil
+}
+
+// serveOutput returns the output folder of a --serve request, relative to the save folder of its codec.
+// API clients may only pick a folder inside the save folders, never an arbitrary path.
+func serveOutput(output string) (string, error) {
+	output = strings.TrimSpace(output)
+	if output == "" {
+		return "", nil
+	}
+	if filepath.IsAbs(output) || filepath.VolumeName(output) != "" || strings.HasPrefix(output, "/") || strings.HasPrefix(output, `\`) {
+		return "", errors.New("output must be a folder relative to the save folder")
+	}
+	clean := filepath.Clean(filepath.FromSlash(output))
+	if clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", errors.New("output must stay inside the save folder")
+	}
+	return clean, nil
+}
+
+func handleHistory(cmd string, args []string) {
+	if downloadHistory == nil {
+		fmt.Println("Download history is disabled, set history-file in config.yaml.")
+		return
+	}
+	switch cmd {
+	case "list":
+		entries := downloadHistory.Entries()
+		if len(entries) == 0 {
+			fmt.Println("Download history is empty.")
+			return
+		}
+		var data [][]string
+		for _, entry := range entries {
+			data = append(data, []string{
+				entry.TrackID,
+				entry.ISRC,
+				entry.AlbumID,
+				entry.Name,
+				entry.Codec,
+				entry.Quality,
+				entry.Path,
+				entry.DownloadedAt.Format("2006-01-02 15:04"),
+			})
+		}
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetHeader([]string{"Track ID", "ISRC", "Album ID", "Name", "Codec", "Quality", "Path", "Downloaded"})
+		table.SetAutoWrapText(false)
+		table.AppendBulk(data)
+		table.Render()
+		fmt.Printf("%d tracks in history\n", len(entries))
+	case "forget":
+		if len(args) == 0 {
+			fmt.Println("Error: --history forget requires at least one track ID, album ID or ISRC.")
+			return
+		}
+		for _, id := range args {
+			removed, err := downloadHistory.Forget(id)
+			if err != nil {
+				fmt.Printf("Failed to forget %s: %v\n", id, err)
+				continue
+			}
+			fmt.Printf("Forgot %d entries for %s\n", removed, id)
+		}
+	default:
+		fmt.Printf("Unknown history command: %s (use 'list' or 'forget')\n", cmd)
 	}
 }
 
-func mvDownloader(adamID string, saveDir string, token string, storefront string, mediaUserToken string, track *task.Track) error {
-	MVInfo, err := ampapi.GetMusicVideoResp(storefront, adamID, Config.Language, token)
+func (s *Session) mvDownloader(adamID string, saveDir string, token string, storefront string, mediaUserToken string, track *task.Track) error {
+	MVInfo, err := ampapi.GetMusicVideoResp(storefront, adamID, s.Config.Language, token)
 	if err != nil {
 		fmt.Println("\u26A0 Failed to get MV manifest:", err)
 		return nil
 	}
 
-	if strings.HasSuffix(saveDir, ".") {
-		saveDir = strings.ReplaceAll(saveDir, ".", "")
-	}
-	saveDir = strings.TrimSpace(saveDir)
-
+	// saveDir is made of names().Component folders already; only the file name is cleaned here
 	vidPath := filepath.Join(saveDir, fmt.Sprintf("%s_vid.mp4", adamID))
 	audPath := filepath.Join(saveDir, fmt.Sprintf("%s_aud.mp4", adamID))
 	mvSaveName := fmt.Sprintf("%s (%s)", MVInfo.Data[0].Attributes.Name, adamID)
@@ -1848,11 +3515,27 @@ func mvDownloader(adamID string, saveDir string, token string, storefront string
 		mvSaveName = fmt.Sprintf("%02d. %s", track.TaskNum, MVInfo.Data[0].Attributes.Name)
 	}
 
-	mvOutPath := filepath.Join(saveDir, fmt.Sprintf("%s.mp4", forbiddenNames.ReplaceAllString(mvSaveName, "_")))
+	mvBaseName := s.names().Base(saveDir, mvSaveName, ".mp4", "_thumbnail.png")
+	mvOutPath := filepath.Join(saveDir, mvBaseName+".mp4")
 
 	fmt.Println(MVInfo.Data[0].Attributes.Name)
 
 	exists, _ := fileExists(mvOutPath)
+	if s.Plan != nil {
+		status := plan.Download
+		if exists {
+			status = plan.Exists
+		}
+		s.Plan.Add(plan.Item{
+			Kind:    "music-videos",
+			TrackID: adamID,
+			Name:    MVInfo.Data[0].Attributes.Name,
+			Artist:  MVInfo.Data[0].Attributes.ArtistName,
+			Path:    mvOutPath,
+			Status:  status,
+		})
+		return nil
+	}
 	if exists {
 		fmt.Println("MV already exists locally.")
 		return nil
@@ -1864,84 +3547,73 @@ func mvDownloader(adamID string, saveDir string, token string, storefront string
 	}
 
 	os.MkdirAll(saveDir, os.ModePerm)
-	videom3u8url, _ := extractVideo(mvm3u8url)
+	videom3u8url, _ := s.extractVideo(mvm3u8url)
 	videokeyAndUrls, _ := runv3.Run(adamID, videom3u8url, token, mediaUserToken, true, "", nil)
-	_ = runv3.ExtMvData(videokeyAndUrls, vidPath)
 	defer os.Remove(vidPath)
-	audiom3u8url, _ := extractMvAudio(mvm3u8url)
+	if err := runv3.ExtMvData(videokeyAndUrls, vidPath); err != nil {
+		return fmt.Errorf("failed to download MV video: %w", err)
+	}
+	audiom3u8url, _ := s.extractMvAudio(mvm3u8url)
 	audiokeyAndUrls, _ := runv3.Run(adamID, audiom3u8url, token, mediaUserToken, true, "", nil)
-	_ = runv3.ExtMvData(audiokeyAndUrls, audPath)
 	defer os.Remove(audPath)
+	if err := runv3.ExtMvData(audiokeyAndUrls, audPath); err != nil {
+		return fmt.Errorf("failed to download MV audio: %w", err)
+	}
 
-	tags := []string{
-		"tool=",
-		fmt.Sprintf("artist=%s", MVInfo.Data[0].Attributes.ArtistName),
-		fmt.Sprintf("title=%s", MVInfo.Data[0].Attributes.Name),
-		fmt.Sprintf("genre=%s", MVInfo.Data[0].Attributes.GenreNames[0]),
-		fmt.Sprintf("created=%s", MVInfo.Data[0].Attributes.ReleaseDate),
-		fmt.Sprintf("ISRC=%s", MVInfo.Data[0].Attributes.Isrc),
+	attrs := MVInfo.Data[0].Attributes
+	tags := remux.Tags{
+		Title:  attrs.Name,
+		Artist: attrs.ArtistName,
+		Date:   attrs.ReleaseDate,
+		Custom: map[string]string{"ISRC": attrs.Isrc},
+	}
+	if len(attrs.GenreNames) > 0 {
+		tags.Genre = attrs.GenreNames[0]
 	}
 
-	if MVInfo.Data[0].Attributes.ContentRating == "explicit" {
-		tags = append(tags, "rating=1")
-	} else if MVInfo.Data[0].Attributes.ContentRating == "clean" {
-		tags = append(tags, "rating=2")
-	} else {
-		tags = append(tags, "rating=0")
+	if attrs.ContentRating == "explicit" {
+		tags.Rating = remux.RatingExplicit
+	} else if attrs.ContentRating == "clean" {
+		tags.Rating = remux.RatingClean
 	}
 
 	if track != nil {
-		if track.PreType == "playlists" && !Config.UseSongInfoForPlaylist {
-			tags = append(tags, "disk=1/1")
-			tags = append(tags, fmt.Sprintf("album=%s", track.PlaylistData.Attributes.Name))
-			tags = append(tags, fmt.Sprintf("track=%d", track.TaskNum))
-			tags = append(tags, fmt.Sprintf("tracknum=%d/%d", track.TaskNum, track.TaskTotal))
-			tags = append(tags, fmt.Sprintf("album_artist=%s", track.PlaylistData.Attributes.ArtistName))
-			tags = append(tags, fmt.Sprintf("performer=%s", track.Resp.Attributes.ArtistName))
-		} else if track.PreType == "playlists" && Config.UseSongInfoForPlaylist {
-			tags = append(tags, fmt.Sprintf("album=%s", track.AlbumData.Attributes.Name))
-			tags = append(tags, fmt.Sprintf("disk=%d/%d", track.Resp.Attributes.DiscNumber, track.DiscTotal))
-			tags = append(tags, fmt.Sprintf("track=%d", track.Resp.Attributes.TrackNumber))
-			tags = append(tags, fmt.Sprintf("tracknum=%d/%d", track.Resp.Attributes.TrackNumber, track.AlbumData.Attributes.TrackCount))
-			tags = append(tags, fmt.Sprintf("album_artist=%s", track.AlbumData.Attributes.ArtistName))
-			tags = append(tags, fmt.Sprintf("performer=%s", track.Resp.Attributes.ArtistName))
-			tags = append(tags, fmt.Sprintf("copyright=%s", track.AlbumData.Attributes.Copyright))
-			tags = append(tags, fmt.Sprintf("UPC=%s", track.AlbumData.Attributes.Upc))
+		tags.Custom["PERFORMER"] = track.Resp.Attributes.ArtistName
+		if track.PreType == "playlists" && !s.Config.UseSongInfoForPlaylist {
+			tags.Album = track.PlaylistData.Attributes.Name
+			tags.AlbumArtist = track.PlaylistData.Attributes.ArtistName
+			tags.Disc, tags.DiscTotal = 1, 1
+			tags.Track, tags.TrackTotal = track.TaskNum, track.TaskTotal
 		} else {
-			tags = append(tags, fmt.Sprintf("album=%s", track.AlbumData.Attributes.Name))
-			tags = append(tags, fmt.Sprintf("disk=%d/%d", track.Resp.Attributes.DiscNumber, track.DiscTotal))
-			tags = append(tags, fmt.Sprintf("track=%d", track.Resp.Attributes.TrackNumber))
-			tags = append(tags, fmt.Sprintf("tracknum=%d/%d", track.Resp.Attributes.TrackNumber, track.AlbumData.Attributes.TrackCount))
-			tags = append(tags, fmt.Sprintf("album_artist=%s", track.AlbumData.Attributes.ArtistName))
-			tags = append(tags, fmt.Sprintf("performer=%s", track.Resp.Attributes.ArtistName))
-			tags = append(tags, fmt.Sprintf("copyright=%s", track.AlbumData.Attributes.Copyright))
-			tags = append(tags, fmt.Sprintf("UPC=%s", track.AlbumData.Attributes.Upc))
+			tags.Album = track.AlbumData.Attributes.Name
+			tags.AlbumArtist = track.AlbumData.Attributes.ArtistName
+			tags.Copyright = track.AlbumData.Attributes.Copyright
+			tags.Disc, tags.DiscTotal = track.Resp.Attributes.DiscNumber, track.DiscTotal
+			tags.Track, tags.TrackTotal = track.Resp.Attributes.TrackNumber, track.AlbumData.Attributes.TrackCount
+			tags.Custom["UPC"] = track.AlbumData.Attributes.Upc
 		}
 	} else {
-		tags = append(tags, fmt.Sprintf("album=%s", MVInfo.Data[0].Attributes.AlbumName))
-		tags = append(tags, fmt.Sprintf("disk=%d", MVInfo.Data[0].Attributes.DiscNumber))
-		tags = append(tags, fmt.Sprintf("track=%d", MVInfo.Data[0].Attributes.TrackNumber))
-		tags = append(tags, fmt.Sprintf("tracknum=%d", MVInfo.Data[0].Attributes.TrackNumber))
-		tags = append(tags, fmt.Sprintf("performer=%s", MVInfo.Data[0].Attributes.ArtistName))
+		tags.Album = attrs.AlbumName
+		tags.Disc = attrs.DiscNumber
+		tags.Track = attrs.TrackNumber
+		tags.Custom["PERFORMER"] = attrs.ArtistName
 	}
 
 	var covPath string
 	if true {
-		thumbURL := MVInfo.Data[0].Attributes.Artwork.URL
-		baseThumbName := forbiddenNames.ReplaceAllString(mvSaveName, "_") + "_thumbnail"
-		covPath, err = writeCover(saveDir, baseThumbName, thumbURL)
+		thumbURL := attrs.Artwork.URL
+		baseThumbName := mvBaseName + "_thumbnail"
+		covPath, err = s.writeCover(saveDir, baseThumbName, thumbURL)
 		if err != nil {
 			fmt.Println("Failed to save MV thumbnail:", err)
 		} else {
-			tags = append(tags, fmt.Sprintf("cover=%s", covPath))
+			tags.Cover = covPath
 		}
 	}
 	defer os.Remove(covPath)
 
-	tagsString := strings.Join(tags, ":")
-	muxCmd := exec.Command("MP4Box", "-itags", tagsString, "-quiet", "-add", vidPath, "-add", audPath, "-keep-utc", "-new", mvOutPath)
 	fmt.Printf("MV Remuxing...")
-	if err := muxCmd.Run(); err != nil {
+	if err := remux.Mux(mvOutPath, []string{vidPath, audPath}, tags); err != nil {
 		fmt.Printf("MV mux failed: %v\n", err)
 		return err
 	}
@@ -1949,7 +3621,7 @@ func mvDownloader(adamID string, saveDir string, token string, storefront string
 	return nil
 }
 
-func extractMvAudio(c string) (string, error) {
+func (s *Session) extractMvAudio(c string) (string, error) {
 	MediaUrl, err := url.Parse(c)
 	if err != nil {
 		return "", err
@@ -1979,9 +3651,9 @@ func extractMvAudio(c string) (string, error) {
 	audio := from.(*m3u8.MasterPlaylist)
 
 	var audioPriority = []string{"audio-atmos", "audio-ac3", "audio-stereo-256"}
-	if Config.MVAudioType == "ac3" {
+	if s.Config.MVAudioType == "ac3" {
 		audioPriority = []string{"audio-ac3", "audio-stereo-256"}
-	} else if Config.MVAudioType == "aac" {
+	} else if s.Config.MVAudioType == "aac" {
 		audioPriority = []string{"audio-stereo-256"}
 	}
 
@@ -2027,11 +3699,11 @@ func extractMvAudio(c string) (string, error) {
 	return audioStreams[0].URL, nil
 }
 
-func checkM3u8(b string, f string) (string, error) {
+func (s *Session) checkM3u8(b string, f string) (string, error) {
 	var EnhancedHls string
-	if Config.GetM3u8FromDevice {
+	if s.Config.GetM3u8FromDevice && s.Plan == nil {
 		adamID := b
-		conn, err := net.Dial("tcp", Config.GetM3u8Port)
+		conn, err := net.Dial("tcp", s.Config.GetM3u8Port)
 		if err != nil {
 			fmt.Println("Error connecting to device:", err)
 			return "none", err
@@ -2082,34 +3754,41 @@ func formatAvailability(available bool, quality string) string {
 	return quality
 }
 
-func extractMedia(b string, more_mode bool) (string, string, error) {
+func (s *Session) extractMedia(b string, more_mode bool) (string, string, error) {
+	streamUrl, quality, _, err := s.extractVariant(b, more_mode)
+	return streamUrl, quality, err
+}
+
+// extractVariant is extractMedia that also describes the chosen variant for the manifest.
+func (s *Session) extractVariant(b string, more_mode bool) (string, string, manifest.Variant, error) {
 	masterUrl, err := url.Parse(b)
 	if err != nil {
-		return "", "", err
+		return "", "", manifest.Variant{}, err
 	}
 	resp, err := http.Get(b)
 	if err != nil {
-		return "", "", err
+		return "", "", manifest.Variant{}, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return "", "", errors.New(resp.Status)
+		return "", "", manifest.Variant{}, errors.New(resp.Status)
 	}
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", "", err
+		return "", "", manifest.Variant{}, err
 	}
 	masterString := string(body)
 	from, listType, err := m3u8.DecodeFrom(strings.NewReader(masterString), true)
 	if err != nil || listType != m3u8.MASTER {
-		return "", "", errors.New("m3u8 not of master type")
+		return "", "", manifest.Variant{}, errors.New("m3u8 not of master type")
 	}
 	master := from.(*m3u8.MasterPlaylist)
 	var streamUrl *url.URL
+	var chosen *m3u8.Variant
 	sort.Slice(master.Variants, func(i, j int) bool {
 		return master.Variants[i].AverageBandwidth > master.Variants[j].AverageBandwidth
 	})
-	if debug_mode && more_mode {
+	if s.Debug && more_mode {
 		fmt.Println("\nDebug: All Available Variants:")
 		var data [][]string
 		for _, variant := range master.Variants {
@@ -2192,13 +3871,13 @@ func extractMedia(b string, more_mode bool) (string, string, error) {
 		fmt.Printf("Dolby Audio     : %s\n", formatAvailability(hasDolbyAudio, dolbyAudioQuality))
 		fmt.Println("------------------------")
 
-		return "", "", nil
+		return "", "", manifest.Variant{}, nil
 	}
 	var Quality string
 	for _, variant := range master.Variants {
-		if dl_atmos {
+		if s.Atmos {
 			if variant.Codecs == "ec-3" && strings.Contains(variant.Audio, "atmos") {
-				if debug_mode && !more_mode {
+				if s.Debug && !more_mode {
 					fmt.Printf("Debug: Found Dolby Atmos variant - %s (Bitrate: %d Kbps)\n",
 						variant.Audio, variant.Bandwidth/1000)
 				}
@@ -2206,43 +3885,45 @@ func extractMedia(b string, more_mode bool) (string, string, error) {
 				length := len(split)
 				length_int, err := strconv.Atoi(split[length-1])
 				if err != nil {
-					return "", "", err
+					return "", "", manifest.Variant{}, err
 				}
-				if length_int <= Config.AtmosMax {
-					if !debug_mode && !more_mode {
+				if length_int <= s.Config.AtmosMax {
+					if !s.Debug && !more_mode {
 						fmt.Printf("%s\n", variant.Audio)
 					}
 					streamUrlTemp, err := masterUrl.Parse(variant.URI)
 					if err != nil {
-						return "", "", err
+						return "", "", manifest.Variant{}, err
 					}
 					streamUrl = streamUrlTemp
+					chosen = variant
 					Quality = fmt.Sprintf("%s Kbps", split[len(split)-1])
 					break
 				}
 			} else if variant.Codecs == "ac-3" { // Add Dolby Audio support
-				if debug_mode && !more_mode {
+				if s.Debug && !more_mode {
 					fmt.Printf("Debug: Found Dolby Audio variant - %s (Bitrate: %d Kbps)\n",
 						variant.Audio, variant.Bandwidth/1000)
 				}
 				streamUrlTemp, err := masterUrl.Parse(variant.URI)
 				if err != nil {
-					return "", "", err
+					return "", "", manifest.Variant{}, err
 				}
 				streamUrl = streamUrlTemp
+				chosen = variant
 				split := strings.Split(variant.Audio, "-")
 				Quality = fmt.Sprintf("%s Kbps", split[len(split)-1])
 				break
 			}
-		} else if dl_aac {
+		} else if s.AAC {
 			if variant.Codecs == "mp4a.40.2" {
-				if debug_mode && !more_mode {
+				if s.Debug && !more_mode {
 					fmt.Printf("Debug: Found AAC variant - %s (Bitrate: %d)\n", variant.Audio, variant.Bandwidth)
 				}
 				aacregex := regexp.MustCompile(`audio-stereo-\d+`)
 				replaced := aacregex.ReplaceAllString(variant.Audio, "aac")
-				if replaced == Config.AacType {
-					if !debug_mode && !more_mode {
+				if replaced == s.Config.AacType {
+					if !s.Debug && !more_mode {
 						fmt.Printf("%s\n", variant.Audio)
 					}
 					streamUrlTemp, err := masterUrl.Parse(variant.URI)
@@ -2250,6 +3931,7 @@ func extractMedia(b string, more_mode bool) (string, string, error) {
 						panic(err)
 					}
 					streamUrl = streamUrlTemp
+					chosen = variant
 					split := strings.Split(variant.Audio, "-")
 					Quality = fmt.Sprintf("%s Kbps", split[2])
 					break
@@ -2261,10 +3943,10 @@ func extractMedia(b string, more_mode bool) (string, string, error) {
 				length := len(split)
 				length_int, err := strconv.Atoi(split[length-2])
 				if err != nil {
-					return "", "", err
+					return "", "", manifest.Variant{}, err
 				}
-				if length_int <= Config.AlacMax {
-					if !debug_mode && !more_mode {
+				if length_int <= s.Config.AlacMax {
+					if !s.Debug && !more_mode {
 						fmt.Printf("%s-bit / %s Hz\n", split[length-1], split[length-2])
 					}
 					streamUrlTemp, err := masterUrl.Parse(variant.URI)
@@ -2272,6 +3954,7 @@ func extractMedia(b string, more_mode bool) (string, string, error) {
 						panic(err)
 					}
 					streamUrl = streamUrlTemp
+					chosen = variant
 					KHZ := float64(length_int) / 1000.0
 					Quality = fmt.Sprintf("%sB-%.1fkHz", split[length-1], KHZ)
 					break
@@ -2280,11 +3963,29 @@ func extractMedia(b string, more_mode bool) (string, string, error) {
 		}
 	}
 	if streamUrl == nil {
-		return "", "", errors.New("no codec found")
+		return "", "", manifest.Variant{}, errors.New("no codec found")
+	}
+	return streamUrl.String(), Quality, mediaVariant(chosen), nil
+}
+
+// mediaVariant describes an audio variant; the bit depth and sample rate of ALAC come from its audio group,
+// such as audio-alac-stereo-96000-24.
+func mediaVariant(variant *m3u8.Variant) manifest.Variant {
+	v := manifest.Variant{
+		Codec:     variant.Codecs,
+		Audio:     variant.Audio,
+		Bandwidth: int(variant.Bandwidth),
+	}
+	if variant.Codecs == "alac" {
+		split := strings.Split(variant.Audio, "-")
+		if len(split) >= 2 {
+			v.BitDepth, _ = strconv.Atoi(split[len(split)-1])
+			v.SampleRate, _ = strconv.Atoi(split[len(split)-2])
+		}
 	}
-	return streamUrl.String(), Quality, nil
+	return v
 }
-func extractVideo(c string) (string, error) {
+func (s *Session) extractVideo(c string) (string, error) {
 	MediaUrl, err := url.Parse(c)
 	if err != nil {
 		return "", err
@@ -2320,7 +4021,7 @@ func extractVideo(c string) (string, error) {
 		return video.Variants[i].AverageBandwidth > video.Variants[j].AverageBandwidth
 	})
 
-	maxHeight := Config.MVMax
+	maxHeight := s.Config.MVMax
 
 	for _, variant := range video.Variants {
 		matches := re.FindStringSubmatch(variant.URI)
@@ -2349,9 +4050,9 @@ func extractVideo(c string) (string, error) {
 	return streamUrl.String(), nil
 }
 
-func ripSong(songId string, token string, storefront string, mediaUserToken string) error {
+func (s *Session) ripSong(songId string, token string, storefront string, mediaUserToken string) error {
 	// Get song info to find album ID
-	manifest, err := ampapi.GetSongResp(storefront, songId, Config.Language, token)
+	manifest, err := ampapi.GetSongResp(storefront, songId, s.Config.Language, token)
 	if err != nil {
 		fmt.Println("Failed to get song response.")
 		return err
@@ -2361,8 +4062,9 @@ func ripSong(songId string, token string, storefront string, mediaUserToken stri
 	albumId := songData.Relationships.Albums.Data[0].ID
 
 	// Use album approach but only download the specific song
-	dl_song = true
-	err = ripAlbum(albumId, token, storefront, mediaUserToken, songId)
+	song := s.derive()
+	song.Song = true
+	err = song.ripAlbum(albumId, token, storefront, mediaUserToken, songId)
 	if err != nil {
 		fmt.Println("Failed to rip song:", err)
 		return err
@@ -2408,7 +4110,7 @@ type TelegramBot struct {
 
 	queueMu       sync.Mutex
 	downloadQueue chan *downloadRequest
-	inProgress    bool
+	inProgress    int
 
 	cacheMu   sync.Mutex
 	cacheFile string
@@ -2442,7 +4144,7 @@ type downloadRequest struct {
 	format    string
 	transferMode string
 	albumID   string
-	fn        func() error
+	fn        func(s *Session) error
 }
 
 type Update struct {
@@ -2681,19 +4383,25 @@ func (b *TelegramBot) loop() {
 }
 
 func (b *TelegramBot) startDownloadWorker() {
-	go func() {
-		for req := range b.downloadQueue {
-			b.queueMu.Lock()
-			b.inProgress = true
-			b.queueMu.Unlock()
-
-			b.runDownload(req.chatID, req.fn, req.single, req.replyToID, req.format, req.transferMode, req.albumID)
-
-			b.queueMu.Lock()
-			b.inProgress = false
-			b.queueMu.Unlock()
-		}
-	}()
+	workers := Config.TelegramDownloadWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for req := range b.downloadQueue {
+				b.queueMu.Lock()
+				b.inProgress++
+				b.queueMu.Unlock()
+
+				b.runDownload(req.chatID, req.fn, req.single, req.replyToID, req.format, req.transferMode, req.albumID)
+
+				b.queueMu.Lock()
+				b.inProgress--
+				b.queueMu.Unlock()
+			}
+		}()
+	}
 }
 
 func normalizeTelegramFormat(format string) string {
@@ -3072,6 +4780,12 @@ func (b *TelegramBot) handleMessage(msg *Message) {
 		b.handleCommand(msg.Chat.ID, cmd, args, msg.MessageID)
 		return
 	}
+	for _, field := range strings.Fields(text) {
+		if strings.Contains(field, "apple.com/") {
+			b.queueLink(msg.Chat.ID, field, "", msg.MessageID)
+			return
+		}
+	}
 }
 
 func (b *TelegramBot) handleCallback(cb *CallbackQuery) {
@@ -3182,14 +4896,14 @@ func (b *TelegramBot) handleCommand(chatID int64, cmd string, args []string, rep
 			return
 		}
 		if len(args) == 1 {
-			b.queueDownloadSong(chatID, args[0])
+			b.queueLink(chatID, args[0], amurl.Song, replyToID)
 			return
 		}
 		switch strings.ToLower(args[0]) {
 		case "song":
-			b.queueDownloadSong(chatID, args[1])
+			b.queueLink(chatID, args[1], amurl.Song, replyToID)
 		case "album":
-			b.queueDownloadAlbum(chatID, args[1])
+			b.queueLink(chatID, args[1], amurl.Album, replyToID)
 		default:
 			_ = b.sendMessage(chatID, "Usage: /id <song|album> <id>", nil)
 		}
@@ -3400,6 +5114,25 @@ func (b *TelegramBot) handlePage(chatID int64, messageID int, delta int) {
 	b.setPending(chatID, pending.Kind, pending.Query, newOffset, items, hasNext, pending.ReplyToMessageID, messageID, pending.Title)
 }
 
+// queueLink downloads the song or album an Apple Music link or ID points to. Bare numeric IDs are taken as defaultKind.
+func (b *TelegramBot) queueLink(chatID int64, text string, defaultKind string, replyToID int) {
+	res, err := amurl.Parse(text, defaultKind)
+	if err != nil {
+		_ = b.sendMessageWithReply(chatID, err.Error(), nil, replyToID)
+		return
+	}
+	switch {
+	case res.Kind == amurl.Song:
+		b.queueDownloadSongWithReply(chatID, res.ID, replyToID)
+	case res.Kind == amurl.Album && res.TrackID != "":
+		b.queueDownloadSongWithReply(chatID, res.TrackID, replyToID)
+	case res.Kind == amurl.Album:
+		b.queueDownloadAlbumWithReply(chatID, res.ID, replyToID)
+	default:
+		_ = b.sendMessageWithReply(chatID, fmt.Sprintf("%s links are not supported, send a song or album link.", res.Kind), nil, replyToID)
+	}
+}
+
 func (b *TelegramBot) queueDownloadSong(chatID int64, songID string) {
 	b.queueDownloadSongWithReply(chatID, songID, 0)
 }
@@ -3413,8 +5146,8 @@ func (b *TelegramBot) queueDownloadSongWithReply(chatID int64, songID string, re
 	if b.trySendCachedTrack(chatID, replyToID, songID, format) {
 		return
 	}
-	b.enqueueDownload(chatID, replyToID, true, format, transferModeOneByOne, "", func() error {
-		return ripSong(songID, b.appleToken, Config.Storefront, Config.MediaUserToken)
+	b.enqueueDownload(chatID, replyToID, true, format, transferModeOneByOne, "", func(s *Session) error {
+		return s.ripSong(songID, b.appleToken, s.Config.Storefront, s.Config.MediaUserToken)
 	})
 }
 
@@ -3448,12 +5181,12 @@ func (b *TelegramBot) enqueueAlbumDownload(chatID int64, albumID string, replyTo
 		return
 	}
 	format := b.getChatFormat(chatID)
-	b.enqueueDownload(chatID, replyToID, false, format, transferMode, albumID, func() error {
-		return ripAlbum(albumID, b.appleToken, Config.Storefront, Config.MediaUserToken, "")
+	b.enqueueDownload(chatID, replyToID, false, format, transferMode, albumID, func(s *Session) error {
+		return s.ripAlbum(albumID, b.appleToken, s.Config.Storefront, s.Config.MediaUserToken, "")
 	})
 }
 
-func (b *TelegramBot) enqueueDownload(chatID int64, replyToID int, single bool, format string, transferMode string, albumID string, fn func() error) {
+func (b *TelegramBot) enqueueDownload(chatID int64, replyToID int, single bool, format string, transferMode string, albumID string, fn func(s *Session) error) {
 	if transferMode != transferModeOneByOne && transferMode != transferModeZip {
 		transferMode = transferModeOneByOne
 	}
@@ -3473,10 +5206,7 @@ func (b *TelegramBot) enqueueDownload(chatID int64, replyToID int, single bool,
 	inProgress := b.inProgress
 	queueLen := len(b.downloadQueue)
 	queueCap := cap(b.downloadQueue)
-	position := queueLen + 1
-	if inProgress {
-		position++
-	}
+	position := queueLen + inProgress + 1
 	queueFull := queueLen >= queueCap
 	b.queueMu.Unlock()
 
@@ -3490,7 +5220,7 @@ func (b *TelegramBot) enqueueDownload(chatID int64, replyToID int, single bool,
 		_ = b.sendMessageWithReply(chatID, "Download queue is full. Please try again later.", nil, replyToID)
 		return
 	}
-	if inProgress || queueLen > 0 {
+	if inProgress > 0 || queueLen > 0 {
 		_ = b.sendMessageWithReply(chatID, fmt.Sprintf("Queued. Position: %d", position), nil, replyToID)
 	}
 }
@@ -3523,23 +5253,9 @@ func (b *TelegramBot) trySendCachedAlbumZip(chatID int64, albumID string, replyT
 	return true
 }
 
-func (b *TelegramBot) runDownload(chatID int64, fn func() error, single bool, replyToID int, format string, transferMode string, albumID string) {
-
-	lastDownloadedPaths = nil
-	downloadedMetaMu.Lock()
-	downloadedMeta = make(map[string]AudioMeta)
-	downloadedMetaMu.Unlock()
-	counter = structs.Counter{}
-	okDict = make(map[string][]int)
-
-	dl_atmos = false
-	dl_aac = false
-	dl_select = false
-	if single {
-		dl_song = true
-	} else {
-		dl_song = false
-	}
+func (b *TelegramBot) runDownload(chatID int64, fn func(s *Session) error, single bool, replyToID int, format string, transferMode string, albumID string) {
+	sess := NewSession(Config)
+	sess.Song = single
 
 	format = normalizeTelegramFormat(format)
 	if format == "" {
@@ -3552,46 +5268,39 @@ func (b *TelegramBot) runDownload(chatID int64, fn func() error, single bool, re
 		transferMode = transferModeOneByOne
 	}
 	defer b.cleanupDownloadsIfNeeded()
-	Config.ConvertAfterDownload = format == telegramFormatFlac
+	sess.Config.ConvertAfterDownload = format == telegramFormatFlac
 	if format == telegramFormatFlac {
-		Config.ConvertFormat = telegramFormatFlac
-		Config.ConvertKeepOriginal = false
-		Config.ConvertSkipLossyToLossless = false
-		if _, err := exec.LookPath(Config.FFmpegPath); err != nil {
-			_ = b.sendMessageWithReply(chatID, fmt.Sprintf("ffmpeg not found at '%s'.", Config.FFmpegPath), nil, replyToID)
-			dl_song = false
+		sess.Config.ConvertFormat = telegramFormatFlac
+		sess.Config.ConvertKeepOriginal = false
+		sess.Config.ConvertSkipLossyToLossless = false
+		if _, err := exec.LookPath(sess.Config.FFmpegPath); err != nil {
+			_ = b.sendMessageWithReply(chatID, fmt.Sprintf("ffmpeg not found at '%s'.", sess.Config.FFmpegPath), nil, replyToID)
 			return
 		}
 	} else {
-		Config.ConvertFormat = ""
+		sess.Config.ConvertFormat = ""
 	}
 
 	status, err := newDownloadStatus(b, chatID, replyToID)
 	if err != nil {
 		_ = b.sendMessageWithReply(chatID, fmt.Sprintf("Failed to create status message: %v", err), nil, replyToID)
-		dl_song = false
 		return
 	}
 	defer status.Stop()
 
-	progress := func(phase string, done, total int64) {
+	sess.Progress = func(phase string, done, total int64) {
 		status.Update(phase, done, total)
 	}
-	activeProgress = progress
-	defer func() { activeProgress = nil }()
 
 	status.Update("Downloading", 0, 0)
-	err = fn()
+	err = fn(sess)
 	if err != nil {
 		status.UpdateSync(fmt.Sprintf("Failed: %v", err), 0, 0)
-		dl_song = false
 		return
 	}
-	dl_song = false
+	sess.Progress = nil
 
-	activeProgress = nil
-
-	paths := append([]string{}, lastDownloadedPaths...)
+	paths := sess.Paths()
 	if len(paths) == 0 {
 		status.UpdateSync("No files were downloaded.", 0, 0)
 		return
@@ -3620,7 +5329,7 @@ func (b *TelegramBot) runDownload(chatID int64, fn func() error, single bool, re
 	}
 	sentAny := false
 	for _, path := range paths {
-		if err := b.sendAudioFile(chatID, path, replyToID, status, format); err != nil {
+		if err := b.sendAudioFile(sess, chatID, path, replyToID, status, format); err != nil {
 			status.Update(fmt.Sprintf("Failed to send audio: %v", err), 0, 0)
 			continue
 		}
@@ -3829,7 +5538,7 @@ func isParentDir(parent, child string) bool {
 	return !strings.HasPrefix(rel, "..")
 }
 
-func (b *TelegramBot) sendAudioFile(chatID int64, filePath string, replyToID int, status *DownloadStatus, format string) error {
+func (b *TelegramBot) sendAudioFile(sess *Session, chatID int64, filePath string, replyToID int, status *DownloadStatus, format string) error {
 	format = normalizeTelegramFormat(format)
 	if format == "" {
 		format = defaultTelegramFormat
@@ -3849,7 +5558,7 @@ func (b *TelegramBot) sendAudioFile(chatID int64, filePath string, replyToID int
 	displayName := filepath.Base(filePath)
 	thumbPath := ""
 	compressed := false
-	meta, hasMeta := getDownloadedMeta(filePath)
+	meta, hasMeta := sess.DownloadedMeta(filePath)
 	cleanup := func() {
 		if thumbPath != "" {
 			_ = os.Remove(thumbPath)
@@ -4379,6 +6088,14 @@ func extractInlineTrackID(query string) string {
 	if strings.HasPrefix(lower, "song:") {
 		return strings.TrimSpace(trimmed[5:])
 	}
+	if res, err := amurl.Parse(trimmed, amurl.Song); err == nil {
+		if res.Kind == amurl.Song {
+			return res.ID
+		}
+		if res.Kind == amurl.Album && res.TrackID != "" {
+			return res.TrackID
+		}
+	}
 	return strings.TrimSpace(trimmed)
 }
 
@@ -4988,7 +6705,8 @@ Commands:
 /search <type> <keywords> unified search (type: song|album|artist)
 /songid <id>              download a song by ID
 /albumid <id>             download an album by ID
-/id <song|album> <id>     download by ID
+/id <song|album> <id>     download by ID or link
+<link>                    send a song or album link to download it
 /settings [alac|flac]     set download format (default: alac)
 `)
 }
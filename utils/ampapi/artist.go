@@ -1 +1,81 @@
 package ampapi
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type ArtistRelease struct {
+	ID          string
+	Type        string
+	Name        string
+	ReleaseDate string
+	URL         string
+}
+
+type ArtistReleasesResp struct {
+	Next string `json:"next"`
+	Data []struct {
+		ID         string `json:"id"`
+		Type       string `json:"type"`
+		Attributes struct {
+			Name             string `json:"name"`
+			ReleaseDate      string `json:"releaseDate"`
+			LastModifiedDate string `json:"lastModifiedDate"`
+			URL              string `json:"url"`
+		} `json:"attributes"`
+	} `json:"data"`
+}
+
+// GetArtistReleases pages through an artist relationship ("albums" or "music-videos") and returns it sorted by release date, oldest first.
+func GetArtistReleases(storefront string, id string, relationship string, language string, token string) ([]ArtistRelease, error) {
+	releases, err := getReleases(fmt.Sprintf("/v1/catalog/%s/artists/%s/%s", storefront, id, relationship), language, token)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(releases, func(i, j int) bool {
+		dateI, _ := time.Parse("2006-01-02", releases[i].ReleaseDate)
+		dateJ, _ := time.Parse("2006-01-02", releases[j].ReleaseDate)
+		return dateI.Before(dateJ)
+	})
+	return releases, nil
+}
+
+// getReleases pages through a list of albums, playlists or music videos in the order the API returns it.
+func getReleases(path string, language string, token string) ([]ArtistRelease, error) {
+	var releases []ArtistRelease
+	offset := 0
+	for {
+		query := url.Values{}
+		query.Set("limit", "100")
+		query.Set("offset", strconv.Itoa(offset))
+		query.Set("l", language)
+		obj := new(ArtistReleasesResp)
+		err := get(path, query, token, "", obj)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range obj.Data {
+			date := item.Attributes.ReleaseDate
+			if date == "" && len(item.Attributes.LastModifiedDate) >= 10 {
+				// playlists have no release date
+				date = item.Attributes.LastModifiedDate[:10]
+			}
+			releases = append(releases, ArtistRelease{
+				ID:          item.ID,
+				Type:        item.Type,
+				Name:        item.Attributes.Name,
+				ReleaseDate: date,
+				URL:         item.Attributes.URL,
+			})
+		}
+		offset += 100
+		if len(obj.Next) == 0 || len(obj.Data) == 0 {
+			break
+		}
+	}
+	return releases, nil
+}
@@ -0,0 +1,37 @@
+package ampapi
+
+import "fmt"
+
+// GetCuratorPlaylists returns the playlists of a curator, such as a radio show or a brand, or of an Apple Music curator.
+func GetCuratorPlaylists(storefront string, id string, language string, token string) ([]ArtistRelease, error) {
+	releases, err := getReleases(fmt.Sprintf("/v1/catalog/%s/curators/%s/playlists", storefront, id), language, token)
+	if err != nil {
+		// /curator/ links also point to Apple Music's own curators, which are a separate type
+		return getReleases(fmt.Sprintf("/v1/catalog/%s/apple-curators/%s/playlists", storefront, id), language, token)
+	}
+	return releases, nil
+}
+
+// GetRecordLabelReleases returns the latest releases of a record label followed by its top releases, without duplicates.
+func GetRecordLabelReleases(storefront string, id string, language string, token string) ([]ArtistRelease, error) {
+	var releases []ArtistRelease
+	seen := make(map[string]bool)
+	for _, view := range []string{"latest-releases", "top-releases"} {
+		viewReleases, err := getReleases(fmt.Sprintf("/v1/catalog/%s/record-labels/%s/view/%s", storefront, id, view), language, token)
+		if err != nil {
+			return nil, err
+		}
+		for _, release := range viewReleases {
+			if !seen[release.ID] {
+				seen[release.ID] = true
+				releases = append(releases, release)
+			}
+		}
+	}
+	return releases, nil
+}
+
+// GetRoomContents returns the albums and playlists of an editorial room.
+func GetRoomContents(storefront string, id string, language string, token string) ([]ArtistRelease, error) {
+	return getReleases(fmt.Sprintf("/v1/editorial/%s/rooms/%s/contents", storefront, id), language, token)
+}
@@ -0,0 +1,184 @@
+package ampapi
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Library resource types for GetLibraryItems.
+const (
+	LibraryAlbums    = "albums"
+	LibrarySongs     = "songs"
+	LibraryPlaylists = "playlists"
+)
+
+// LibraryItem is an album, song or playlist in the user's library.
+type LibraryItem struct {
+	ID   string
+	Name string
+	// CatalogID is the catalog resource the item maps to, "" for uploads Apple Music did not match.
+	CatalogID string
+}
+
+type libraryResp struct {
+	Next string        `json:"next"`
+	Data []libraryData `json:"data"`
+}
+
+type libraryData struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	Attributes struct {
+		Name    string `json:"name"`
+		Artwork struct {
+			URL string `json:"url"`
+		} `json:"artwork"`
+		PlayParams struct {
+			ID        string `json:"id"`
+			Kind      string `json:"kind"`
+			CatalogID string `json:"catalogId"`
+		} `json:"playParams"`
+	} `json:"attributes"`
+	Relationships struct {
+		Catalog struct {
+			Data []struct {
+				ID string `json:"id"`
+			} `json:"data"`
+		} `json:"catalog"`
+	} `json:"relationships"`
+}
+
+func (d libraryData) item() LibraryItem {
+	item := LibraryItem{ID: d.ID, Name: d.Attributes.Name, CatalogID: d.Attributes.PlayParams.CatalogID}
+	if len(d.Relationships.Catalog.Data) > 0 {
+		item.CatalogID = d.Relationships.Catalog.Data[0].ID
+	}
+	return item
+}
+
+// GetLibraryItem returns a library album or song with its catalog ID.
+func GetLibraryItem(kind string, id string, language string, token string, mediaUserToken string) (LibraryItem, error) {
+	query := url.Values{}
+	query.Set("include", "catalog")
+	query.Set("l", language)
+	obj := new(libraryResp)
+	err := get(fmt.Sprintf("/v1/me/library/%s/%s", kind, id), query, token, mediaUserToken, obj)
+	if err != nil {
+		return LibraryItem{}, err
+	}
+	if len(obj.Data) == 0 {
+		return LibraryItem{}, fmt.Errorf("library item %s not found", id)
+	}
+	return obj.Data[0].item(), nil
+}
+
+// GetLibraryItems pages through all albums, songs or playlists of the user's library.
+func GetLibraryItems(kind string, language string, token string, mediaUserToken string) ([]LibraryItem, error) {
+	var items []LibraryItem
+	err := getLibraryPages(fmt.Sprintf("/v1/me/library/%s", kind), language, token, mediaUserToken, func(data libraryData) {
+		items = append(items, data.item())
+	})
+	return items, err
+}
+
+// GetLibraryPlaylistResp returns a library playlist in the shape of a catalog playlist. Its tracks are
+// the catalog songs of the library tracks; uploads without a catalog match are left out and counted in skipped.
+func GetLibraryPlaylistResp(storefront string, id string, language string, token string, mediaUserToken string) (resp *PlaylistResp, skipped int, err error) {
+	query := url.Values{}
+	query.Set("l", language)
+	head := new(libraryResp)
+	err = get(fmt.Sprintf("/v1/me/library/playlists/%s", id), query, token, mediaUserToken, head)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(head.Data) == 0 {
+		return nil, 0, fmt.Errorf("library playlist %s not found", id)
+	}
+	var catalogIDs []string
+	err = getLibraryPages(fmt.Sprintf("/v1/me/library/playlists/%s/tracks", id), language, token, mediaUserToken, func(data libraryData) {
+		if catalogID := data.item().CatalogID; catalogID != "" {
+			catalogIDs = append(catalogIDs, catalogID)
+		} else {
+			skipped++
+		}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	tracks, err := GetCatalogSongs(storefront, catalogIDs, language, token)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp = &PlaylistResp{Data: make([]PlaylistRespData, 1)}
+	data := &resp.Data[0]
+	data.ID = id
+	data.Type = "library-playlists"
+	data.Attributes.Name = head.Data[0].Attributes.Name
+	data.Attributes.Artwork.URL = head.Data[0].Attributes.Artwork.URL
+	if data.Attributes.Artwork.URL == "" && len(tracks) > 0 {
+		// playlists without their own artwork use the cover of their first track
+		data.Attributes.Artwork.URL = tracks[0].Attributes.Artwork.URL
+	}
+	data.Attributes.TrackCount = len(tracks)
+	data.Attributes.PlayParams.ID = id
+	data.Attributes.PlayParams.Kind = "playlist"
+	data.Relationships.Tracks.Data = tracks
+	return resp, skipped, nil
+}
+
+// GetCatalogSongs returns the catalog songs with the given IDs, in the same order, with their stream URLs.
+// IDs the storefront does not have are left out.
+func GetCatalogSongs(storefront string, ids []string, language string, token string) ([]TrackRespData, error) {
+	byID := make(map[string]TrackRespData)
+	for start := 0; start < len(ids); start += 100 {
+		end := start + 100
+		if end > len(ids) {
+			end = len(ids)
+		}
+		query := url.Values{}
+		query.Set("ids", strings.Join(ids[start:end], ","))
+		query.Set("include", "albums,artists")
+		query.Set("extend", "extendedAssetUrls")
+		query.Set("l", language)
+		obj := new(TrackResp)
+		err := getCatalog(storefront, "songs", query, token, obj)
+		if err != nil {
+			return nil, err
+		}
+		for _, track := range obj.Data {
+			byID[track.ID] = track
+		}
+	}
+	var tracks []TrackRespData
+	for _, id := range ids {
+		if track, ok := byID[id]; ok {
+			tracks = append(tracks, track)
+		}
+	}
+	return tracks, nil
+}
+
+func getLibraryPages(path string, language string, token string, mediaUserToken string, each func(libraryData)) error {
+	offset := 0
+	for {
+		query := url.Values{}
+		query.Set("include", "catalog")
+		query.Set("limit", "100")
+		query.Set("offset", strconv.Itoa(offset))
+		query.Set("l", language)
+		obj := new(libraryResp)
+		err := get(path, query, token, mediaUserToken, obj)
+		if err != nil {
+			return err
+		}
+		for _, data := range obj.Data {
+			each(data)
+		}
+		offset += 100
+		if obj.Next == "" || len(obj.Data) == 0 {
+			return nil
+		}
+	}
+}
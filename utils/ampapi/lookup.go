@@ -0,0 +1,96 @@
+package ampapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// GetAlbumIDByUPC returns the ID of the album with the given UPC in storefront.
+func GetAlbumIDByUPC(storefront string, upc string, token string) (string, error) {
+	query := url.Values{}
+	query.Set("filter[upc]", upc)
+	obj := new(AlbumResp)
+	err := getCatalog(storefront, "albums", query, token, obj)
+	if err != nil {
+		return "", err
+	}
+	if len(obj.Data) == 0 {
+		return "", fmt.Errorf("no album with UPC %s in %s", upc, storefront)
+	}
+	return obj.Data[0].ID, nil
+}
+
+// GetSongsByISRC returns the songs with the given ISRC in storefront, including their stream URLs.
+func GetSongsByISRC(storefront string, isrc string, language string, token string) (*TrackResp, error) {
+	query := url.Values{}
+	query.Set("filter[isrc]", isrc)
+	query.Set("extend", "extendedAssetUrls")
+	query.Set("l", language)
+	obj := new(TrackResp)
+	err := getCatalog(storefront, "songs", query, token, obj)
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// MatchTrack finds want among tracks by ISRC, or else by disc and track number, and only returns a streamable track.
+func MatchTrack(tracks []TrackRespData, want TrackRespData) (TrackRespData, bool) {
+	for _, byISRC := range []bool{true, false} {
+		for _, track := range tracks {
+			if track.Attributes.ExtendedAssetUrls.EnhancedHls == "" {
+				continue
+			}
+			if byISRC && want.Attributes.Isrc != "" && track.Attributes.Isrc == want.Attributes.Isrc {
+				return track, true
+			}
+			if !byISRC && track.Attributes.DiscNumber == want.Attributes.DiscNumber && track.Attributes.TrackNumber == want.Attributes.TrackNumber {
+				return track, true
+			}
+		}
+	}
+	return TrackRespData{}, false
+}
+
+func getCatalog(storefront string, resource string, query url.Values, token string, obj any) error {
+	return get(fmt.Sprintf("/v1/catalog/%s/%s", storefront, resource), query, token, "", obj)
+}
+
+// get decodes an amp-api response into obj. Library paths under /v1/me need the media-user-token.
+func get(path string, query url.Values, token string, mediaUserToken string, obj any) error {
+	var err error
+	if token == "" {
+		token, err = GetToken()
+		if err != nil {
+			return err
+		}
+	}
+	if strings.HasPrefix(path, "/v1/me/") && len(mediaUserToken) <= 50 {
+		return errors.New("media-user-token is not set")
+	}
+
+	req, err := http.NewRequest("GET", "https://amp-api.music.apple.com"+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
+	req.Header.Set("Origin", "https://music.apple.com")
+	if mediaUserToken != "" {
+		req.Header.Set("Media-User-Token", mediaUserToken)
+	}
+	req.URL.RawQuery = query.Encode()
+	do, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer do.Body.Close()
+	if do.StatusCode != http.StatusOK {
+		return errors.New(do.Status)
+	}
+	return json.NewDecoder(do.Body).Decode(obj)
+}
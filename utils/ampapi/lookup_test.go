@@ -0,0 +1,44 @@
+package ampapi
+
+import "testing"
+
+func track(id string, isrc string, disc int, number int, streamable bool) TrackRespData {
+	var t TrackRespData
+	t.ID = id
+	t.Attributes.Isrc = isrc
+	t.Attributes.DiscNumber = disc
+	t.Attributes.TrackNumber = number
+	if streamable {
+		t.Attributes.ExtendedAssetUrls.EnhancedHls = "https://example.com/" + id + ".m3u8"
+	}
+	return t
+}
+
+func TestMatchTrack(t *testing.T) {
+	tracks := []TrackRespData{
+		track("1", "ISRC1", 1, 1, true),
+		track("2", "ISRC2", 1, 2, false),
+		track("3", "ISRC3", 1, 3, true),
+		track("4", "ISRC4", 2, 1, true),
+		track("5", "ISRC2", 2, 5, true),
+	}
+	tests := []struct {
+		name string
+		want TrackRespData
+		id   string
+	}{
+		{"by ISRC", track("x", "ISRC3", 9, 9, false), "3"},
+		{"ISRC before position", track("x", "ISRC4", 1, 1, false), "4"},
+		{"skips a non-streamable ISRC match", track("x", "ISRC2", 1, 2, false), "5"},
+		{"by disc and track number", track("x", "OTHER", 2, 1, false), "4"},
+		{"no ISRC", track("x", "", 1, 3, false), "3"},
+		{"skips a non-streamable position match", track("x", "OTHER", 1, 2, false), ""},
+		{"no match", track("x", "OTHER", 3, 1, false), ""},
+	}
+	for _, tt := range tests {
+		got, ok := MatchTrack(tracks, tt.want)
+		if ok != (tt.id != "") || got.ID != tt.id {
+			t.Errorf("%s: MatchTrack = %q, %v, want %q", tt.name, got.ID, ok, tt.id)
+		}
+	}
+}
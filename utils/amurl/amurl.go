@@ -0,0 +1,204 @@
+// Package amurl parses Apple Music links and bare IDs into the resource they point to.
+//
+// It understands music.apple.com links with or without a slug and their beta, classical, geo and
+// embed hosts, legacy itunes.apple.com links with "id" prefixed IDs, and links into the user's library.
+package amurl
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Kinds of resources.
+const (
+	Album       = "album"
+	Song        = "song"
+	Playlist    = "playlist"
+	Station     = "station"
+	MusicVideo  = "music-video"
+	Artist      = "artist"
+	Curator     = "curator"
+	RecordLabel = "record-label"
+	Room        = "room"
+)
+
+// kinds maps the path segments of links to kinds.
+var kinds = map[string]string{
+	"album":         Album,
+	"albums":        Album,
+	"song":          Song,
+	"songs":         Song,
+	"playlist":      Playlist,
+	"station":       Station,
+	"music-video":   MusicVideo,
+	"artist":        Artist,
+	"curator":       Curator,
+	"apple-curator": Curator,
+	"label":         RecordLabel,
+	"record-label":  RecordLabel,
+	"room":          Room,
+}
+
+var (
+	storefrontRe = regexp.MustCompile(`^[a-zA-Z]{2}$`)
+	numericRe    = regexp.MustCompile(`^\d+$`)
+	playlistRe   = regexp.MustCompile(`^pl\.[\w-]+$`)
+	stationRe    = regexp.MustCompile(`^ra\.[\w-]+$`)
+	// libraryRe matches the IDs of library resources by kind.
+	libraryRe = map[string]*regexp.Regexp{
+		Album:    regexp.MustCompile(`^l\.[\w-]+$`),
+		Song:     regexp.MustCompile(`^i\.[\w-]+$`),
+		Playlist: regexp.MustCompile(`^p\.[\w-]+$`),
+	}
+)
+
+// Resource is what a link points to.
+type Resource struct {
+	Kind string
+	// Storefront is the two-letter storefront, or "" when the link or bare ID has none.
+	Storefront string
+	ID         string
+	// TrackID is the track an album link selects with ?i=.
+	TrackID string
+	// Library is set for albums (l. IDs), songs (i. IDs) and playlists (p. IDs) in the user's own library,
+	// which need the media-user-token.
+	Library bool
+}
+
+// URL returns the canonical music.apple.com link of the resource.
+func (r Resource) URL() string {
+	var link string
+	if r.Library {
+		kind := r.Kind
+		if kind != Playlist {
+			kind += "s"
+		}
+		link = fmt.Sprintf("https://music.apple.com/library/%s/%s", kind, r.ID)
+	} else {
+		link = fmt.Sprintf("https://music.apple.com/%s/%s/%s", r.Storefront, r.Kind, r.ID)
+	}
+	if r.TrackID != "" {
+		link += "?i=" + r.TrackID
+	}
+	return link
+}
+
+// StorefrontOr returns the storefront of the resource, or fallback when it has none.
+func (r Resource) StorefrontOr(fallback string) string {
+	if r.Storefront != "" {
+		return r.Storefront
+	}
+	return fallback
+}
+
+// Parse parses an Apple Music link or a bare ID. Playlist, station and library IDs are recognized by
+// their prefix; bare numeric IDs are taken as defaultKind, and are an error when it is "".
+func Parse(raw string, defaultKind string) (Resource, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return Resource{}, errors.New("empty link")
+	}
+	if !strings.Contains(raw, "/") {
+		return parseID(raw, defaultKind)
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return Resource{}, fmt.Errorf("invalid link %q: %w", raw, err)
+	}
+	host := strings.ToLower(u.Hostname())
+	if host != "apple.com" && !strings.HasSuffix(host, ".apple.com") {
+		return Resource{}, fmt.Errorf("not an Apple Music link: %s", raw)
+	}
+	var segments []string
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	var res Resource
+	if len(segments) > 0 && storefrontRe.MatchString(segments[0]) {
+		res.Storefront = strings.ToLower(segments[0])
+		segments = segments[1:]
+	}
+	if len(segments) > 0 && segments[0] == "library" {
+		res.Library = true
+		segments = segments[1:]
+	}
+	if len(segments) == 0 {
+		return Resource{}, fmt.Errorf("link does not point to a release: %s", raw)
+	}
+	kind, ok := kinds[strings.ToLower(segments[0])]
+	if !ok {
+		return Resource{}, fmt.Errorf("unsupported link type %q: %s", segments[0], raw)
+	}
+	if len(segments) < 2 {
+		return Resource{}, fmt.Errorf("%s link has no ID: %s", kind, raw)
+	}
+	res.Kind = kind
+	res.ID = segments[len(segments)-1]
+	if strings.HasPrefix(res.ID, "id") && numericRe.MatchString(res.ID[2:]) {
+		// legacy itunes.apple.com links
+		res.ID = res.ID[2:]
+	}
+	if !validID(res.Kind, res.ID) {
+		return Resource{}, fmt.Errorf("invalid %s ID %q in %s", res.Kind, res.ID, raw)
+	}
+	if isLibraryID(res.Kind, res.ID) {
+		res.Library = true
+	} else if res.Library {
+		return Resource{}, fmt.Errorf("only library albums, songs and playlists are supported: %s", raw)
+	}
+	if i := u.Query().Get("i"); i != "" {
+		if !numericRe.MatchString(i) {
+			return Resource{}, fmt.Errorf("invalid track ID %q in %s", i, raw)
+		}
+		if res.Kind == Album {
+			res.TrackID = i
+		}
+	}
+	return res, nil
+}
+
+func parseID(id string, defaultKind string) (Resource, error) {
+	switch {
+	case playlistRe.MatchString(id):
+		return Resource{Kind: Playlist, ID: id}, nil
+	case stationRe.MatchString(id):
+		return Resource{Kind: Station, ID: id}, nil
+	case numericRe.MatchString(id):
+		if defaultKind == "" {
+			return Resource{}, fmt.Errorf("ID %s needs a type, pass a link instead", id)
+		}
+		return Resource{Kind: defaultKind, ID: id}, nil
+	}
+	for kind := range libraryRe {
+		if isLibraryID(kind, id) {
+			return Resource{Kind: kind, ID: id, Library: true}, nil
+		}
+	}
+	return Resource{}, fmt.Errorf("not an Apple Music link or ID: %s", id)
+}
+
+func validID(kind string, id string) bool {
+	if isLibraryID(kind, id) {
+		return true
+	}
+	switch kind {
+	case Playlist:
+		return playlistRe.MatchString(id)
+	case Station:
+		return stationRe.MatchString(id)
+	}
+	return numericRe.MatchString(id)
+}
+
+func isLibraryID(kind string, id string) bool {
+	re, ok := libraryRe[kind]
+	return ok && re.MatchString(id)
+}
@@ -0,0 +1,103 @@
+package amurl
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		raw         string
+		defaultKind string
+		want        Resource
+	}{
+		{"https://music.apple.com/us/album/1989-taylors-version/1708308989", "", Resource{Kind: Album, Storefront: "us", ID: "1708308989"}},
+		{"https://music.apple.com/jp/album/1708308989", "", Resource{Kind: Album, Storefront: "jp", ID: "1708308989"}},
+		{"https://music.apple.com/us/album/x/1708308989?i=1708309000", "", Resource{Kind: Album, Storefront: "us", ID: "1708308989", TrackID: "1708309000"}},
+		{"music.apple.com/GB/song/anti-hero/1708309000", "", Resource{Kind: Song, Storefront: "gb", ID: "1708309000"}},
+		{"https://beta.music.apple.com/us/playlist/todays-hits/pl.f4d106fed2bd41149aaacabb233eb5eb", "", Resource{Kind: Playlist, Storefront: "us", ID: "pl.f4d106fed2bd41149aaacabb233eb5eb"}},
+		{"https://classical.music.apple.com/us/album/1234", "", Resource{Kind: Album, Storefront: "us", ID: "1234"}},
+		{"https://music.apple.com/us/station/apple-music-1/ra.978194965", "", Resource{Kind: Station, Storefront: "us", ID: "ra.978194965"}},
+		{"https://music.apple.com/us/music-video/video/1710000000", "", Resource{Kind: MusicVideo, Storefront: "us", ID: "1710000000"}},
+		{"https://music.apple.com/us/artist/taylor-swift/159260351", "", Resource{Kind: Artist, Storefront: "us", ID: "159260351"}},
+		{"https://music.apple.com/us/label/republic-records/1543411840", "", Resource{Kind: RecordLabel, Storefront: "us", ID: "1543411840"}},
+		{"https://itunes.apple.com/us/album/name/id1708308989", "", Resource{Kind: Album, Storefront: "us", ID: "1708308989"}},
+		{"https://music.apple.com/library/albums/l.abcDEF123", "", Resource{Kind: Album, ID: "l.abcDEF123", Library: true}},
+		{"https://music.apple.com/library/playlist/p.XyZ-1", "", Resource{Kind: Playlist, ID: "p.XyZ-1", Library: true}},
+		{"https://music.apple.com/us/library/songs/i.AbC", "", Resource{Kind: Song, Storefront: "us", ID: "i.AbC", Library: true}},
+		{" pl.u-abc123 ", "", Resource{Kind: Playlist, ID: "pl.u-abc123"}},
+		{"ra.978194965", "", Resource{Kind: Station, ID: "ra.978194965"}},
+		{"1708308989", Album, Resource{Kind: Album, ID: "1708308989"}},
+		{"l.abcDEF123", "", Resource{Kind: Album, ID: "l.abcDEF123", Library: true}},
+		{"i.AbC", Album, Resource{Kind: Song, ID: "i.AbC", Library: true}},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.raw, tt.defaultKind)
+		if err != nil {
+			t.Errorf("Parse(%q) error = %v", tt.raw, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"", "empty link"},
+		{"1708308989", "needs a type"},
+		{"hello", "not an Apple Music link or ID"},
+		{"https://open.spotify.com/album/123", "not an Apple Music link"},
+		{"https://apple.com.evil.example/us/album/1", "not an Apple Music link"},
+		{"https://music.apple.com/us", "does not point to a release"},
+		{"https://music.apple.com/us/browse/123", "unsupported link type"},
+		{"https://music.apple.com/us/album", "has no ID"},
+		{"https://music.apple.com/us/album/name", "invalid album ID"},
+		{"https://music.apple.com/us/playlist/name/1234", "invalid playlist ID"},
+		{"https://music.apple.com/us/album/x/1?i=abc", "invalid track ID"},
+		{"https://music.apple.com/library/artist/r.123", "invalid artist ID"},
+		{"https://music.apple.com/library/albums/1234", "only library albums, songs and playlists"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.raw, "")
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Parse(%q) error = %v, want %q", tt.raw, err, tt.want)
+		}
+	}
+}
+
+func TestURL(t *testing.T) {
+	tests := []struct {
+		res  Resource
+		want string
+	}{
+		{Resource{Kind: Album, Storefront: "us", ID: "1", TrackID: "2"}, "https://music.apple.com/us/album/1?i=2"},
+		{Resource{Kind: Playlist, Storefront: "jp", ID: "pl.abc"}, "https://music.apple.com/jp/playlist/pl.abc"},
+		{Resource{Kind: Album, ID: "l.abc", Library: true}, "https://music.apple.com/library/albums/l.abc"},
+		{Resource{Kind: Playlist, ID: "p.abc", Library: true}, "https://music.apple.com/library/playlist/p.abc"},
+	}
+	for _, tt := range tests {
+		if got := tt.res.URL(); got != tt.want {
+			t.Errorf("%+v URL() = %q, want %q", tt.res, got, tt.want)
+		}
+		if !tt.res.Library {
+			back, err := Parse(tt.want, "")
+			if err != nil || back != tt.res {
+				t.Errorf("Parse(%q) = %+v, %v, want %+v", tt.want, back, err, tt.res)
+			}
+		}
+	}
+}
+
+func TestStorefrontOr(t *testing.T) {
+	if got := (Resource{Storefront: "jp"}).StorefrontOr("us"); got != "jp" {
+		t.Errorf("StorefrontOr = %q, want jp", got)
+	}
+	if got := (Resource{}).StorefrontOr("us"); got != "us" {
+		t.Errorf("StorefrontOr = %q, want us", got)
+	}
+}
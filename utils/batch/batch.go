@@ -0,0 +1,173 @@
+package batch
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Entry is one queued URL with its optional per-line overrides.
+type Entry struct {
+	Line       int
+	URL        string
+	Codec      string
+	Tracks     []int
+	Storefront string
+	Output     string
+}
+
+var codecs = []string{"alac", "atmos", "aac", "aac-lc", "aac-binaural", "aac-downmix"}
+
+// ParseFile reads a batch file with one URL per line followed by optional key=value overrides.
+// Blank lines and everything after a '#' that starts a line or follows whitespace are ignored.
+func ParseFile(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		entry, ok, err := ParseLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		if !ok {
+			continue
+		}
+		entry.Line = lineNum
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ParseLine parses a single batch line. ok is false for blank and comment-only lines.
+func ParseLine(line string) (Entry, bool, error) {
+	line = stripComment(line)
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return Entry{}, false, nil
+	}
+	entry := Entry{URL: fields[0]}
+	for _, field := range fields[1:] {
+		key, value, found := strings.Cut(field, "=")
+		if !found || value == "" {
+			return Entry{}, false, fmt.Errorf("invalid override %q, expected key=value", field)
+		}
+		switch strings.ToLower(key) {
+		case "codec":
+			value = strings.ToLower(value)
+			if !isKnownCodec(value) {
+				return Entry{}, false, fmt.Errorf("unknown codec %q (use %s)", value, strings.Join(codecs, ", "))
+			}
+			entry.Codec = value
+		case "tracks":
+			tracks, err := ParseRanges(value)
+			if err != nil {
+				return Entry{}, false, err
+			}
+			entry.Tracks = tracks
+		case "storefront":
+			if len(value) != 2 {
+				return Entry{}, false, fmt.Errorf("invalid storefront %q", value)
+			}
+			entry.Storefront = strings.ToLower(value)
+		case "output":
+			entry.Output = value
+		default:
+			return Entry{}, false, fmt.Errorf("unknown override %q", key)
+		}
+	}
+	return entry, true, nil
+}
+
+// ParseRanges parses a track selection such as "1-3,5,7" into track numbers.
+func ParseRanges(s string) ([]int, error) {
+	var selected []int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if startStr, endStr, isRange := strings.Cut(part, "-"); isRange {
+			start, err1 := strconv.Atoi(startStr)
+			end, err2 := strconv.Atoi(endStr)
+			if err1 != nil || err2 != nil || start < 1 || start > end {
+				return nil, fmt.Errorf("invalid track range %q", part)
+			}
+			for i := start; i <= end; i++ {
+				selected = append(selected, i)
+			}
+			continue
+		}
+		num, err := strconv.Atoi(part)
+		if err != nil || num < 1 {
+			return nil, fmt.Errorf("invalid track number %q", part)
+		}
+		selected = append(selected, num)
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("empty track selection %q", s)
+	}
+	return selected, nil
+}
+
+func stripComment(line string) string {
+	for i, r := range line {
+		if r != '#' {
+			continue
+		}
+		if i == 0 || line[i-1] == ' ' || line[i-1] == '\t' {
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// ParseCodecs parses a comma-separated codec list such as "alac,atmos,aac-binaural", dropping duplicates.
+func ParseCodecs(list string) ([]string, error) {
+	var out []string
+	for _, codec := range strings.Split(list, ",") {
+		codec = strings.ToLower(strings.TrimSpace(codec))
+		if codec == "" {
+			continue
+		}
+		if !isKnownCodec(codec) {
+			return nil, fmt.Errorf("unknown codec %q (use %s)", codec, strings.Join(codecs, ", "))
+		}
+		known := false
+		for _, c := range out {
+			known = known || c == codec
+		}
+		if !known {
+			out = append(out, codec)
+		}
+	}
+	return out, nil
+}
+
+func isKnownCodec(codec string) bool {
+	for _, c := range codecs {
+		if c == codec {
+			return true
+		}
+	}
+	return false
+}
+
+// StorefrontOr returns the entry's storefront override, or fallback when none is set.
+func (e Entry) StorefrontOr(fallback string) string {
+	if e.Storefront != "" {
+		return e.Storefront
+	}
+	return fallback
+}
@@ -0,0 +1,139 @@
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"main/utils/structs"
+)
+
+// Event types written by an Emitter.
+const (
+	JobStarted    = "job_started"
+	TrackResolved = "track_resolved"
+	Progress      = "progress"
+	Converted     = "converted"
+	TrackFinished = "track_finished"
+	Error         = "error"
+	Summary       = "summary"
+)
+
+// Error types reported in Event.ErrorType.
+const (
+	ErrUnavailable = "unavailable"
+	ErrManifest    = "manifest"
+	ErrToken       = "token"
+	ErrDownload    = "download"
+	ErrTagging     = "tagging"
+	ErrVerify      = "verify"
+	ErrURL         = "url"
+)
+
+// Event is one line of the JSON stream. Only the fields relevant to its type are set.
+type Event struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	URL       string    `json:"url,omitempty"`
+	Kind      string    `json:"kind,omitempty"`
+	TrackID   string    `json:"track_id,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	Artist    string    `json:"artist,omitempty"`
+	Album     string    `json:"album,omitempty"`
+	Codec     string    `json:"codec,omitempty"`
+	Quality   string    `json:"quality,omitempty"`
+	Phase     string    `json:"phase,omitempty"`
+	Done      int64     `json:"done,omitempty"`
+	Total     int64     `json:"total,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	Format    string    `json:"format,omitempty"`
+	ErrorType string    `json:"error_type,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Counts    *Counts   `json:"counts,omitempty"`
+	// Codecs breaks the summary down by codec when releases were downloaded in several codecs.
+	Codecs map[string]*Counts `json:"codecs,omitempty"`
+	// Qualities counts the tracks downloaded in each quality-preference option.
+	Qualities map[string]int `json:"qualities,omitempty"`
+}
+
+// Counts is the final tally carried by the summary event.
+type Counts struct {
+	Total       int `json:"total"`
+	Success     int `json:"success"`
+	Unavailable int `json:"unavailable"`
+	NotSong     int `json:"not_song"`
+	Error       int `json:"error"`
+}
+
+// Emitter writes events as newline-delimited JSON. A nil *Emitter is valid and writes nothing.
+type Emitter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// New returns an Emitter writing to w.
+func New(w io.Writer) *Emitter {
+	return &Emitter{enc: json.NewEncoder(w)}
+}
+
+// Emit writes ev, stamping it with the current time.
+func (e *Emitter) Emit(ev Event) {
+	if e == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_ = e.enc.Encode(ev)
+}
+
+// Progress returns a progress callback emitting progress events based on base.
+// Updates are limited to one per percent of each phase, or one per MiB when the total is unknown.
+func (e *Emitter) Progress(base Event) func(phase string, done, total int64) {
+	if e == nil {
+		return nil
+	}
+	lastPhase := ""
+	lastBucket := int64(-1)
+	var mu sync.Mutex
+	return func(phase string, done, total int64) {
+		bucket := done >> 20
+		if total > 0 {
+			bucket = done * 100 / total
+		}
+		mu.Lock()
+		if phase == lastPhase && bucket == lastBucket {
+			mu.Unlock()
+			return
+		}
+		lastPhase = phase
+		lastBucket = bucket
+		mu.Unlock()
+
+		ev := base
+		ev.Type = Progress
+		ev.Phase = phase
+		ev.Done = done
+		ev.Total = total
+		e.Emit(ev)
+	}
+}
+
+// SummaryEvent returns the summary event for the final counters of a run.
+func SummaryEvent(counter structs.Counter) Event {
+	return Event{Type: Summary, Counts: CountsOf(counter)}
+}
+
+// CountsOf converts run counters to the Counts of an event.
+func CountsOf(counter structs.Counter) *Counts {
+	return &Counts{
+		Total:       counter.Total,
+		Success:     counter.Success,
+		Unavailable: counter.Unavailable,
+		NotSong:     counter.NotSong,
+		Error:       counter.Error,
+	}
+}
@@ -0,0 +1,322 @@
+package history
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxStaleLines is how many superseded lines the history file may hold before Open compacts it.
+const maxStaleLines = 1000
+
+// Entry describes one archived track.
+type Entry struct {
+	TrackID      string    `json:"track_id"`
+	ISRC         string    `json:"isrc,omitempty"`
+	AlbumID      string    `json:"album_id,omitempty"`
+	Name         string    `json:"name,omitempty"`
+	Artist       string    `json:"artist,omitempty"`
+	Codec        string    `json:"codec"`
+	Quality      string    `json:"quality,omitempty"`
+	Path         string    `json:"path"`
+	Checksum     string    `json:"checksum,omitempty"`
+	Size         int64     `json:"size,omitempty"`
+	DownloadedAt time.Time `json:"downloaded_at"`
+}
+
+// historyFile is the format older versions wrote: one JSON document rewritten on every change.
+type historyFile struct {
+	Version int     `json:"version"`
+	Entries []Entry `json:"entries"`
+}
+
+// Store is a download history kept as JSON lines: Record appends one line per track and the last line of
+// a track wins, so recording stays cheap for large libraries. A nil *Store is valid and records nothing.
+type Store struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]Entry
+	// lines counts the entries in the file, including the ones later lines replaced
+	lines int
+	// torn is set when the file ends in a partly written line, which the next append would corrupt
+	torn bool
+}
+
+// Open loads the history stored at path, starting empty if the file does not exist yet. A file in the older
+// single-document format, or one holding many superseded lines, is rewritten compactly. A ".jsonl" path that
+// does not exist yet takes over the ".json" file next to it.
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:    path,
+		entries: make(map[string]Entry),
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && strings.HasSuffix(path, ".jsonl") {
+		// older versions defaulted to download-history.json
+		if os.Rename(strings.TrimSuffix(path, "l"), path) == nil {
+			data, err = os.ReadFile(path)
+		}
+	}
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s, nil
+		}
+		return nil, err
+	}
+	legacy := false
+	var payload historyFile
+	if err := json.Unmarshal(data, &payload); err == nil && payload.Version > 0 {
+		legacy = true
+		for _, entry := range payload.Entries {
+			s.add(entry)
+		}
+	} else if err := s.readLines(data); err != nil {
+		return nil, err
+	}
+	if legacy || s.torn || s.lines-len(s.entries) > maxStaleLines {
+		if err := s.compactLocked(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Store) readLines(data []byte) error {
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			// a crash while appending leaves an unterminated last line behind
+			if i == len(lines)-1 {
+				s.lines++
+				s.torn = true
+				continue
+			}
+			return fmt.Errorf("%s line %d: %w", filepath.Base(s.path), i+1, err)
+		}
+		s.add(entry)
+	}
+	return nil
+}
+
+func (s *Store) add(entry Entry) {
+	s.lines++
+	if entry.TrackID == "" {
+		return
+	}
+	s.entries[entryKey(entry.TrackID, entry.Codec)] = entry
+}
+
+func entryKey(trackID, codec string) string {
+	return strings.TrimSpace(trackID) + "|" + strings.ToUpper(strings.TrimSpace(codec))
+}
+
+// Lookup returns the entry archived for a track in the given codec, matching by track ID first and ISRC second.
+// An entry whose file no longer exists does not count, so deleted or moved tracks are downloaded again.
+func (s *Store) Lookup(trackID, isrc, codec string) (Entry, bool) {
+	if s == nil {
+		return Entry{}, false
+	}
+	for _, entry := range s.candidates(trackID, isrc, codec) {
+		if _, err := os.Stat(entry.Path); err == nil {
+			return entry, true
+		}
+	}
+	return Entry{}, false
+}
+
+// candidates returns the entry of the track ID followed by the other entries of the ISRC, all in codec.
+func (s *Store) candidates(trackID, isrc, codec string) []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found []Entry
+	key := entryKey(trackID, codec)
+	if entry, ok := s.entries[key]; ok {
+		found = append(found, entry)
+	}
+	if isrc == "" {
+		return found
+	}
+	codec = strings.ToUpper(strings.TrimSpace(codec))
+	for k, entry := range s.entries {
+		if k != key && strings.EqualFold(entry.ISRC, isrc) && strings.ToUpper(entry.Codec) == codec {
+			found = append(found, entry)
+		}
+	}
+	return found
+}
+
+// Record adds or replaces the entry for a track and codec and appends it to the history file.
+func (s *Store) Record(entry Entry) error {
+	if s == nil || entry.TrackID == "" {
+		return nil
+	}
+	if entry.DownloadedAt.IsZero() {
+		entry.DownloadedAt = time.Now()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.mkdirLocked(); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	s.add(entry)
+	return nil
+}
+
+// Close rewrites the history file without the lines later records replaced.
+func (s *Store) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lines == len(s.entries) {
+		return nil
+	}
+	return s.compactLocked()
+}
+
+// Forget removes every entry whose track ID, ISRC or album ID equals id and returns how many were removed.
+func (s *Store) Forget(id string) (int, error) {
+	if s == nil {
+		return 0, nil
+	}
+	id = strings.TrimSpace(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := 0
+	for key, entry := range s.entries {
+		if entry.TrackID == id || entry.AlbumID == id || (entry.ISRC != "" && strings.EqualFold(entry.ISRC, id)) {
+			delete(s.entries, key)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, s.compactLocked()
+}
+
+// ForgetPath removes the entries recorded for the file at path and returns how many were removed. Entries of
+// the same track in other codecs are kept.
+func (s *Store) ForgetPath(path string) (int, error) {
+	if s == nil {
+		return 0, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := 0
+	for key, entry := range s.entries {
+		if entry.Path == path {
+			delete(s.entries, key)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, s.compactLocked()
+}
+
+// Entries returns all entries ordered by download time.
+func (s *Store) Entries() []Entry {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sortedLocked()
+}
+
+func (s *Store) sortedLocked() []Entry {
+	entries := make([]Entry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].DownloadedAt.Equal(entries[j].DownloadedAt) {
+			return entries[i].TrackID < entries[j].TrackID
+		}
+		return entries[i].DownloadedAt.Before(entries[j].DownloadedAt)
+	})
+	return entries
+}
+
+func (s *Store) mkdirLocked() error {
+	dir := filepath.Dir(s.path)
+	if dir != "." && dir != "" {
+		return os.MkdirAll(dir, 0755)
+	}
+	return nil
+}
+
+// compactLocked rewrites the history file with one line per entry.
+func (s *Store) compactLocked() error {
+	if err := s.mkdirLocked(); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	entries := s.sortedLocked()
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.lines = len(entries)
+	s.torn = false
+	return nil
+}
+
+// Checksum returns the hex encoded SHA-256 of the file at path and its size.
+func Checksum(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
@@ -0,0 +1,301 @@
+package history
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// track writes an empty file for an entry to point at.
+func track(t *testing.T, dir, name string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+func TestLookup(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(filepath.Join(dir, "history.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alac := track(t, dir, "alac.m4a")
+	binaural := track(t, dir, "binaural.m4a")
+	deluxe := track(t, dir, "deluxe.m4a")
+	entries := []Entry{
+		{TrackID: "1", ISRC: "USABC0000001", AlbumID: "10", Codec: "ALAC", Path: alac},
+		{TrackID: "1", ISRC: "USABC0000001", AlbumID: "10", Codec: "AAC-BINAURAL", Path: binaural},
+		{TrackID: "2", ISRC: "USABC0000002", AlbumID: "10", Codec: "ALAC", Path: filepath.Join(dir, "deleted.m4a")},
+		{TrackID: "3", ISRC: "USABC0000003", AlbumID: "10", Codec: "ALAC", Path: filepath.Join(dir, "moved.m4a")},
+		{TrackID: "30", ISRC: "USABC0000003", AlbumID: "20", Codec: "ALAC", Path: deluxe},
+	}
+	for _, entry := range entries {
+		if err := s.Record(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		trackID, isrc, codec string
+		want                 string
+	}{
+		{"1", "", "ALAC", alac},
+		{"1", "", " alac ", alac},
+		{"1", "", "AAC-BINAURAL", binaural},
+		{"1", "", "AAC", ""},
+		{"1", "", "AAC-LC", ""},
+		// the same recording under another ID, e.g. from a deluxe edition
+		{"99", "usabc0000001", "ALAC", alac},
+		{"99", "USABC0000009", "ALAC", ""},
+		{"99", "", "ALAC", ""},
+		// the file is gone
+		{"2", "USABC0000002", "ALAC", ""},
+		// the file of the track ID is gone, but the same recording is still archived from another release
+		{"3", "USABC0000003", "ALAC", deluxe},
+		{"3", "", "ALAC", ""},
+	}
+	for _, tt := range tests {
+		entry, ok := s.Lookup(tt.trackID, tt.isrc, tt.codec)
+		if ok != (tt.want != "") || entry.Path != tt.want {
+			t.Errorf("Lookup(%q, %q, %q) = %q, %v, want %q", tt.trackID, tt.isrc, tt.codec, entry.Path, ok, tt.want)
+		}
+	}
+}
+
+func TestForget(t *testing.T) {
+	tests := []struct {
+		id   string
+		want int
+		left []string
+	}{
+		{"1", 2, []string{"2", "3"}},
+		{"10", 2, []string{"1", "3"}},
+		{"usabc0000003", 1, []string{"1", "2"}},
+		{"404", 0, []string{"1", "2", "3"}},
+		{"", 0, []string{"1", "2", "3"}},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "history.jsonl")
+		s, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range []Entry{
+			{TrackID: "1", AlbumID: "10", Codec: "ALAC"},
+			{TrackID: "1", AlbumID: "20", Codec: "ATMOS"},
+			{TrackID: "2", AlbumID: "10", Codec: "ALAC"},
+			{TrackID: "3", ISRC: "USABC0000003", AlbumID: "30", Codec: "ALAC"},
+		} {
+			if err := s.Record(entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+		removed, err := s.Forget(tt.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed != tt.want {
+			t.Errorf("Forget(%q) removed %d, want %d", tt.id, removed, tt.want)
+		}
+		reopened, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var left []string
+		seen := make(map[string]bool)
+		for _, entry := range reopened.Entries() {
+			if !seen[entry.TrackID] {
+				seen[entry.TrackID] = true
+				left = append(left, entry.TrackID)
+			}
+		}
+		if strings.Join(left, ",") != strings.Join(tt.left, ",") {
+			t.Errorf("after Forget(%q) the history holds %v, want %v", tt.id, left, tt.left)
+		}
+	}
+}
+
+func TestRecordAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "history.jsonl")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		entry := Entry{TrackID: "1", Codec: "ALAC", Quality: string(rune('a' + i)), DownloadedAt: start.Add(time.Duration(i) * time.Hour)}
+		if err := s.Record(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Record(Entry{TrackID: "2", Codec: "ALAC", DownloadedAt: start}); err != nil {
+		t.Fatal(err)
+	}
+	if n := countLines(t, path); n != 4 {
+		t.Fatalf("history file has %d lines after 4 records, want 4", n)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := reopened.Entries()
+	if len(entries) != 2 || entries[0].TrackID != "2" || entries[1].Quality != "c" {
+		t.Fatalf("reopened history = %+v, want track 2 and the last record of track 1", entries)
+	}
+	if err := reopened.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countLines(t, path); n != 2 {
+		t.Errorf("history file has %d lines after Close, want 2", n)
+	}
+}
+
+func TestOpenFormats(t *testing.T) {
+	legacy, err := json.Marshal(historyFile{Version: 1, Entries: []Entry{
+		{TrackID: "1", Codec: "ALAC"},
+		{TrackID: "2", Codec: "ATMOS"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		data    string
+		entries int
+		lines   int
+		err     bool
+	}{
+		{"empty", "", 0, 0, false},
+		{"legacy", string(legacy), 2, 2, false},
+		// a file without superseded lines is left as is
+		{"lines", "{\"track_id\":\"1\",\"codec\":\"ALAC\"}\n\n{\"track_id\":\"2\",\"codec\":\"ALAC\"}\n", 2, 3, false},
+		{"torn", "{\"track_id\":\"1\",\"codec\":\"ALAC\"}\n{\"track_id\":\"2\",\"co", 1, 1, false},
+		{"corrupt", "{\"track_id\":\"1\"\n{\"track_id\":\"2\",\"codec\":\"ALAC\"}\n", 0, 0, true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "history.jsonl")
+		if err := os.WriteFile(path, []byte(tt.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		s, err := Open(path)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: Open succeeded, want an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Open error = %v", tt.name, err)
+			continue
+		}
+		if n := len(s.Entries()); n != tt.entries {
+			t.Errorf("%s: %d entries, want %d", tt.name, n, tt.entries)
+		}
+		if tt.data != "" {
+			if n := countLines(t, path); n != tt.lines {
+				t.Errorf("%s: file has %d lines after Open, want %d", tt.name, n, tt.lines)
+			}
+		}
+		// an append after a torn line must still be readable
+		if err := s.Record(Entry{TrackID: "3", Codec: "ALAC"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Open(path); err != nil {
+			t.Errorf("%s: Open after Record error = %v", tt.name, err)
+		}
+	}
+}
+
+func TestNilStore(t *testing.T) {
+	var s *Store
+	if _, ok := s.Lookup("1", "", "ALAC"); ok {
+		t.Error("nil store found an entry")
+	}
+	if err := s.Record(Entry{TrackID: "1"}); err != nil {
+		t.Error(err)
+	}
+	if n, err := s.Forget("1"); n != 0 || err != nil {
+		t.Errorf("Forget = %d, %v", n, err)
+	}
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestForgetPath(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(filepath.Join(dir, "history.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := track(t, dir, "broken.m4a")
+	atmos := track(t, dir, "atmos.m4a")
+	for _, entry := range []Entry{
+		{TrackID: "1", ISRC: "USABC0000001", AlbumID: "10", Codec: "ALAC", Path: broken},
+		{TrackID: "1", ISRC: "USABC0000001", AlbumID: "10", Codec: "ATMOS", Path: atmos},
+		{TrackID: "2", ISRC: "USABC0000001", AlbumID: "20", Codec: "AAC", Path: track(t, dir, "other.m4a")},
+	} {
+		if err := s.Record(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		path string
+		want int
+		left int
+	}{
+		{filepath.Join(dir, "missing.m4a"), 0, 3},
+		{broken, 1, 2},
+		{broken, 0, 2},
+	}
+	for _, tt := range tests {
+		removed, err := s.ForgetPath(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed != tt.want || len(s.Entries()) != tt.left {
+			t.Errorf("ForgetPath(%s) removed %d leaving %d, want %d leaving %d", filepath.Base(tt.path), removed, len(s.Entries()), tt.want, tt.left)
+		}
+	}
+	if _, ok := s.Lookup("1", "", "ATMOS"); !ok {
+		t.Error("ForgetPath removed the entry of another codec")
+	}
+}
+
+func TestOpenOldName(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "download-history.json")
+	if err := os.WriteFile(old, []byte("{\"track_id\":\"1\",\"codec\":\"ALAC\"}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "download-history.jsonl")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.Entries()); n != 1 {
+		t.Errorf("%d entries taken over from the .json file, want 1", n)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("the .json file is still there: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,145 @@
+// Package manifest records what was downloaded into an album or playlist folder, with a checksum file
+// that sha256sum -c can check offline.
+package manifest
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// File names inside a release folder.
+const (
+	FileName         = "manifest.json"
+	ChecksumFileName = "checksums.sha256"
+)
+
+// Variant is the stream a track was downloaded from.
+type Variant struct {
+	Codec      string `json:"codec"`
+	Audio      string `json:"audio,omitempty"`
+	BitDepth   int    `json:"bit_depth,omitempty"`
+	SampleRate int    `json:"sample_rate,omitempty"`
+	Bandwidth  int    `json:"bandwidth,omitempty"`
+}
+
+// Track is one downloaded file. File is relative to the release folder, and Storefront is only set
+// for tracks that came from a fallback storefront.
+type Track struct {
+	ID         string  `json:"id"`
+	ISRC       string  `json:"isrc,omitempty"`
+	Position   int     `json:"position"`
+	Disc       int     `json:"disc,omitempty"`
+	Name       string  `json:"name"`
+	Artist     string  `json:"artist,omitempty"`
+	Storefront string  `json:"storefront,omitempty"`
+	Quality    string  `json:"quality,omitempty"`
+	Variant    Variant `json:"variant"`
+	File       string  `json:"file"`
+	Size       int64   `json:"size"`
+	SHA256     string  `json:"sha256"`
+}
+
+// Manifest describes an album or playlist folder.
+type Manifest struct {
+	Type       string    `json:"type"`
+	ID         string    `json:"id"`
+	UPC        string    `json:"upc,omitempty"`
+	Name       string    `json:"name"`
+	Artist     string    `json:"artist,omitempty"`
+	Storefront string    `json:"storefront"`
+	Codec      string    `json:"codec"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	Tracks     []Track   `json:"tracks"`
+}
+
+// Load reads the manifest in folder. A missing file yields an empty manifest.
+func Load(folder string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(folder, FileName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &Manifest{}, nil
+		}
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Add records a track, replacing an earlier entry with the same ID. A track without a variant, such as one
+// that already existed locally, keeps the variant of the entry it replaces when the file did not change.
+func (m *Manifest) Add(track Track) {
+	for i, old := range m.Tracks {
+		if old.ID != track.ID {
+			continue
+		}
+		if track.Variant == (Variant{}) && old.SHA256 == track.SHA256 {
+			track.Variant = old.Variant
+		}
+		m.Tracks[i] = track
+		return
+	}
+	m.Tracks = append(m.Tracks, track)
+}
+
+// Save writes the manifest and the checksum file into folder. Entries whose file is gone are dropped,
+// so tracks removed or renamed since the last run do not linger.
+func (m *Manifest) Save(folder string) error {
+	kept := m.Tracks[:0]
+	for _, track := range m.Tracks {
+		if _, err := os.Stat(filepath.Join(folder, track.File)); err == nil {
+			kept = append(kept, track)
+		}
+	}
+	m.Tracks = kept
+	sort.SliceStable(m.Tracks, func(i, j int) bool {
+		if m.Tracks[i].Disc != m.Tracks[j].Disc {
+			return m.Tracks[i].Disc < m.Tracks[j].Disc
+		}
+		return m.Tracks[i].Position < m.Tracks[j].Position
+	})
+	m.UpdatedAt = time.Now()
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(folder, FileName), func(w *bufio.Writer) {
+		w.Write(data)
+		w.WriteString("\n")
+	}); err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(folder, ChecksumFileName), func(w *bufio.Writer) {
+		for _, track := range m.Tracks {
+			// the binary marker makes sha256sum read the files the same way on every platform
+			fmt.Fprintf(w, "%s *%s\n", track.SHA256, filepath.ToSlash(track.File))
+		}
+	})
+}
+
+// writeFile writes path through a temporary file so a crash never leaves half a manifest.
+func writeFile(path string, fill func(w *bufio.Writer)) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fill(w)
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
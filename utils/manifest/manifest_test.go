@@ -0,0 +1,77 @@
+package manifest
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdd(t *testing.T) {
+	alac := Variant{Codec: "ALAC", BitDepth: 24, SampleRate: 96000}
+	tests := []struct {
+		name  string
+		track Track
+		want  Variant
+		count int
+	}{
+		{"new track", Track{ID: "2", SHA256: "b", Variant: alac}, alac, 2},
+		{"replaced with a new variant", Track{ID: "1", SHA256: "c", Variant: Variant{Codec: "AAC"}}, Variant{Codec: "AAC"}, 1},
+		{"existing file keeps its variant", Track{ID: "1", SHA256: "a"}, alac, 1},
+		{"changed file drops its variant", Track{ID: "1", SHA256: "c"}, Variant{}, 1},
+	}
+	for _, tt := range tests {
+		m := &Manifest{Tracks: []Track{{ID: "1", SHA256: "a", Variant: alac}}}
+		m.Add(tt.track)
+		if len(m.Tracks) != tt.count {
+			t.Errorf("%s: %d tracks, want %d", tt.name, len(m.Tracks), tt.count)
+			continue
+		}
+		if got := m.Tracks[len(m.Tracks)-1].Variant; got != tt.want {
+			t.Errorf("%s: variant %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"01 A.m4a", "Disc 2/01 C.m4a"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	empty, err := Load(dir)
+	if err != nil || len(empty.Tracks) != 0 {
+		t.Fatalf("Load of a missing manifest = %+v, %v", empty, err)
+	}
+	m := &Manifest{Type: "album", ID: "1"}
+	m.Add(Track{ID: "c", Disc: 2, Position: 1, File: "Disc 2/01 C.m4a", SHA256: "cc"})
+	m.Add(Track{ID: "b", Disc: 1, Position: 2, File: "02 B.m4a", SHA256: "bb"})
+	m.Add(Track{ID: "a", Disc: 1, Position: 1, File: "01 A.m4a", SHA256: "aa"})
+	if err := m.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, track := range loaded.Tracks {
+		ids = append(ids, track.ID)
+	}
+	// b has no file, so it is dropped
+	if strings.Join(ids, ",") != "a,c" || loaded.UpdatedAt.IsZero() {
+		t.Errorf("loaded tracks %v at %v, want a,c", ids, loaded.UpdatedAt)
+	}
+	sums, err := os.ReadFile(filepath.Join(dir, ChecksumFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "aa *01 A.m4a\ncc *Disc 2/01 C.m4a\n"; string(sums) != want {
+		t.Errorf("checksums = %q, want %q", sums, want)
+	}
+}
@@ -0,0 +1,301 @@
+// Package naming expands the folder and file name formats from config.yaml.
+//
+// A format is plain text with placeholders in braces:
+//
+//	{Name}              the value of a variable
+//	{Name:3}            a number zero-padded to 3 digits
+//	{Name:auto}         a number padded to the digits of its total, e.g. TrackTotal for TrackNumber
+//	{Name|upper}        a filtered value: upper, lower, title or ascii, filters can be chained
+//	{if Name}...{end}   text kept only when Name is set and not "0" or "false"
+//	{if Name > 1}...{else}...{end}
+//	                    comparisons ==, !=, <, <=, >, >= against a number or text
+//
+// Text in braces that is not a placeholder, such as the outer braces of "{{Tag}}", is kept as is.
+package naming
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Vars holds the variables available to a format.
+type Vars map[string]string
+
+// totals maps numeric variables to the variable holding their maximum, used by {Name:auto}.
+var totals = map[string]string{
+	"SongNumer":   "TrackTotal",
+	"SongNumber":  "TrackTotal",
+	"TrackNumber": "TrackTotal",
+	"DiscNumber":  "DiscTotal",
+}
+
+// Expand renders format with vars.
+func Expand(format string, vars Vars) string {
+	nodes, _ := parse(format, 0, false)
+	var b strings.Builder
+	render(&b, nodes, vars)
+	return b.String()
+}
+
+type node struct {
+	text      string
+	name      string
+	pad       string
+	filters   []string
+	cond      *condition
+	then, els []node
+}
+
+type condition struct {
+	name  string
+	op    string
+	value string
+}
+
+// parse reads nodes until the end of format or, inside a conditional, until its {else} or {end}.
+// It returns the nodes and the position after the closing tag.
+func parse(format string, pos int, inBlock bool) ([]node, int) {
+	var nodes []node
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			nodes = append(nodes, node{text: text.String()})
+			text.Reset()
+		}
+	}
+	for pos < len(format) {
+		open := strings.IndexByte(format[pos:], '{')
+		if open < 0 {
+			text.WriteString(format[pos:])
+			pos = len(format)
+			break
+		}
+		text.WriteString(format[pos : pos+open])
+		pos += open
+		end := strings.IndexByte(format[pos:], '}')
+		if end < 0 {
+			text.WriteString(format[pos:])
+			pos = len(format)
+			break
+		}
+		tag := format[pos+1 : pos+end]
+		if tag == "" || strings.ContainsAny(tag, "{\n") {
+			text.WriteByte('{')
+			pos++
+			continue
+		}
+		switch {
+		case (tag == "else" || tag == "end") && inBlock:
+			flush()
+			return nodes, pos
+		case strings.HasPrefix(tag, "if "):
+			cond, ok := parseCondition(strings.TrimSpace(tag[3:]))
+			if !ok {
+				text.WriteByte('{')
+				pos++
+				continue
+			}
+			flush()
+			n := node{cond: &cond}
+			var next int
+			n.then, next = parse(format, pos+end+1, true)
+			if strings.HasPrefix(format[next:], "{else}") {
+				n.els, next = parse(format, next+len("{else}"), true)
+			}
+			if strings.HasPrefix(format[next:], "{end}") {
+				next += len("{end}")
+			}
+			nodes = append(nodes, n)
+			pos = next
+			continue
+		}
+		n, ok := parsePlaceholder(tag)
+		if !ok {
+			text.WriteByte('{')
+			pos++
+			continue
+		}
+		flush()
+		nodes = append(nodes, n)
+		pos += end + 1
+	}
+	flush()
+	return nodes, pos
+}
+
+func parsePlaceholder(tag string) (node, bool) {
+	parts := strings.Split(tag, "|")
+	name, pad, _ := strings.Cut(parts[0], ":")
+	if !isName(name) {
+		return node{}, false
+	}
+	if pad != "" && pad != "auto" {
+		if _, err := strconv.Atoi(pad); err != nil {
+			return node{}, false
+		}
+	}
+	n := node{name: name, pad: pad}
+	for _, filter := range parts[1:] {
+		switch filter = strings.TrimSpace(filter); filter {
+		case "upper", "lower", "title", "ascii":
+			n.filters = append(n.filters, filter)
+		default:
+			return node{}, false
+		}
+	}
+	return n, true
+}
+
+func parseCondition(expr string) (condition, bool) {
+	fields := strings.Fields(expr)
+	switch len(fields) {
+	case 1:
+		if strings.HasPrefix(fields[0], "!") && isName(fields[0][1:]) {
+			return condition{name: fields[0][1:], op: "!"}, true
+		}
+		return condition{name: fields[0]}, isName(fields[0])
+	case 3:
+		switch fields[1] {
+		case "==", "!=", "<", "<=", ">", ">=":
+			return condition{name: fields[0], op: fields[1], value: fields[2]}, isName(fields[0])
+		}
+	}
+	return condition{}, false
+}
+
+func isName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !(r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+func render(b *strings.Builder, nodes []node, vars Vars) {
+	for _, n := range nodes {
+		switch {
+		case n.cond != nil:
+			if n.cond.eval(vars) {
+				render(b, n.then, vars)
+			} else {
+				render(b, n.els, vars)
+			}
+		case n.name != "":
+			b.WriteString(n.value(vars))
+		default:
+			b.WriteString(n.text)
+		}
+	}
+}
+
+func (n node) value(vars Vars) string {
+	value, ok := vars[n.name]
+	if !ok {
+		// keep unknown placeholders so formats can be expanded in stages
+		return "{" + n.name + "}"
+	}
+	if n.pad != "" {
+		width := 0
+		if n.pad == "auto" {
+			width = len(strings.TrimLeft(vars[totals[n.name]], "0"))
+		} else {
+			width, _ = strconv.Atoi(n.pad)
+		}
+		if num, err := strconv.Atoi(value); err == nil {
+			value = strconv.Itoa(num)
+			if len(value) < width {
+				value = strings.Repeat("0", width-len(value)) + value
+			}
+		}
+	}
+	for _, filter := range n.filters {
+		switch filter {
+		case "upper":
+			value = strings.ToUpper(value)
+		case "lower":
+			value = strings.ToLower(value)
+		case "title":
+			value = cases.Title(language.Und, cases.NoLower).String(value)
+		case "ascii":
+			value = ASCII(value)
+		}
+	}
+	return value
+}
+
+func (c condition) eval(vars Vars) bool {
+	value := vars[c.name]
+	switch c.op {
+	case "":
+		return truthy(value)
+	case "!":
+		return !truthy(value)
+	}
+	cmp := 0
+	a, errA := strconv.ParseFloat(value, 64)
+	b, errB := strconv.ParseFloat(c.value, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case a < b:
+			cmp = -1
+		case a > b:
+			cmp = 1
+		}
+	} else {
+		cmp = strings.Compare(value, strings.Trim(c.value, `"'`))
+	}
+	switch c.op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+func truthy(value string) bool {
+	value = strings.TrimSpace(value)
+	return value != "" && value != "0" && !strings.EqualFold(value, "false")
+}
+
+// ASCII transliterates s to ASCII by removing diacritics. Other non-ASCII characters are dropped.
+func ASCII(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(s) {
+		switch {
+		case r < unicode.MaxASCII:
+			b.WriteRune(r)
+		case r == 'ß':
+			b.WriteString("ss")
+		case r == 'Æ':
+			b.WriteString("AE")
+		case r == 'æ':
+			b.WriteString("ae")
+		case r == 'Ø':
+			b.WriteString("O")
+		case r == 'ø':
+			b.WriteString("o")
+		case r == 'Ł':
+			b.WriteString("L")
+		case r == 'ł':
+			b.WriteString("l")
+		}
+	}
+	return b.String()
+}
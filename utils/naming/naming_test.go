@@ -0,0 +1,67 @@
+package naming
+
+import "testing"
+
+func TestExpand(t *testing.T) {
+	vars := Vars{
+		"SongName":    "Héllo Wörld",
+		"TrackNumber": "7",
+		"TrackTotal":  "12",
+		"DiscNumber":  "1",
+		"DiscTotal":   "1",
+		"Explicit":    "false",
+		"Tag":         "Deluxe",
+		"Codec":       "ALAC",
+		"Empty":       "",
+	}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"{SongName}", "Héllo Wörld"},
+		{"{TrackNumber:3} {SongName}", "007 Héllo Wörld"},
+		{"{TrackNumber:auto}", "07"},
+		{"{DiscNumber:auto}", "1"},
+		{"{SongName|upper}", "HÉLLO WÖRLD"},
+		{"{SongName|ascii|lower}", "hello world"},
+		{"{Codec|title}", "ALAC"},
+		{"{Unknown} {SongName}", "{Unknown} Héllo Wörld"},
+		{"{{Tag}}", "{Deluxe}"},
+		{"{SongName|bogus}", "{SongName|bogus}"},
+		{"{}", "{}"},
+		{"unclosed {SongName", "unclosed {SongName"},
+		{"{if Explicit} [E]{end}", ""},
+		{"{if !Explicit}clean{end}", "clean"},
+		{"{if Empty}set{else}unset{end}", "unset"},
+		{"{if DiscTotal > 1}{DiscNumber}-{end}{TrackNumber:2}", "07"},
+		{"{if TrackTotal >= 12}long{else}short{end}", "long"},
+		{"{if TrackNumber < 10}{TrackNumber:2}{else}{TrackNumber}{end}", "07"},
+		{"{if Codec == ALAC}lossless{end}", "lossless"},
+		{"{if Codec != \"AAC\"}not aac{end}", "not aac"},
+		{"{if Codec}{if Tag}{Tag} {end}{Codec}{end}", "Deluxe ALAC"},
+		{"{if Codec ~ ALAC}x{end}", "{if Codec ~ ALAC}x{end}"},
+	}
+	for _, tt := range tests {
+		if got := Expand(tt.format, vars); got != tt.want {
+			t.Errorf("Expand(%q) = %q, want %q", tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestASCII(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Beyoncé", "Beyonce"},
+		{"Straße", "Strasse"},
+		{"Ærøskøbing", "AEroskobing"},
+		{"Łódź", "Lodz"},
+		{"ﬁne", "fine"},
+		{"日本", ""},
+	}
+	for _, tt := range tests {
+		if got := ASCII(tt.in); got != tt.want {
+			t.Errorf("ASCII(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package plan
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"text/tabwriter"
+)
+
+// Statuses of a planned item.
+const (
+	Download    = "download"
+	Exists      = "exists"
+	Archived    = "archived"
+	Unavailable = "unavailable"
+)
+
+// Item is one file a run would produce, or skip.
+type Item struct {
+	Kind       string `json:"kind"`
+	Collection string `json:"collection,omitempty"`
+	TrackID    string `json:"track_id"`
+	Name       string `json:"name"`
+	Artist     string `json:"artist,omitempty"`
+	Codec      string `json:"codec,omitempty"`
+	Quality    string `json:"quality,omitempty"`
+	Path       string `json:"path,omitempty"`
+	Status     string `json:"status"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// Plan collects the items of a dry run. It is safe for concurrent use.
+type Plan struct {
+	mu    sync.Mutex
+	items []Item
+}
+
+// Add appends item to the plan.
+func (p *Plan) Add(item Item) {
+	p.mu.Lock()
+	p.items = append(p.items, item)
+	p.mu.Unlock()
+}
+
+// Items returns the planned items in the order they were added.
+func (p *Plan) Items() []Item {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Item{}, p.items...)
+}
+
+// Count returns how many items have the given status.
+func (p *Plan) Count(status string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, item := range p.items {
+		if item.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// Print writes the plan as a table followed by a one line summary.
+func (p *Plan) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tCODEC\tQUALITY\tPATH")
+	for _, item := range p.Items() {
+		status := item.Status
+		if item.Reason != "" {
+			status += " (" + item.Reason + ")"
+		}
+		path := item.Path
+		if path == "" {
+			path = item.Name
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", status, item.Codec, item.Quality, path)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "Plan: %d to download, %d existing, %d archived, %d unavailable\n",
+		p.Count(Download), p.Count(Exists), p.Count(Archived), p.Count(Unavailable))
+}
+
+// WriteFile saves the plan as JSON.
+func (p *Plan) WriteFile(path string) error {
+	data, err := json.MarshalIndent(struct {
+		Items []Item `json:"items"`
+	}{p.Items()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
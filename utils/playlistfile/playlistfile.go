@@ -0,0 +1,66 @@
+package playlistfile
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Entry is one track of a playlist file.
+type Entry struct {
+	Path string
+	// Duration is written rounded to seconds; 0 writes -1, the M3U value for unknown.
+	Duration time.Duration
+	Artist   string
+	Title    string
+}
+
+// info returns the #EXTINF line of the entry.
+func (e Entry) info() string {
+	seconds := int64(-1)
+	if e.Duration > 0 {
+		seconds = int64(e.Duration.Round(time.Second) / time.Second)
+	}
+	title := e.Title
+	if e.Artist != "" && title != "" {
+		title = e.Artist + " - " + title
+	}
+	if title == "" {
+		title = strings.TrimSuffix(filepath.Base(e.Path), filepath.Ext(e.Path))
+	}
+	// a line break would end the directive early
+	title = strings.NewReplacer("\r", " ", "\n", " ").Replace(title)
+	return fmt.Sprintf("#EXTINF:%d,%s", seconds, title)
+}
+
+// Write saves an extended M3U playlist at path listing entries in order.
+// Paths are written relative to the playlist's folder, so the folder can be moved as a whole.
+func Write(path string, entries []Entry) error {
+	dir := filepath.Dir(path)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	w.WriteString("#EXTM3U\n")
+	for _, entry := range entries {
+		file := entry.Path
+		if rel, err := filepath.Rel(dir, file); err == nil {
+			file = rel
+		}
+		w.WriteString(entry.info() + "\n")
+		w.WriteString(filepath.ToSlash(file) + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
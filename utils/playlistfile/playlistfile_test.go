@@ -0,0 +1,52 @@
+package playlistfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInfo(t *testing.T) {
+	tests := []struct {
+		entry Entry
+		want  string
+	}{
+		{Entry{Path: "a.m4a", Duration: 201 * time.Second, Artist: "Artist", Title: "Song"}, "#EXTINF:201,Artist - Song"},
+		{Entry{Path: "a.m4a", Duration: 200600 * time.Millisecond, Title: "Song"}, "#EXTINF:201,Song"},
+		{Entry{Path: "a.m4a", Artist: "Artist", Title: "Song"}, "#EXTINF:-1,Artist - Song"},
+		{Entry{Path: "dir/01 Song.m4a", Duration: time.Second, Artist: "Artist"}, "#EXTINF:1,01 Song"},
+		{Entry{Path: "a.m4a", Title: "Two\r\nLines"}, "#EXTINF:-1,Two  Lines"},
+	}
+	for _, tt := range tests {
+		if got := tt.entry.info(); got != tt.want {
+			t.Errorf("info(%+v) = %q, want %q", tt.entry, got, tt.want)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "Playlists", "Mix.m3u8")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	entries := []Entry{
+		{Path: filepath.Join(dir, "Playlists", "01 A.m4a"), Duration: 60 * time.Second, Title: "A"},
+		{Path: filepath.Join(dir, "Artist", "Album", "02 B.m4a"), Title: "B"},
+	}
+	if err := Write(path, entries); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "#EXTM3U\n#EXTINF:60,A\n01 A.m4a\n#EXTINF:-1,B\n../Artist/Album/02 B.m4a\n"
+	if string(data) != want {
+		t.Errorf("playlist = %q, want %q", data, want)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Write left its temporary file behind: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package progress
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Func reports the progress of one phase of a task.
+type Func func(phase string, done, total int64)
+
+// Lines renders progress of concurrently running tasks as whole lines prefixed with the task label,
+// so updates from different tasks never interleave mid-line.
+type Lines struct {
+	mu   sync.Mutex
+	w    io.Writer
+	step int
+}
+
+// NewLines returns a Lines writing to w and printing an update every 25 percent.
+func NewLines(w io.Writer) *Lines {
+	return &Lines{w: w, step: 25}
+}
+
+// Task returns the progress callback for one task.
+func (l *Lines) Task(label string) Func {
+	lastPhase := ""
+	lastBucket := -1
+	var mu sync.Mutex
+	return func(phase string, done, total int64) {
+		percent := 0
+		if total > 0 {
+			percent = int(done * 100 / total)
+			if percent > 100 {
+				percent = 100
+			}
+		}
+		bucket := percent / l.step
+		mu.Lock()
+		if phase == lastPhase && bucket == lastBucket {
+			mu.Unlock()
+			return
+		}
+		lastPhase = phase
+		lastBucket = bucket
+		mu.Unlock()
+
+		var line string
+		if total > 0 {
+			line = fmt.Sprintf("[%s] %s %d%% (%s / %s)\n", label, phase, percent, formatBytes(done), formatBytes(total))
+		} else {
+			line = fmt.Sprintf("[%s] %s %s\n", label, phase, formatBytes(done))
+		}
+		l.mu.Lock()
+		io.WriteString(l.w, line)
+		l.mu.Unlock()
+	}
+}
+
+func formatBytes(value int64) string {
+	const unit = 1024
+	if value < unit {
+		return fmt.Sprintf("%d B", value)
+	}
+	div, exp := int64(unit), 0
+	for n := value / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(value)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,114 @@
+package quality
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Codecs an option can name. The AAC types match aac-type.
+const (
+	ALAC        = "alac"
+	Atmos       = "atmos"
+	AAC         = "aac"
+	AACBinaural = "aac-binaural"
+	AACDownmix  = "aac-downmix"
+	AACLC       = "aac-lc"
+)
+
+// Option is one entry of the quality-preference chain, such as "alac<=48000".
+type Option struct {
+	Codec string
+	// Max caps the sample rate of alac or the bitrate of atmos. 0 keeps alac-max or atmos-max.
+	Max int
+}
+
+func (o Option) String() string {
+	if o.Max > 0 {
+		return fmt.Sprintf("%s<=%d", o.Codec, o.Max)
+	}
+	return o.Codec
+}
+
+// IsAAC reports whether the option selects one of the AAC types.
+func (o Option) IsAAC() bool {
+	return strings.HasPrefix(o.Codec, AAC)
+}
+
+// Parse parses the quality-preference entries, each an option like "alac<=192000", "atmos" or "aac-lc".
+// An entry may also hold several options separated by commas. Options an earlier one already covers, such as
+// "alac<=48000" after "alac<=192000", are accepted but left out of the chain since they can never be chosen.
+func Parse(entries []string) ([]Option, error) {
+	var chain []Option
+	for _, entry := range entries {
+		for _, field := range strings.Split(entry, ",") {
+			field = strings.ToLower(strings.TrimSpace(field))
+			if field == "" {
+				continue
+			}
+			option, err := parseOption(field)
+			if err != nil {
+				return nil, err
+			}
+			if !covered(chain, option) {
+				chain = append(chain, option)
+			}
+		}
+	}
+	return chain, nil
+}
+
+func parseOption(field string) (Option, error) {
+	codec, limit, capped := strings.Cut(field, "<=")
+	option := Option{Codec: strings.TrimSpace(codec)}
+	switch option.Codec {
+	case ALAC, Atmos:
+		if capped {
+			max, err := strconv.Atoi(strings.TrimSpace(limit))
+			if err != nil || max <= 0 {
+				return Option{}, fmt.Errorf("invalid limit in quality option %q", field)
+			}
+			option.Max = max
+		}
+	case AAC, AACBinaural, AACDownmix, AACLC:
+		if capped {
+			return Option{}, fmt.Errorf("quality option %q does not take a limit", field)
+		}
+	default:
+		return Option{}, fmt.Errorf("unknown codec in quality option %q (use alac, atmos, aac, aac-binaural, aac-downmix or aac-lc)", field)
+	}
+	return option, nil
+}
+
+func covered(chain []Option, option Option) bool {
+	for _, earlier := range chain {
+		if earlier.covers(option) {
+			return true
+		}
+	}
+	return false
+}
+
+// covers reports whether later is available whenever o is, so later can never be chosen after o.
+// A track that has no variant up to a limit has none up to a lower limit either.
+func (o Option) covers(later Option) bool {
+	if o.Codec != later.Codec {
+		return false
+	}
+	if o.Max == 0 || later.Max == 0 {
+		// the limit of the config applies, which may be higher or lower
+		return o.Max == later.Max
+	}
+	return later.Max <= o.Max
+}
+
+// From returns the part of chain starting at the first option for codec, the codec a run was asked for.
+// It returns nil when chain does not list codec, so the run keeps its single codec.
+func From(chain []Option, codec string) []Option {
+	for i, option := range chain {
+		if option.Codec == codec {
+			return chain[i:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package quality
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		entries []string
+		want    []Option
+		err     string
+	}{
+		{
+			entries: []string{"alac<=192000", "atmos", "aac-binaural", "aac-lc"},
+			want:    []Option{{ALAC, 192000}, {Atmos, 0}, {AACBinaural, 0}, {AACLC, 0}},
+		},
+		{
+			entries: []string{" ALAC <= 48000 , alac<=96000", "", "aac"},
+			want:    []Option{{ALAC, 48000}, {ALAC, 96000}, {AAC, 0}},
+		},
+		{
+			entries: []string{"alac", "alac<=48000"},
+			want:    []Option{{ALAC, 0}, {ALAC, 48000}},
+		},
+		{
+			entries: []string{"alac<=48000", "alac"},
+			want:    []Option{{ALAC, 48000}, {ALAC, 0}},
+		},
+		{entries: nil, want: nil},
+		// options an earlier one covers are accepted and left out
+		{
+			entries: []string{"alac<=192000, alac<=48000, atmos, aac-binaural, aac-lc"},
+			want:    []Option{{ALAC, 192000}, {Atmos, 0}, {AACBinaural, 0}, {AACLC, 0}},
+		},
+		{entries: []string{"alac<=48000", "alac<=48000"}, want: []Option{{ALAC, 48000}}},
+		{entries: []string{"atmos", "aac-lc", "atmos"}, want: []Option{{Atmos, 0}, {AACLC, 0}}},
+		{entries: []string{"aac-lc", "aac-lc"}, want: []Option{{AACLC, 0}}},
+		{entries: []string{"aac<=256"}, err: "does not take a limit"},
+		{entries: []string{"alac<=fast"}, err: "invalid limit"},
+		{entries: []string{"atmos<=0"}, err: "invalid limit"},
+		{entries: []string{"flac"}, err: "unknown codec"},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.entries)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Parse(%q) error = %v, want %q", tt.entries, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q) error = %v", tt.entries, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parse(%q) = %v, want %v", tt.entries, got, tt.want)
+		}
+	}
+}
+
+func TestFrom(t *testing.T) {
+	chain := []Option{{ALAC, 192000}, {Atmos, 0}, {AACBinaural, 0}, {AACLC, 0}}
+	tests := []struct {
+		codec string
+		want  []Option
+	}{
+		{ALAC, chain},
+		{Atmos, chain[1:]},
+		{AACLC, chain[3:]},
+		{AAC, nil},
+	}
+	for _, tt := range tests {
+		if got := From(chain, tt.codec); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("From(%q) = %v, want %v", tt.codec, got, tt.want)
+		}
+	}
+}
+
+func TestOption(t *testing.T) {
+	tests := []struct {
+		option Option
+		str    string
+		aac    bool
+	}{
+		{Option{ALAC, 48000}, "alac<=48000", false},
+		{Option{Atmos, 0}, "atmos", false},
+		{Option{AAC, 0}, "aac", true},
+		{Option{AACDownmix, 0}, "aac-downmix", true},
+	}
+	for _, tt := range tests {
+		if got := tt.option.String(); got != tt.str {
+			t.Errorf("String() = %q, want %q", got, tt.str)
+		}
+		if got := tt.option.IsAAC(); got != tt.aac {
+			t.Errorf("%s IsAAC() = %v, want %v", tt.str, got, tt.aac)
+		}
+	}
+}
@@ -0,0 +1,461 @@
+// Package remux turns the fragmented MP4 files the downloaders write into regular, progressive MP4 files
+// with iTunes metadata, and muxes the separate video and audio of music videos into one file.
+package remux
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/itouakirai/mp4ff/mp4"
+)
+
+// maxStcoOffset is the largest chunk offset an stco box can hold. Tests lower it to exercise co64.
+var maxStcoOffset uint64 = math.MaxUint32
+
+// File rewrites the fragmented MP4 at path in place as a progressive MP4 tagged with tags.
+func File(path string, tags Tags) error {
+	return Mux(path, []string{path}, tags)
+}
+
+// Mux writes every track of the fragmented MP4 files inputs into one progressive MP4 at out, tagged with tags.
+// out may be one of the inputs; it is only replaced once the new file is complete.
+func Mux(out string, inputs []string, tags Tags) error {
+	if len(inputs) == 0 {
+		return errors.New("nothing to mux")
+	}
+	ilst, err := tags.ilst()
+	if err != nil {
+		return err
+	}
+	var mvhd *mp4.MvhdBox
+	var tracks []*track
+	var files []*os.File
+	// the inputs must be closed before out replaces one of them on Windows
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+		files = nil
+	}
+	defer closeAll()
+	for _, input := range inputs {
+		f, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		header, found, err := readTracks(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(input), err)
+		}
+		if mvhd == nil {
+			mvhd = header
+		}
+		tracks = append(tracks, found...)
+	}
+
+	video := false
+	for i, t := range tracks {
+		t.trak.Tkhd.TrackID = uint32(i + 1)
+		if t.trak.Mdia.Hdlr != nil && t.trak.Mdia.Hdlr.HandlerType == "vide" {
+			video = true
+		}
+	}
+	ftyp := mp4.NewFtyp("M4A ", 0, []string{"M4A ", "mp42", "isom"})
+	if video {
+		ftyp = mp4.NewFtyp("mp42", 0, []string{"mp42", "isom"})
+	}
+
+	chunks := interleave(tracks)
+	var mdatSize uint64
+	for _, c := range chunks {
+		c.out = mdatSize
+		mdatSize += c.size
+	}
+	mdatHeader := uint64(8)
+	if mdatSize+8 > math.MaxUint32 {
+		mdatHeader = 16
+	}
+	// moov does not change size when the chunk offsets are filled in, so it can be laid out first. Offsets
+	// are counted from the start of the file, so co64 is needed as soon as the end of mdat is past 4 GiB.
+	moov, err := buildMoov(mvhd, tracks, ilst, false)
+	if err != nil {
+		return err
+	}
+	dataStart := ftyp.Size() + moov.Size() + mdatHeader
+	if dataStart+mdatSize > maxStcoOffset {
+		if moov, err = buildMoov(mvhd, tracks, ilst, true); err != nil {
+			return err
+		}
+		dataStart = ftyp.Size() + moov.Size() + mdatHeader
+	}
+	for _, t := range tracks {
+		t.setOffsets(dataStart)
+	}
+
+	tmp := out + ".remux"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	w := bufio.NewWriterSize(dst, 1<<20)
+	if err := ftyp.Encode(w); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := moov.Encode(w); err != nil {
+		dst.Close()
+		return fmt.Errorf("failed to write moov: %w", err)
+	}
+	if err := writeMdatHeader(w, mdatHeader, mdatSize); err != nil {
+		dst.Close()
+		return err
+	}
+	for _, c := range chunks {
+		if _, err := io.Copy(w, io.NewSectionReader(c.src, c.offset, int64(c.size))); err != nil {
+			dst.Close()
+			return fmt.Errorf("failed to copy samples: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	closeAll()
+	return os.Rename(tmp, out)
+}
+
+// track is one track of an input and the samples of all its fragments.
+type track struct {
+	trak      *mp4.TrakBox
+	timescale uint32
+	samples   []mp4.Sample
+	chunks    []*chunk
+	duration  uint64
+}
+
+// chunk is the data of one trun, which stays contiguous in the output.
+type chunk struct {
+	src     *os.File
+	offset  int64
+	size    uint64
+	samples uint32
+	sdi     uint32
+	time    float64 // start in seconds, to interleave tracks
+	out     uint64  // offset in mdat
+}
+
+// readTracks collects the tracks of a fragmented MP4 and where the data of each trun lies in the file.
+func readTracks(f *os.File) (*mp4.MvhdBox, []*track, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	parsed, err := mp4.DecodeFile(f, mp4.WithDecodeMode(mp4.DecModeLazyMdat))
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot parse MP4: %w", err)
+	}
+	if !parsed.IsFragmented() || parsed.Init == nil {
+		return nil, nil, errors.New("not a fragmented MP4")
+	}
+	moov := parsed.Init.Moov
+	if moov.Mvhd == nil || len(moov.Traks) == 0 {
+		return nil, nil, errors.New("init segment has no tracks")
+	}
+	byID := make(map[uint32]*track)
+	var tracks []*track
+	for _, trak := range moov.Traks {
+		if trak.Tkhd == nil || trak.Mdia == nil || trak.Mdia.Mdhd == nil || trak.Mdia.Minf == nil || trak.Mdia.Minf.Stbl == nil {
+			return nil, nil, errors.New("track without sample table")
+		}
+		t := &track{trak: trak, timescale: trak.Mdia.Mdhd.Timescale}
+		byID[trak.Tkhd.TrackID] = t
+		tracks = append(tracks, t)
+	}
+	for _, segment := range parsed.Segments {
+		for _, frag := range segment.Fragments {
+			if frag.Moof == nil {
+				continue
+			}
+			for _, traf := range frag.Moof.Trafs {
+				if err := addTraf(f, info.Size(), moov, frag.Moof, traf, byID); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+	for _, t := range tracks {
+		if len(t.samples) == 0 {
+			return nil, nil, fmt.Errorf("track %d has no samples", t.trak.Tkhd.TrackID)
+		}
+	}
+	return moov.Mvhd, tracks, nil
+}
+
+func addTraf(f *os.File, fileSize int64, moov *mp4.MoovBox, moof *mp4.MoofBox, traf *mp4.TrafBox, byID map[uint32]*track) error {
+	if traf.Tfhd == nil {
+		return errors.New("traf without tfhd")
+	}
+	t, ok := byID[traf.Tfhd.TrackID]
+	if !ok {
+		return fmt.Errorf("fragment for unknown track %d", traf.Tfhd.TrackID)
+	}
+	if traf.Senc != nil || traf.UUIDSenc != nil {
+		return fmt.Errorf("track %d is still encrypted", traf.Tfhd.TrackID)
+	}
+	var trex *mp4.TrexBox
+	if moov.Mvex != nil {
+		trex, _ = moov.Mvex.GetTrex(traf.Tfhd.TrackID)
+	}
+	sdi := uint32(1)
+	if traf.Tfhd.HasSampleDescriptionIndex() {
+		sdi = traf.Tfhd.SampleDescriptionIndex
+	} else if trex != nil && trex.DefaultSampleDescriptionIndex != 0 {
+		sdi = trex.DefaultSampleDescriptionIndex
+	}
+	base := moof.StartPos
+	if traf.Tfhd.HasBaseDataOffset() {
+		base = traf.Tfhd.BaseDataOffset
+	}
+	decodeTime := t.duration
+	if traf.Tfdt != nil {
+		decodeTime = traf.Tfdt.BaseMediaDecodeTime()
+	}
+	next := base
+	for _, trun := range traf.Truns {
+		dur := trun.AddSampleDefaultValues(traf.Tfhd, trex)
+		offset := next
+		if trun.HasDataOffset() {
+			offset = uint64(int64(base) + int64(trun.DataOffset))
+		}
+		size := trun.SizeOfData()
+		if offset+size > uint64(fileSize) {
+			return fmt.Errorf("track %d: sample data at %d-%d lies past the end of the file (%d bytes)", t.trak.Tkhd.TrackID, offset, offset+size, fileSize)
+		}
+		c := &chunk{
+			src:     f,
+			offset:  int64(offset),
+			size:    size,
+			samples: trun.SampleCount(),
+			sdi:     sdi,
+			time:    float64(decodeTime) / float64(t.timescale),
+		}
+		if c.samples > 0 {
+			t.chunks = append(t.chunks, c)
+			t.samples = append(t.samples, trun.Samples...)
+		}
+		decodeTime += dur
+		t.duration = decodeTime
+		next = offset + size
+	}
+	return nil
+}
+
+// interleave orders the chunks of all tracks by time, keeping the order within each track.
+func interleave(tracks []*track) []*chunk {
+	next := make([]int, len(tracks))
+	var chunks []*chunk
+	for {
+		pick := -1
+		for i, t := range tracks {
+			if next[i] == len(t.chunks) {
+				continue
+			}
+			if pick < 0 || t.chunks[next[i]].time < tracks[pick].chunks[next[pick]].time {
+				pick = i
+			}
+		}
+		if pick < 0 {
+			return chunks
+		}
+		chunks = append(chunks, tracks[pick].chunks[next[pick]])
+		next[pick]++
+	}
+}
+
+// buildMoov returns the moov of the output: the tracks of the inputs with full sample tables and
+// no fragment or DRM boxes, and a udta holding ilst.
+func buildMoov(mvhd *mp4.MvhdBox, tracks []*track, ilst []byte, wide bool) (*mp4.MoovBox, error) {
+	moov := mp4.NewMoovBox()
+	moov.AddChild(mvhd)
+	mvhd.NextTrackID = uint32(len(tracks) + 1)
+	mvhd.Duration = 0
+	for _, t := range tracks {
+		stbl, err := t.sampleTable(wide)
+		if err != nil {
+			return nil, err
+		}
+		minf := t.trak.Mdia.Minf
+		replaceChild(minf.Children, minf.Stbl, stbl)
+		minf.Stbl = stbl
+
+		t.trak.Mdia.Mdhd.Duration = t.duration
+		if t.duration > math.MaxUint32 {
+			t.trak.Mdia.Mdhd.Version = 1
+		}
+		movieDuration := t.duration * uint64(mvhd.Timescale) / uint64(t.timescale)
+		t.trak.Tkhd.Duration = movieDuration
+		if movieDuration > math.MaxUint32 {
+			t.trak.Tkhd.Version = 1
+		}
+		if movieDuration > mvhd.Duration {
+			mvhd.Duration = movieDuration
+		}
+		if t.trak.Edts != nil {
+			for _, elst := range t.trak.Edts.Elst {
+				for i := range elst.Entries {
+					// an empty edit means "until the end" in fragmented files only
+					if elst.Entries[i].SegmentDuration == 0 && elst.Entries[i].MediaTime >= 0 {
+						elapsed := uint64(elst.Entries[i].MediaTime) * uint64(mvhd.Timescale) / uint64(t.timescale)
+						if elapsed < movieDuration {
+							elst.Entries[i].SegmentDuration = movieDuration - elapsed
+						}
+					}
+				}
+			}
+		}
+		moov.AddChild(t.trak)
+	}
+	if mvhd.Duration > math.MaxUint32 {
+		mvhd.Version = 1
+	}
+	moov.AddChild(udta(ilst))
+	return moov, nil
+}
+
+// sampleTable builds the stbl of a track. Chunk offsets are placeholders until setOffsets.
+func (t *track) sampleTable(wide bool) (*mp4.StblBox, error) {
+	old := t.trak.Mdia.Minf.Stbl
+	if old.Stsd == nil {
+		return nil, fmt.Errorf("track %d has no sample description", t.trak.Tkhd.TrackID)
+	}
+	stbl := mp4.NewStblBox()
+	stbl.AddChild(old.Stsd)
+
+	stts := &mp4.SttsBox{}
+	for i, s := range t.samples {
+		if i > 0 && s.Dur == stts.SampleTimeDelta[len(stts.SampleTimeDelta)-1] {
+			stts.SampleCount[len(stts.SampleCount)-1]++
+			continue
+		}
+		stts.SampleCount = append(stts.SampleCount, 1)
+		stts.SampleTimeDelta = append(stts.SampleTimeDelta, s.Dur)
+	}
+	stbl.AddChild(stts)
+
+	var counts []uint32
+	var offsets []int32
+	shifted, negative := false, false
+	for i, s := range t.samples {
+		if s.CompositionTimeOffset != 0 {
+			shifted = true
+		}
+		if s.CompositionTimeOffset < 0 {
+			negative = true
+		}
+		if i > 0 && s.CompositionTimeOffset == offsets[len(offsets)-1] {
+			counts[len(counts)-1]++
+			continue
+		}
+		counts = append(counts, 1)
+		offsets = append(offsets, s.CompositionTimeOffset)
+	}
+	if shifted {
+		ctts := &mp4.CttsBox{}
+		if negative {
+			ctts.Version = 1
+		}
+		if err := ctts.AddSampleCountsAndOffset(counts, offsets); err != nil {
+			return nil, err
+		}
+		stbl.AddChild(ctts)
+	}
+
+	stsc := &mp4.StscBox{}
+	for i, c := range t.chunks {
+		if i > 0 && c.samples == t.chunks[i-1].samples && c.sdi == t.chunks[i-1].sdi {
+			continue
+		}
+		if err := stsc.AddEntry(uint32(i+1), c.samples, c.sdi); err != nil {
+			return nil, err
+		}
+	}
+	stbl.AddChild(stsc)
+
+	stsz := &mp4.StszBox{SampleNumber: uint32(len(t.samples))}
+	uniform := true
+	for _, s := range t.samples {
+		if s.Size != t.samples[0].Size {
+			uniform = false
+			break
+		}
+	}
+	if uniform {
+		stsz.SampleUniformSize = t.samples[0].Size
+	} else {
+		for _, s := range t.samples {
+			stsz.SampleSize = append(stsz.SampleSize, s.Size)
+		}
+	}
+	stbl.AddChild(stsz)
+
+	if t.trak.Mdia.Hdlr != nil && t.trak.Mdia.Hdlr.HandlerType == "vide" {
+		stss := &mp4.StssBox{}
+		for i := range t.samples {
+			if t.samples[i].IsSync() {
+				stss.SampleNumber = append(stss.SampleNumber, uint32(i+1))
+			}
+		}
+		if len(stss.SampleNumber) < len(t.samples) {
+			stbl.AddChild(stss)
+		}
+	}
+
+	if wide {
+		stbl.AddChild(&mp4.Co64Box{ChunkOffset: make([]uint64, len(t.chunks))})
+	} else {
+		stbl.AddChild(&mp4.StcoBox{ChunkOffset: make([]uint32, len(t.chunks))})
+	}
+	return stbl, nil
+}
+
+// setOffsets fills in the chunk offsets once the position of mdat is known.
+func (t *track) setOffsets(dataStart uint64) {
+	stbl := t.trak.Mdia.Minf.Stbl
+	for i, c := range t.chunks {
+		if stbl.Co64 != nil {
+			stbl.Co64.ChunkOffset[i] = dataStart + c.out
+		} else {
+			stbl.Stco.ChunkOffset[i] = uint32(dataStart + c.out)
+		}
+	}
+}
+
+func replaceChild(children []mp4.Box, old mp4.Box, box mp4.Box) {
+	for i, child := range children {
+		if child == old {
+			children[i] = box
+		}
+	}
+}
+
+func writeMdatHeader(w io.Writer, headerSize uint64, payload uint64) error {
+	var header []byte
+	if headerSize == 16 {
+		header = append(be32(1), "mdat"...)
+		header = append(header, be64(payload+16)...)
+	} else {
+		header = append(be32(uint32(payload+8)), "mdat"...)
+	}
+	_, err := w.Write(header)
+	return err
+}
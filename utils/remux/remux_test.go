@@ -0,0 +1,174 @@
+package remux
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/itouakirai/mp4ff/aac"
+	"github.com/itouakirai/mp4ff/mp4"
+)
+
+// writeFragmented writes a fragmented AAC file with one fragment per entry of fragments, each holding
+// the given samples, and returns the payload of every fragment.
+func writeFragmented(t *testing.T, path string, fragments [][]int) [][]byte {
+	t.Helper()
+	init := mp4.CreateEmptyInit()
+	init.AddEmptyTrack(48000, "audio", "und")
+	if err := init.Moov.Trak.SetAACDescriptor(aac.AAClc, 48000); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := init.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var payloads [][]byte
+	decodeTime := uint64(0)
+	fill := byte(1)
+	for i, sizes := range fragments {
+		frag, err := mp4.CreateFragment(uint32(i+1), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var payload []byte
+		for _, size := range sizes {
+			data := bytes.Repeat([]byte{fill}, size)
+			fill++
+			frag.AddFullSample(mp4.FullSample{
+				Sample:     mp4.NewSample(mp4.SyncSampleFlags, 1024, uint32(size), 0),
+				DecodeTime: decodeTime,
+				Data:       data,
+			})
+			decodeTime += 1024
+			payload = append(payload, data...)
+		}
+		if err := frag.Encode(&buf); err != nil {
+			t.Fatal(err)
+		}
+		payloads = append(payloads, payload)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return payloads
+}
+
+func TestFileOffsets(t *testing.T) {
+	fragments := [][]int{{100, 120, 90}, {300}, {64, 64, 64, 64}}
+	var mdatSize uint64
+	for _, sizes := range fragments {
+		for _, size := range sizes {
+			mdatSize += uint64(size)
+		}
+	}
+	tests := []struct {
+		name  string
+		limit uint64
+		co64  bool
+	}{
+		{"stco", math.MaxUint32, false},
+		// mdat alone fits in 32 bits, but not once it is placed after ftyp and moov
+		{"offsets past the limit", mdatSize + 8, true},
+		{"mdat past the limit", mdatSize - 1, true},
+	}
+	defer func(limit uint64) { maxStcoOffset = limit }(maxStcoOffset)
+	for _, tt := range tests {
+		maxStcoOffset = tt.limit
+		path := filepath.Join(t.TempDir(), "track.m4a")
+		payloads := writeFragmented(t, path, fragments)
+		if err := File(path, Tags{Title: "Song", Track: 1, TrackTotal: 2}); err != nil {
+			t.Fatalf("%s: File error = %v", tt.name, err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := mp4.DecodeFile(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: cannot parse output: %v", tt.name, err)
+		}
+		if parsed.IsFragmented() || parsed.Moov == nil {
+			t.Fatalf("%s: output is still fragmented", tt.name)
+		}
+		stbl := parsed.Moov.Trak.Mdia.Minf.Stbl
+		var offsets []uint64
+		switch {
+		case tt.co64 && stbl.Co64 != nil:
+			offsets = stbl.Co64.ChunkOffset
+		case !tt.co64 && stbl.Stco != nil:
+			for _, offset := range stbl.Stco.ChunkOffset {
+				offsets = append(offsets, uint64(offset))
+			}
+		default:
+			t.Fatalf("%s: stco %v, co64 %v, want co64 %v", tt.name, stbl.Stco != nil, stbl.Co64 != nil, tt.co64)
+		}
+		if len(offsets) != len(payloads) {
+			t.Fatalf("%s: %d chunks, want %d", tt.name, len(offsets), len(payloads))
+		}
+		for i, payload := range payloads {
+			end := offsets[i] + uint64(len(payload))
+			if end > uint64(len(data)) || !bytes.Equal(data[offsets[i]:end], payload) {
+				t.Errorf("%s: chunk %d at offset %d does not hold its samples", tt.name, i, offsets[i])
+			}
+		}
+		if got := stbl.Stsz.SampleNumber; got != 8 {
+			t.Errorf("%s: %d samples, want 8", tt.name, got)
+		}
+		if got := parsed.Moov.Trak.Mdia.Mdhd.Duration; got != 8*1024 {
+			t.Errorf("%s: duration %d, want %d", tt.name, got, 8*1024)
+		}
+		if !bytes.Contains(data, []byte("\xa9nam")) || !bytes.Contains(data, []byte("Song")) {
+			t.Errorf("%s: output has no title tag", tt.name)
+		}
+	}
+}
+
+func TestMuxErrors(t *testing.T) {
+	dir := t.TempDir()
+	progressive := filepath.Join(dir, "progressive.m4a")
+	writeFragmented(t, progressive, [][]int{{10}})
+	if err := File(progressive, Tags{}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		inputs []string
+		want   string
+	}{
+		{"no inputs", nil, "nothing to mux"},
+		{"progressive input", []string{progressive}, "not a fragmented MP4"},
+		{"missing input", []string{filepath.Join(dir, "missing.m4a")}, "no such file"},
+	}
+	for _, tt := range tests {
+		err := Mux(filepath.Join(dir, "out.m4a"), tt.inputs, Tags{})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Mux error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.m4a")); !os.IsNotExist(err) {
+		t.Errorf("a failed Mux left its output behind: %v", err)
+	}
+}
+
+func TestMdatHeader(t *testing.T) {
+	tests := []struct {
+		header  uint64
+		payload uint64
+		want    []byte
+	}{
+		{8, 100, []byte{0, 0, 0, 108, 'm', 'd', 'a', 't'}},
+		{16, 100, []byte{0, 0, 0, 1, 'm', 'd', 'a', 't', 0, 0, 0, 0, 0, 0, 0, 116}},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := writeMdatHeader(&buf, tt.header, tt.payload); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), tt.want) {
+			t.Errorf("writeMdatHeader(%d, %d) = %x, want %x", tt.header, tt.payload, buf.Bytes(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package remux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/itouakirai/mp4ff/mp4"
+)
+
+// Content ratings of the rtng atom.
+const (
+	RatingNone     = 0
+	RatingExplicit = 1
+	RatingClean    = 2
+)
+
+// Tags are the iTunes metadata written into the ilst of the output. Empty fields are left out.
+type Tags struct {
+	Title       string
+	Artist      string
+	Album       string
+	AlbumArtist string
+	Genre       string
+	Date        string
+	Copyright   string
+	Track       int
+	TrackTotal  int
+	Disc        int
+	DiscTotal   int
+	Rating      int
+	// Cover is the path of a JPEG or PNG image.
+	Cover string
+	// Custom holds free-form com.apple.iTunes atoms such as ISRC.
+	Custom map[string]string
+}
+
+// Data types of ilst values.
+const (
+	typeBinary = 0
+	typeUTF8   = 1
+	typeJPEG   = 13
+	typePNG    = 14
+	typeInt    = 21
+)
+
+// ilst returns the payload of the ilst box.
+func (t Tags) ilst() ([]byte, error) {
+	var buf bytes.Buffer
+	for _, text := range []struct {
+		name  string
+		value string
+	}{
+		{"\xa9nam", t.Title},
+		{"\xa9ART", t.Artist},
+		{"\xa9alb", t.Album},
+		{"aART", t.AlbumArtist},
+		{"\xa9gen", t.Genre},
+		{"\xa9day", t.Date},
+		{"cprt", t.Copyright},
+	} {
+		if text.value != "" {
+			buf.Write(box(text.name, data(typeUTF8, []byte(text.value))))
+		}
+	}
+	if t.Track > 0 || t.TrackTotal > 0 {
+		payload := make([]byte, 8)
+		binary.BigEndian.PutUint16(payload[2:], uint16(t.Track))
+		binary.BigEndian.PutUint16(payload[4:], uint16(t.TrackTotal))
+		buf.Write(box("trkn", data(typeBinary, payload)))
+	}
+	if t.Disc > 0 || t.DiscTotal > 0 {
+		payload := make([]byte, 6)
+		binary.BigEndian.PutUint16(payload[2:], uint16(t.Disc))
+		binary.BigEndian.PutUint16(payload[4:], uint16(t.DiscTotal))
+		buf.Write(box("disk", data(typeBinary, payload)))
+	}
+	if t.Rating != RatingNone {
+		buf.Write(box("rtng", data(typeInt, []byte{byte(t.Rating)})))
+	}
+	if t.Cover != "" {
+		image, err := os.ReadFile(t.Cover)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cover: %w", err)
+		}
+		kind := typeJPEG
+		if bytes.HasPrefix(image, []byte("\x89PNG")) {
+			kind = typePNG
+		}
+		buf.Write(box("covr", data(kind, image)))
+	}
+	names := make([]string, 0, len(t.Custom))
+	for name := range t.Custom {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := t.Custom[name]
+		if value == "" {
+			continue
+		}
+		var atom []byte
+		atom = append(atom, box("mean", append(make([]byte, 4), "com.apple.iTunes"...))...)
+		atom = append(atom, box("name", append(make([]byte, 4), name...))...)
+		atom = append(atom, data(typeUTF8, []byte(value))...)
+		buf.Write(box("----", atom))
+	}
+	return buf.Bytes(), nil
+}
+
+// udta returns moov.udta.meta.ilst as MP4Box writes it, so go-mp4tag can update the tags later.
+func udta(ilst []byte) mp4.Box {
+	hdlr := append(make([]byte, 8), "mdirappl"...)
+	hdlr = append(hdlr, make([]byte, 9)...)
+	meta := append(make([]byte, 4), box("hdlr", hdlr)...)
+	meta = append(meta, box("ilst", ilst)...)
+	payload := box("meta", meta)
+	return mp4.CreateUnknownBox("udta", uint64(8+len(payload)), payload)
+}
+
+// data returns a data atom holding value.
+func data(kind int, value []byte) []byte {
+	payload := append(be32(uint32(kind)), 0, 0, 0, 0)
+	return box("data", append(payload, value...))
+}
+
+func box(name string, payload []byte) []byte {
+	return append(append(be32(uint32(8+len(payload))), name...), payload...)
+}
+
+func be32(n uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, n)
+}
+
+func be64(n uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, n)
+}
@@ -0,0 +1,157 @@
+package runv2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/grafov/m3u8"
+	"github.com/itouakirai/mp4ff/mp4"
+)
+
+// checkpointInterval is how many bytes of fragments are written between two checkpoints. An interrupted
+// download redoes at most this much, while short tracks are not slowed down by a write per fragment.
+const checkpointInterval = 4 << 20
+
+// checkpoint records how far a download got, saved next to the part file every checkpointInterval bytes.
+type checkpoint struct {
+	AdamID      string `json:"adam_id"`
+	TotalLen    int64  `json:"total_len"`
+	InitSize    uint64 `json:"init_size"`
+	Fragment    int    `json:"fragment"`
+	InputOffset uint64 `json:"input_offset"`
+	OutputSize  int64  `json:"output_size"`
+}
+
+func partPath(outfile string) string {
+	return outfile + ".part"
+}
+
+func checkpointPath(outfile string) string {
+	return outfile + ".part.json"
+}
+
+// loadCheckpoint returns the checkpoint for outfile if it belongs to adamId and its part file is usable.
+func loadCheckpoint(path string, adamId string, segmentCount int) *checkpoint {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var ckpt checkpoint
+	if err := json.Unmarshal(data, &ckpt); err != nil {
+		return nil
+	}
+	if ckpt.AdamID != adamId || ckpt.Fragment <= 0 || ckpt.Fragment >= segmentCount || ckpt.InitSize == 0 {
+		return nil
+	}
+	info, err := os.Stat(strings.TrimSuffix(path, ".json"))
+	if err != nil || info.Size() < ckpt.OutputSize {
+		return nil
+	}
+	return &ckpt
+}
+
+func saveCheckpoint(path string, ckpt checkpoint) error {
+	data, err := json.Marshal(ckpt)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// openRange requests fileUrl starting at from. end < 0 requests everything up to the end of the file.
+// A ranged request must be answered with 206, otherwise the server does not support resuming.
+func openRange(ctx context.Context, client *http.Client, fileUrl string, header http.Header, from int64, end int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fileUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header.Clone()
+	ranged := from > 0 || end >= 0
+	if ranged {
+		if end >= 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", from, end))
+		} else {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", from))
+		}
+	}
+	do, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if ranged && do.StatusCode != http.StatusPartialContent {
+		do.Body.Close()
+		return nil, fmt.Errorf("range request not honored: %s", do.Status)
+	}
+	if !ranged && do.StatusCode != http.StatusOK {
+		do.Body.Close()
+		return nil, errors.New(do.Status)
+	}
+	return do, nil
+}
+
+// openResume fetches the init segment again and opens the file at the checkpoint's input offset.
+func openResume(ctx context.Context, client *http.Client, fileUrl string, header http.Header, ckpt *checkpoint) (*mp4.InitSegment, *http.Response, error) {
+	initResp, err := openRange(ctx, client, fileUrl, header, 0, int64(ckpt.InitSize)-1)
+	if err != nil {
+		return nil, nil, err
+	}
+	init, _, err := ReadInitSegment(initResp.Body)
+	initResp.Body.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	do, err := openRange(ctx, client, fileUrl, header, int64(ckpt.InputOffset), -1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if total := contentRangeTotal(do.Header.Get("Content-Range")); total != ckpt.TotalLen {
+		do.Body.Close()
+		return nil, nil, fmt.Errorf("file size changed from %d to %d bytes", ckpt.TotalLen, total)
+	}
+	return init, do, nil
+}
+
+// contentRangeTotal returns the complete length from a "bytes start-end/total" header, or -1.
+func contentRangeTotal(value string) int64 {
+	_, total, found := strings.Cut(value, "/")
+	if !found {
+		return -1
+	}
+	n, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// currentKey returns the key in effect for segment i, which may have been declared on an earlier segment.
+func currentKey(segments []*m3u8.MediaSegment, i int) *m3u8.Key {
+	for j := i; j >= 0; j-- {
+		if segments[j] != nil && segments[j].Key != nil {
+			return segments[j].Key
+		}
+	}
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -104,26 +104,39 @@ func Run(adamId string, playlistUrl string, outfile string, Config structs.Confi
 		return err
 	}
 
-	// request mp4
+	// request mp4, resuming from the last checkpoint when a previous attempt was interrupted
 	ctx, cancel := context.WithCancelCause(context.Background())
 	defer cancel(nil)
-	req, err = http.NewRequestWithContext(ctx, "GET", fileUrl.String(), nil)
-	if err != nil {
-		return err
-	}
-	req.Header = header
-
-	var body io.Reader
 	client := &http.Client{Timeout: timeout}
+	var timer *time.Timer
 	if optstimeout > 0 {
 		// create the timer before calling Do so that the timeout covers TCP handshake,
 		// TLS handshake, sending the request and receiving HTTP headers
-		timer := time.AfterFunc(timeout, func() { cancel(ErrTimeout) })
-		do, err = client.Do(req)
+		timer = time.AfterFunc(timeout, func() { cancel(ErrTimeout) })
+	}
+
+	resume := loadCheckpoint(checkpointPath(outfile), adamId, len(segments))
+	var resumeInit *mp4.InitSegment
+	if resume != nil {
+		resumeInit, do, err = openResume(ctx, client, fileUrl.String(), header, resume)
+		if err != nil {
+			fmt.Printf("Unable to resume download, starting over: %v\n", err)
+			resume = nil
+			resumeInit = nil
+		} else {
+			fmt.Printf("Resuming download at fragment %d\n", resume.Fragment+1)
+		}
+	}
+	if resume == nil {
+		do, err = openRange(ctx, client, fileUrl.String(), header, 0, -1)
 		if err != nil {
 			return err
 		}
-		defer do.Body.Close()
+	}
+	defer do.Body.Close()
+
+	var body io.Reader
+	if timer != nil {
 		body = &TimedResponseBody{
 			timeout:   timeout,
 			timer:     timer,
@@ -131,16 +144,14 @@ func Run(adamId string, playlistUrl string, outfile string, Config structs.Confi
 			body:      do.Body,
 		}
 	} else {
-		do, err = client.Do(req)
-		if err != nil {
-			return err
-		}
-		defer do.Body.Close()
 		body = do.Body
 	}
 
 	var totalLen int64
 	totalLen = do.ContentLength
+	if resume != nil {
+		totalLen = resume.TotalLen
+	}
 	// connect to decryptor
 	//addr := fmt.Sprintf("127.0.0.1:10020")
 	addr := Config.DecryptM3u8Port
@@ -151,7 +162,7 @@ func Run(adamId string, playlistUrl string, outfile string, Config structs.Confi
 	//fmt.Print("Decrypting...\n")
 	defer Close(conn)
 
-	err = downloadAndDecryptFile(conn, body, outfile, adamId, segments, totalLen, Config, progress, "Downloading")
+	err = downloadAndDecryptFile(conn, body, outfile, adamId, segments, totalLen, Config, progress, "Downloading", resume, resumeInit)
 	if err != nil {
 		return err
 	}
@@ -159,35 +170,77 @@ func Run(adamId string, playlistUrl string, outfile string, Config structs.Confi
 	return nil
 }
 
+// downloadAndDecryptFile decrypts the stream into outfile.part, saving a checkpoint every checkpointInterval
+// bytes and renaming the part file to outfile once the whole stream has been written.
+// A non-nil resume continues an existing part file, in which case in starts at resume.InputOffset.
 func downloadAndDecryptFile(conn io.ReadWriter, in io.Reader, outfile string,
-	adamId string, playlistSegments []*m3u8.MediaSegment, totalLen int64, Config structs.ConfigSet, progress ProgressFunc, phase string) error {
+	adamId string, playlistSegments []*m3u8.MediaSegment, totalLen int64, Config structs.ConfigSet, progress ProgressFunc, phase string,
+	resume *checkpoint, resumeInit *mp4.InitSegment) error {
 	inBuf := bufio.NewReader(in)
-	ofh, err := os.Create(outfile)
-	if err != nil {
-		return err
+	partfile := partPath(outfile)
+	ckptfile := checkpointPath(outfile)
+
+	var ofh *os.File
+	var init *mp4.InitSegment
+	var offset uint64
+	var tracks map[uint32]mp4.DecryptTrackInfo
+	var err error
+	ckpt := checkpoint{
+		AdamID:   adamId,
+		TotalLen: totalLen,
 	}
-	defer ofh.Close()
-	outBuf := bufio.NewWriter(ofh)
-	init, offset, err := ReadInitSegment(inBuf)
-	if err != nil {
-		return err
+	if resume != nil {
+		ofh, err = os.OpenFile(partfile, os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		defer ofh.Close()
+		if err = ofh.Truncate(resume.OutputSize); err != nil {
+			return err
+		}
+		if _, err = ofh.Seek(resume.OutputSize, io.SeekStart); err != nil {
+			return err
+		}
+		init = resumeInit
+		offset = resume.InputOffset
+		ckpt = *resume
+		tracks, err = TransformInit(init)
+		if err != nil {
+			return err
+		}
+	} else {
+		ofh, err = os.Create(partfile)
+		if err != nil {
+			return err
+		}
+		defer ofh.Close()
+		init, offset, err = ReadInitSegment(inBuf)
+		if err != nil {
+			return err
+		}
+		ckpt.InitSize = offset
 	}
+	out := &countingWriter{w: ofh, n: ckpt.OutputSize}
+	outBuf := bufio.NewWriter(out)
+	var sinceCheckpoint uint64
 	if init == nil {
 		return errors.New("no init segment found")
 	}
 
-	tracks, err := TransformInit(init)
-	if err != nil {
-		return err
-	}
-	err = sanitizeInit(init)
-	if err != nil {
-		// errors returned by sanitizeInit are non-fatal
-		fmt.Printf("Warning: unable to sanitize init completely: %s\n", err)
-	}
-	err = init.Encode(outBuf)
-	if err != nil {
-		return err
+	if resume == nil {
+		tracks, err = TransformInit(init)
+		if err != nil {
+			return err
+		}
+		err = sanitizeInit(init)
+		if err != nil {
+			// errors returned by sanitizeInit are non-fatal
+			fmt.Printf("Warning: unable to sanitize init completely: %s\n", err)
+		}
+		err = init.Encode(outBuf)
+		if err != nil {
+			return err
+		}
 	}
 
 	// 'segment' in m3u8 == 'fragment' in mp4ff
@@ -219,7 +272,8 @@ func downloadAndDecryptFile(conn io.ReadWriter, in io.Reader, outfile string,
 		progress(phase, int64(offset), totalLen)
 	}
 	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
-	for i := 0; ; i++ {
+	keySent := false
+	for i := ckpt.Fragment; ; i++ {
 		var frag *mp4.Fragment
 		rawoffset := offset
 		frag, offset, err = ReadNextFragment(inBuf, offset)
@@ -236,13 +290,20 @@ func downloadAndDecryptFile(conn io.ReadWriter, in io.Reader, outfile string,
 		// if totalLen > 0 {
 		// 	fmt.Printf("%.2f%% of %d bytes\n", 100*float32(offset)/float32(totalLen), totalLen)
 		// }
+		if i >= len(playlistSegments) {
+			return errors.New("segment number out of sync")
+		}
 		segment := playlistSegments[i]
 		if segment == nil {
 			return errors.New("segment number out of sync")
 		}
 		key := segment.Key
+		if key == nil && !keySent {
+			// resuming in the middle of a key period, the wrapper still needs the current key
+			key = currentKey(playlistSegments, i)
+		}
 		if key != nil {
-			if i != 0 {
+			if keySent {
 				SwitchKeys(rw)
 			}
 			if key.URI == prefetchKey {
@@ -251,6 +312,7 @@ func downloadAndDecryptFile(conn io.ReadWriter, in io.Reader, outfile string,
 				SendString(rw, adamId)
 			}
 			SendString(rw, key.URI)
+			keySent = true
 		}
 		// flushes the buffer
 		err = DecryptFragment(frag, tracks, rw)
@@ -261,6 +323,20 @@ func downloadAndDecryptFile(conn io.ReadWriter, in io.Reader, outfile string,
 		if err != nil {
 			return err
 		}
+		sinceCheckpoint += frag.Size()
+		if sinceCheckpoint >= checkpointInterval {
+			err = outBuf.Flush()
+			if err != nil {
+				return err
+			}
+			ckpt.Fragment = i + 1
+			ckpt.InputOffset = offset
+			ckpt.OutputSize = out.n
+			if err := saveCheckpoint(ckptfile, ckpt); err != nil {
+				fmt.Printf("Warning: unable to save download checkpoint: %s\n", err)
+			}
+			sinceCheckpoint = 0
+		}
 		if progress != nil {
 			progress(phase, int64(offset), totalLen)
 		} else {
@@ -271,6 +347,13 @@ func downloadAndDecryptFile(conn io.ReadWriter, in io.Reader, outfile string,
 	if err != nil {
 		return err
 	}
+	if err = ofh.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(partfile, outfile); err != nil {
+		return err
+	}
+	_ = os.Remove(ckptfile)
 	return nil
 }
 
@@ -1,10 +1,11 @@
 package runv3
 
 import (
+	"bufio"
 	"context"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
-	"path/filepath"
 
 	"github.com/go-resty/resty/v2"
 	"google.golang.org/protobuf/proto"
@@ -21,7 +22,6 @@ import (
 
 	"encoding/json"
 	"net/http"
-	"os/exec"
 	"strings"
 	"sync"
 
@@ -453,16 +453,27 @@ func fileWriter(wg *sync.WaitGroup, segmentsChan <-chan Segment, outputFile io.W
 
 func ExtMvData(keyAndUrls string, savePath string) error {
 	segments := strings.Split(keyAndUrls, ";")
-	key := segments[0]
-	//fmt.Println(key)
+	key, err := parseMvKey(segments[0])
+	if err != nil {
+		return err
+	}
 	urls := segments[1:]
-	tempFile, err := os.CreateTemp("", "enc_mv_data-*.mp4")
+	outFile, err := os.Create(savePath)
 	if err != nil {
 		fmt.Printf("创建文件失败：%v\n", err)
 		return err
 	}
-	defer os.Remove(tempFile.Name())
-	defer tempFile.Close()
+	defer outFile.Close()
+	done := false
+	defer func() {
+		// 失败时不保留不完整的文件
+		if !done {
+			outFile.Close()
+			os.Remove(savePath)
+		}
+	}()
+	// 边下载边解密，不再需要先落盘加密文件再调用mp4decrypt
+	decrypter := &segmentDecrypter{key: key, w: bufio.NewWriterSize(outFile, 1<<20)}
 
 	var downloadWg, writerWg sync.WaitGroup
 	segmentsChan := make(chan Segment, len(urls))
@@ -474,7 +485,7 @@ func ExtMvData(keyAndUrls string, savePath string) error {
 
 	// 初始化进度条
 	bar := progressbar.DefaultBytes(-1, "Downloading...")
-	barWriter := io.MultiWriter(tempFile, bar)
+	barWriter := io.MultiWriter(decrypter, bar)
 
 	// 启动写入 Goroutine
 	writerWg.Add(1)
@@ -500,23 +511,101 @@ func ExtMvData(keyAndUrls string, savePath string) error {
 
 	// 等待写入 Goroutine 完成所有写入和缓冲处理
 	writerWg.Wait()
+	fmt.Println("\nDownloaded.")
 
+	if decrypter.err != nil {
+		fmt.Printf("Decrypt failed: %v\n", decrypter.err)
+		return decrypter.err
+	}
+	if decrypter.written != len(urls) {
+		return fmt.Errorf("only %d of %d segments downloaded", decrypter.written, len(urls))
+	}
+	if err := decrypter.w.Flush(); err != nil {
+		return err
+	}
 	// 显式关闭文件（defer会再次调用，但重复关闭是安全的）
-	if err := tempFile.Close(); err != nil {
-		fmt.Printf("关闭临时文件失败: %v\n", err)
+	if err := outFile.Close(); err != nil {
+		fmt.Printf("关闭文件失败: %v\n", err)
 		return err
 	}
-	fmt.Println("\nDownloaded.")
+	done = true
+	fmt.Println("Decrypted.")
+	return nil
+}
 
-	cmd1 := exec.Command("mp4decrypt", "--key", key, tempFile.Name(), filepath.Base(savePath))
-	cmd1.Dir = filepath.Dir(savePath) //设置mp4decrypt的工作目录以解决中文路径错误
-	outlog, err := cmd1.CombinedOutput()
+// parseMvKey returns the key of a "KID:KEY" pair as returned by Run in mv mode.
+func parseMvKey(pair string) ([]byte, error) {
+	_, hexKey, found := strings.Cut(pair, ":")
+	if !found {
+		return nil, errors.New("malformed key")
+	}
+	key, err := hex.DecodeString(hexKey)
 	if err != nil {
-		fmt.Printf("Decrypt failed: %v\n", err)
-		fmt.Printf("Output:\n%s\n", outlog)
-		return err
+		return nil, fmt.Errorf("malformed key: %w", err)
+	}
+	return key, nil
+}
+
+// segmentDecrypter decrypts an HLS stream of fMP4 segments while it is written. Each Write must be one
+// whole segment, starting with the init segment, which is how fileWriter writes them.
+type segmentDecrypter struct {
+	key  []byte
+	w    *bufio.Writer
+	init []byte // the encrypted init segment, to parse the media segments against
+	info mp4.DecryptInfo
+	// written counts the segments decrypted so far, init included
+	written int
+	err     error
+}
+
+func (d *segmentDecrypter) Write(data []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if d.init == nil {
+		d.err = d.decryptInit(data)
 	} else {
-		fmt.Println("Decrypted.")
+		d.err = d.decryptSegment(data)
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	d.written++
+	return len(data), nil
+}
+
+func (d *segmentDecrypter) decryptInit(data []byte) error {
+	parsed, err := mp4.DecodeFile(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to decode init segment: %w", err)
+	}
+	if parsed.Init == nil {
+		return errors.New("no init segment found")
+	}
+	d.init = data
+	d.info, err = mp4.DecryptInit(parsed.Init)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt init: %w", err)
+	}
+	if err = parsed.Init.Encode(d.w); err != nil {
+		return fmt.Errorf("failed to write init: %w", err)
+	}
+	return nil
+}
+
+func (d *segmentDecrypter) decryptSegment(data []byte) error {
+	// the sample encryption boxes can only be read with the track info of the init segment
+	parsed, err := mp4.DecodeFile(io.MultiReader(bytes.NewReader(d.init), bytes.NewReader(data)))
+	if err != nil {
+		return fmt.Errorf("failed to decode segment: %w", err)
+	}
+	for _, seg := range parsed.Segments {
+		if err = decryptSegment(seg, d.info, d.key); err != nil {
+			return err
+		}
+		if err = seg.Encode(d.w); err != nil {
+			return fmt.Errorf("failed to encode segment: %w", err)
+		}
 	}
 	return nil
 }
@@ -544,15 +633,8 @@ func DecryptMP4(r io.Reader, key []byte, w io.Writer) error {
 	}
 	// Decode segments
 	for _, seg := range inMp4.Segments {
-		if err = mp4.DecryptSegment(seg, decryptInfo, key); err != nil {
-			if err.Error() == "no senc box in traf" {
-				// No SENC box, skip decryption for this segment as samples can have
-				// unencrypted segments followed by encrypted segments. See:
-				// https://github.com/iyear/gowidevine/pull/26#issuecomment-2385960551
-				err = nil
-			} else {
-				return fmt.Errorf("failed to decrypt segment: %w", err)
-			}
+		if err = decryptSegment(seg, decryptInfo, key); err != nil {
+			return err
 		}
 		if err = seg.Encode(w); err != nil {
 			return fmt.Errorf("failed to encode segment: %w", err)
@@ -560,3 +642,16 @@ func DecryptMP4(r io.Reader, key []byte, w io.Writer) error {
 	}
 	return nil
 }
+
+func decryptSegment(seg *mp4.MediaSegment, decryptInfo mp4.DecryptInfo, key []byte) error {
+	if err := mp4.DecryptSegment(seg, decryptInfo, key); err != nil {
+		if err.Error() == "no senc box in traf" {
+			// No SENC box, skip decryption for this segment as samples can have
+			// unencrypted segments followed by encrypted segments. See:
+			// https://github.com/iyear/gowidevine/pull/26#issuecomment-2385960551
+			return nil
+		}
+		return fmt.Errorf("failed to decrypt segment: %w", err)
+	}
+	return nil
+}
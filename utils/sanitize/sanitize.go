@@ -0,0 +1,194 @@
+// Package sanitize turns titles into file and folder names that are valid on the target filesystem.
+package sanitize
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Profiles select the rules of a filesystem.
+const (
+	// POSIX only forbids "/" and NUL, and compares names case-sensitively.
+	POSIX = "posix"
+	// Windows also covers SMB shares: no <>:"/\|?* or control characters, no trailing dots or spaces,
+	// no reserved device names, and names that differ only in case collide.
+	Windows = "windows"
+	// FAT covers FAT32 and exFAT, e.g. USB sticks for car stereos: the Windows rules.
+	FAT = "fat"
+)
+
+// Default limits of a path component and of a full path. POSIX counts bytes; Windows and FAT count
+// UTF-16 code units, the way those filesystems store names.
+const (
+	DefaultNameBytes = 255
+	posixPathBytes   = 4096
+	windowsPathBytes = 260
+)
+
+var reserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Sanitizer cleans names for one profile.
+type Sanitizer struct {
+	profile   string
+	nameBytes int
+	pathBytes int
+}
+
+// New returns a Sanitizer for profile. An empty or unknown profile uses the one of the operating system
+// the program runs on. Limits of 0 use the defaults of the profile; 260 is the classic Windows path limit.
+func New(profile string, nameBytes int, pathBytes int) *Sanitizer {
+	profile = strings.ToLower(strings.TrimSpace(profile))
+	if profile != POSIX && profile != Windows && profile != FAT {
+		profile = DefaultProfile()
+	}
+	if nameBytes <= 0 {
+		nameBytes = DefaultNameBytes
+	}
+	if pathBytes <= 0 {
+		pathBytes = windowsPathBytes
+		if profile == POSIX {
+			pathBytes = posixPathBytes
+		}
+	}
+	return &Sanitizer{profile: profile, nameBytes: nameBytes, pathBytes: pathBytes}
+}
+
+// DefaultProfile returns the profile of the operating system the program runs on.
+func DefaultProfile() string {
+	if runtime.GOOS == "windows" {
+		return Windows
+	}
+	return POSIX
+}
+
+// Component returns name as a valid folder or file name without extension.
+func (s *Sanitizer) Component(name string) string {
+	return s.fix(s.truncate(s.clean(name), s.nameBytes))
+}
+
+// Base returns the base name of a file in dir, shortened so the longest of exts still fits
+// the component and path limits. The path limit applies to the absolute path of dir.
+func (s *Sanitizer) Base(dir string, name string, exts ...string) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	ext := 0
+	for _, e := range exts {
+		if n := s.length(e); n > ext {
+			ext = n
+		}
+	}
+	limit := s.nameBytes - ext
+	if room := s.pathBytes - s.length(filepath.Clean(dir)) - 1 - ext; room < limit {
+		limit = room
+	}
+	if limit < 1 {
+		// the folder alone is too long; keep a short name and let the filesystem report it
+		limit = 1
+	}
+	return s.fix(s.truncate(s.clean(name), limit))
+}
+
+// Key returns the form of path used to detect collisions: names that differ only in case
+// are the same file on Windows and FAT.
+func (s *Sanitizer) Key(path string) string {
+	path = norm.NFC.String(path)
+	if s.profile == POSIX {
+		return path
+	}
+	return strings.ToLower(path)
+}
+
+// clean normalizes name and replaces the characters the profile forbids.
+func (s *Sanitizer) clean(name string) string {
+	name = norm.NFC.String(name)
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r == '/' || r == 0:
+			b.WriteByte('_')
+		case s.profile != POSIX && (r < 0x20 || strings.ContainsRune(`<>:"\|?*`, r)):
+			b.WriteByte('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// fix makes the final adjustments that truncation could undo.
+func (s *Sanitizer) fix(name string) string {
+	if s.profile != POSIX {
+		name = strings.TrimRight(name, ". ")
+		stem, _, _ := strings.Cut(name, ".")
+		if reserved[strings.ToUpper(strings.TrimSpace(stem))] {
+			name = "_" + name
+		}
+	}
+	if name == "" || name == "." || name == ".." {
+		name = "_" + name
+	}
+	return name
+}
+
+// truncate cuts name to limit units without splitting a character.
+func (s *Sanitizer) truncate(name string, limit int) string {
+	if s.length(name) <= limit {
+		return name
+	}
+	n := 0
+	for i, r := range name {
+		size := utf8.RuneLen(r)
+		if s.profile != POSIX {
+			size = 1
+			if r > 0xFFFF {
+				size = 2
+			}
+		}
+		if n+size > limit {
+			return strings.TrimSpace(name[:i])
+		}
+		n += size
+	}
+	return name
+}
+
+// length measures name in the units of the profile limits: bytes on POSIX, UTF-16 code units otherwise.
+func (s *Sanitizer) length(name string) int {
+	if s.profile == POSIX {
+		return len(name)
+	}
+	n := 0
+	for _, r := range name {
+		n++
+		if r > 0xFFFF {
+			n++
+		}
+	}
+	return n
+}
+
+// Unique returns names with the ID appended to every name already used by an earlier entry,
+// so tracks that would overwrite each other get distinct, stable file names.
+func (s *Sanitizer) Unique(names []string, ids []string) []string {
+	out := make([]string, len(names))
+	seen := make(map[string]bool)
+	for i, name := range names {
+		key := s.Key(name)
+		if seen[key] {
+			name = name + " [" + ids[i] + "]"
+			key = s.Key(name)
+		}
+		seen[key] = true
+		out[i] = name
+	}
+	return out
+}
@@ -0,0 +1,141 @@
+package sanitize
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestComponent(t *testing.T) {
+	tests := []struct {
+		profile string
+		name    string
+		want    string
+	}{
+		{POSIX, "AC/DC", "AC_DC"},
+		{POSIX, `What? "Yes": <No>`, `What? "Yes": <No>`},
+		{POSIX, "  Trailing dot. ", "Trailing dot."},
+		{POSIX, "..", "_.."},
+		{POSIX, "", "_"},
+		{Windows, `What? "Yes": <No>`, "What_ _Yes__ _No_"},
+		{Windows, "Trailing dots...", "Trailing dots"},
+		{Windows, "CON", "_CON"},
+		{Windows, "aux.txt", "_aux.txt"},
+		{Windows, "Console", "Console"},
+		{Windows, "tab\there", "tab_here"},
+		{FAT, "a|b", "a_b"},
+		{Windows, "é", "é"},
+	}
+	for _, tt := range tests {
+		if got := New(tt.profile, 0, 0).Component(tt.name); got != tt.want {
+			t.Errorf("%s Component(%q) = %q, want %q", tt.profile, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestComponentLimit(t *testing.T) {
+	tests := []struct {
+		profile string
+		limit   int
+		name    string
+		want    string
+	}{
+		// 3 bytes per character on POSIX, 1 UTF-16 unit on Windows
+		{POSIX, 7, "日本語の歌", "日本"},
+		{Windows, 7, "日本語の歌", "日本語の歌"},
+		{Windows, 4, "日本語の歌", "日本語の"},
+		// characters outside the BMP take two UTF-16 units
+		{Windows, 3, "😀😀", "😀"},
+		{POSIX, 4, "😀😀", "😀"},
+		// truncation must not leave a trailing dot or space on Windows
+		{Windows, 6, "Hello. World", "Hello"},
+		{POSIX, 6, "Hello. World", "Hello."},
+	}
+	for _, tt := range tests {
+		if got := New(tt.profile, tt.limit, 0).Component(tt.name); got != tt.want {
+			t.Errorf("%s/%d Component(%q) = %q, want %q", tt.profile, tt.limit, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBase(t *testing.T) {
+	dir := t.TempDir()
+	abs := len(filepath.Clean(dir))
+	long := strings.Repeat("a", 300)
+	tests := []struct {
+		profile string
+		name    string
+		path    int
+		exts    []string
+		want    int
+	}{
+		// the component limit leaves room for the longest extension
+		{POSIX, long, 0, []string{".m4a", ".lrc"}, 255 - 4},
+		{POSIX, long, 0, []string{".m4a", ".ttml"}, 255 - 5},
+		// the path limit counts the absolute folder, the separator and the extension
+		{Windows, long, abs + 1 + 4 + 100, []string{".m4a"}, 100},
+		// a folder that already fills the path keeps a one-character name
+		{Windows, long, abs, []string{".m4a"}, 1},
+	}
+	for _, tt := range tests {
+		got := New(tt.profile, 0, tt.path).Base(dir, tt.name, tt.exts...)
+		if len(got) != tt.want {
+			t.Errorf("%s Base(path %d, %v) has length %d, want %d", tt.profile, tt.path, tt.exts, len(got), tt.want)
+		}
+	}
+}
+
+func TestBaseRelative(t *testing.T) {
+	abs, err := filepath.Abs("music")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit := len(abs) + 1 + 10
+	if got := New(POSIX, 0, limit).Base("music", strings.Repeat("b", 50)); len(got) != 10 {
+		t.Errorf("relative Base has length %d, want 10", len(got))
+	}
+}
+
+func TestNewDefaults(t *testing.T) {
+	tests := []struct {
+		profile string
+		want    string
+	}{
+		{"", DefaultProfile()},
+		{"ntfs", DefaultProfile()},
+		{" Windows ", Windows},
+		{"FAT", FAT},
+		{"posix", POSIX},
+	}
+	for _, tt := range tests {
+		if got := New(tt.profile, 0, 0).profile; got != tt.want {
+			t.Errorf("New(%q) uses profile %q, want %q", tt.profile, got, tt.want)
+		}
+	}
+	if got := New(POSIX, 0, 0).pathBytes; got != posixPathBytes {
+		t.Errorf("posix path limit = %d, want %d", got, posixPathBytes)
+	}
+	if got := New(FAT, 0, 0).pathBytes; got != windowsPathBytes {
+		t.Errorf("fat path limit = %d, want %d", got, windowsPathBytes)
+	}
+}
+
+func TestUnique(t *testing.T) {
+	tests := []struct {
+		profile string
+		names   []string
+		want    []string
+	}{
+		{POSIX, []string{"Intro", "intro", "Intro"}, []string{"Intro", "intro", "Intro [3]"}},
+		{Windows, []string{"Intro", "intro", "Outro"}, []string{"Intro", "intro [2]", "Outro"}},
+		// composed and decomposed accents are the same name
+		{POSIX, []string{"Caf\u00e9", "Cafe\u0301"}, []string{"Caf\u00e9", "Cafe\u0301 [2]"}},
+	}
+	for _, tt := range tests {
+		got := New(tt.profile, 0, 0).Unique(tt.names, []string{"1", "2", "3"})
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s Unique(%q) = %q, want %q", tt.profile, tt.names, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"main/utils/events"
+)
+
+// Job statuses.
+const (
+	Queued   = "queued"
+	Running  = "running"
+	Done     = "done"
+	Failed   = "failed"
+	Canceled = "canceled"
+)
+
+// keepFinished is how many finished jobs are kept for status queries.
+const keepFinished = 100
+
+// Request is the body of POST /jobs. Either URL, or ID with Type, names what to download.
+type Request struct {
+	URL        string `json:"url,omitempty"`
+	ID         string `json:"id,omitempty"`
+	Type       string `json:"type,omitempty"`
+	Codec      string `json:"codec,omitempty"`
+	Tracks     []int  `json:"tracks,omitempty"`
+	Storefront string `json:"storefront,omitempty"`
+	Output     string `json:"output,omitempty"`
+}
+
+// Job is one queued download and its progress.
+type Job struct {
+	mu       sync.Mutex
+	ID       string         `json:"id"`
+	URL      string         `json:"url"`
+	Request  Request        `json:"request"`
+	Status   string         `json:"status"`
+	Phase    string         `json:"phase,omitempty"`
+	Done     int64          `json:"done,omitempty"`
+	Total    int64          `json:"total,omitempty"`
+	Files    []string       `json:"files,omitempty"`
+	Counts   *events.Counts `json:"counts,omitempty"`
+	Error    string         `json:"error,omitempty"`
+	Created  time.Time      `json:"created"`
+	Started  *time.Time     `json:"started,omitempty"`
+	Finished *time.Time     `json:"finished,omitempty"`
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Progress records a progress update; it has the signature of Session.Progress.
+func (j *Job) Progress(phase string, done, total int64) {
+	j.mu.Lock()
+	j.Phase = phase
+	j.Done = done
+	j.Total = total
+	j.mu.Unlock()
+}
+
+// Context is canceled when the job is canceled.
+func (j *Job) Context() context.Context {
+	return j.ctx
+}
+
+// snapshot returns a copy of the job that can be encoded without holding its lock.
+func (j *Job) snapshot() *Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return &Job{
+		ID:       j.ID,
+		URL:      j.URL,
+		Request:  j.Request,
+		Status:   j.Status,
+		Phase:    j.Phase,
+		Done:     j.Done,
+		Total:    j.Total,
+		Files:    append([]string{}, j.Files...),
+		Counts:   j.Counts,
+		Error:    j.Error,
+		Created:  j.Created,
+		Started:  j.Started,
+		Finished: j.Finished,
+	}
+}
+
+// Result is what a finished job produced.
+type Result struct {
+	Files  []string
+	Counts *events.Counts
+}
+
+// Options configure a Server.
+type Options struct {
+	// Token, when set, must be sent as "Authorization: Bearer <token>".
+	Token string
+	// Workers is how many jobs run at the same time.
+	Workers int
+	// QueueSize is how many jobs can wait.
+	QueueSize int
+	// Resolve validates a request and returns the URL to download.
+	Resolve func(req Request) (string, error)
+	// Run downloads a job. It should stop early once job.Context() is canceled.
+	Run func(job *Job) (Result, error)
+}
+
+// Server queues download jobs and serves their status over HTTP.
+type Server struct {
+	opts  Options
+	queue chan *Job
+
+	mu    sync.Mutex
+	jobs  map[string]*Job
+	order []string
+	seq   int
+}
+
+// New returns a Server and starts its workers.
+func New(opts Options) *Server {
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	if opts.QueueSize < 1 {
+		opts.QueueSize = 20
+	}
+	s := &Server{
+		opts:  opts,
+		queue: make(chan *Job, opts.QueueSize),
+		jobs:  make(map[string]*Job),
+	}
+	for i := 0; i < opts.Workers; i++ {
+		go s.worker()
+	}
+	return s
+}
+
+func (s *Server) worker() {
+	for job := range s.queue {
+		job.mu.Lock()
+		if job.Status == Canceled {
+			job.mu.Unlock()
+			continue
+		}
+		now := time.Now()
+		job.Status = Running
+		job.Started = &now
+		job.mu.Unlock()
+
+		result, err := s.opts.Run(job)
+
+		job.mu.Lock()
+		finished := time.Now()
+		job.Finished = &finished
+		job.Files = result.Files
+		job.Counts = result.Counts
+		switch {
+		case job.ctx.Err() != nil:
+			job.Status = Canceled
+		case err != nil:
+			job.Status = Failed
+			job.Error = err.Error()
+		default:
+			job.Status = Done
+		}
+		job.mu.Unlock()
+		job.cancel()
+		s.prune()
+	}
+}
+
+// Handler returns the HTTP API:
+//
+//	POST   /jobs             enqueue a Request, returns the job
+//	GET    /jobs             list jobs
+//	GET    /jobs/{id}        job status and progress
+//	GET    /jobs/{id}/files  files the job downloaded
+//	DELETE /jobs/{id}        cancel a queued or running job
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", s.handleCreate)
+	mux.HandleFunc("GET /jobs", s.handleList)
+	mux.HandleFunc("GET /jobs/{id}", s.handleGet)
+	mux.HandleFunc("GET /jobs/{id}/files", s.handleFiles)
+	mux.HandleFunc("DELETE /jobs/{id}", s.handleCancel)
+	return s.authorize(mux)
+}
+
+func (s *Server) authorize(next http.Handler) http.Handler {
+	if s.opts.Token == "" {
+		return next
+	}
+	want := []byte("Bearer " + s.opts.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("missing or wrong token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	url, err := s.opts.Resolve(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.mu.Lock()
+	s.seq++
+	job := &Job{
+		ID:      fmt.Sprintf("%d", s.seq),
+		URL:     url,
+		Request: req,
+		Status:  Queued,
+		Created: time.Now(),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	select {
+	case s.queue <- job:
+	default:
+		s.mu.Unlock()
+		cancel()
+		writeError(w, http.StatusServiceUnavailable, errors.New("download queue is full"))
+		return
+	}
+	s.jobs[job.ID] = job
+	s.order = append(s.order, job.ID)
+	s.mu.Unlock()
+	writeJSON(w, http.StatusAccepted, job.snapshot())
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	jobs := make([]*Job, 0, len(s.order))
+	for _, id := range s.order {
+		jobs = append(jobs, s.jobs[id])
+	}
+	s.mu.Unlock()
+	list := make([]*Job, 0, len(jobs))
+	for _, job := range jobs {
+		list = append(list, job.snapshot())
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"jobs": list})
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.job(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, job.snapshot())
+}
+
+func (s *Server) handleFiles(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.job(w, r)
+	if !ok {
+		return
+	}
+	snap := job.snapshot()
+	writeJSON(w, http.StatusOK, map[string]any{"id": snap.ID, "status": snap.Status, "files": snap.Files})
+}
+
+func (s *Server) handleCancel(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.job(w, r)
+	if !ok {
+		return
+	}
+	job.mu.Lock()
+	switch job.Status {
+	case Queued:
+		// the worker skips it when it comes up
+		now := time.Now()
+		job.Status = Canceled
+		job.Finished = &now
+	case Running:
+		// the job ends after the tracks already downloading
+	default:
+		job.mu.Unlock()
+		writeError(w, http.StatusConflict, fmt.Errorf("job %s is already %s", job.ID, job.Status))
+		return
+	}
+	job.mu.Unlock()
+	job.cancel()
+	writeJSON(w, http.StatusAccepted, job.snapshot())
+}
+
+func (s *Server) job(w http.ResponseWriter, r *http.Request) (*Job, bool) {
+	id := r.PathValue("id")
+	s.mu.Lock()
+	job, ok := s.jobs[id]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("job %s not found", id))
+	}
+	return job, ok
+}
+
+// prune forgets the oldest finished jobs beyond keepFinished.
+func (s *Server) prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	finished := 0
+	for _, id := range s.order {
+		if isFinished(s.jobs[id]) {
+			finished++
+		}
+	}
+	kept := s.order[:0]
+	for _, id := range s.order {
+		if finished > keepFinished && isFinished(s.jobs[id]) {
+			delete(s.jobs, id)
+			finished--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	s.order = kept
+}
+
+func isFinished(job *Job) bool {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.Status == Done || job.Status == Failed || job.Status == Canceled
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": strings.TrimSpace(err.Error())})
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func resolve(req Request) (string, error) {
+	if req.URL == "" {
+		return "", errors.New("url is required")
+	}
+	return req.URL, nil
+}
+
+func do(t *testing.T, ts *httptest.Server, method, path string, body any, out any) int {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, ts.URL+path, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// waitStatus polls the job until it has status.
+func waitStatus(t *testing.T, ts *httptest.Server, id, status string) *Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job := &Job{}
+		do(t, ts, "GET", "/jobs/"+id, nil, job)
+		if job.Status == status {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s is %s, want %s", id, job.Status, status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestJobLifecycle(t *testing.T) {
+	release := make(chan struct{})
+	s := New(Options{
+		Resolve: resolve,
+		Run: func(job *Job) (Result, error) {
+			job.Progress("tracks", 1, 2)
+			<-release
+			if strings.Contains(job.URL, "fail") {
+				return Result{}, errors.New("boom")
+			}
+			return Result{Files: []string{"a.m4a", "b.m4a"}}, nil
+		},
+	})
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	var created Job
+	if code := do(t, ts, "POST", "/jobs", Request{URL: "https://music.apple.com/us/album/1"}, &created); code != http.StatusAccepted {
+		t.Fatalf("POST /jobs = %d, want %d", code, http.StatusAccepted)
+	}
+	running := waitStatus(t, ts, created.ID, Running)
+	if running.Phase != "tracks" || running.Done != 1 || running.Total != 2 || running.Started == nil {
+		t.Errorf("running job = %+v, want its progress and start time", running)
+	}
+	close(release)
+	done := waitStatus(t, ts, created.ID, Done)
+	if done.Finished == nil || len(done.Files) != 2 {
+		t.Errorf("finished job = %+v, want its files and end time", done)
+	}
+	var files struct {
+		Status string   `json:"status"`
+		Files  []string `json:"files"`
+	}
+	do(t, ts, "GET", "/jobs/"+created.ID+"/files", nil, &files)
+	if files.Status != Done || strings.Join(files.Files, ",") != "a.m4a,b.m4a" {
+		t.Errorf("GET files = %+v", files)
+	}
+
+	var failed Job
+	do(t, ts, "POST", "/jobs", Request{URL: "https://music.apple.com/us/album/fail"}, &failed)
+	if job := waitStatus(t, ts, failed.ID, Failed); job.Error != "boom" {
+		t.Errorf("failed job error = %q, want boom", job.Error)
+	}
+
+	var list struct {
+		Jobs []*Job `json:"jobs"`
+	}
+	do(t, ts, "GET", "/jobs", nil, &list)
+	if len(list.Jobs) != 2 || list.Jobs[0].ID != created.ID || list.Jobs[1].ID != failed.ID {
+		t.Errorf("GET /jobs = %+v, want both jobs in order", list.Jobs)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	started := make(chan struct{}, 1)
+	var runs atomic.Int32
+	s := New(Options{
+		Workers: 1,
+		Resolve: resolve,
+		Run: func(job *Job) (Result, error) {
+			runs.Add(1)
+			started <- struct{}{}
+			<-job.Context().Done()
+			return Result{Files: []string{"partial.m4a"}}, nil
+		},
+	})
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	var running, queued Job
+	do(t, ts, "POST", "/jobs", Request{URL: "first"}, &running)
+	<-started
+	do(t, ts, "POST", "/jobs", Request{URL: "second"}, &queued)
+
+	var canceled Job
+	if code := do(t, ts, "DELETE", "/jobs/"+queued.ID, nil, &canceled); code != http.StatusAccepted || canceled.Status != Canceled {
+		t.Fatalf("DELETE queued job = %d %s, want %d %s", code, canceled.Status, http.StatusAccepted, Canceled)
+	}
+	if code := do(t, ts, "DELETE", "/jobs/"+running.ID, nil, nil); code != http.StatusAccepted {
+		t.Fatalf("DELETE running job = %d, want %d", code, http.StatusAccepted)
+	}
+	if job := waitStatus(t, ts, running.ID, Canceled); len(job.Files) != 1 {
+		t.Errorf("canceled job files = %v, want what it downloaded before", job.Files)
+	}
+	if code := do(t, ts, "DELETE", "/jobs/"+running.ID, nil, nil); code != http.StatusConflict {
+		t.Errorf("DELETE finished job = %d, want %d", code, http.StatusConflict)
+	}
+
+	// the worker skips the canceled job and takes the next one
+	var next Job
+	do(t, ts, "POST", "/jobs", Request{URL: "third"}, &next)
+	<-started
+	do(t, ts, "DELETE", "/jobs/"+next.ID, nil, nil)
+	waitStatus(t, ts, next.ID, Canceled)
+	if n := runs.Load(); n != 2 {
+		t.Errorf("Run was called %d times, want 2", n)
+	}
+}
+
+func TestRequests(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	started := make(chan struct{}, 1)
+	s := New(Options{
+		Token:     "secret",
+		Workers:   1,
+		QueueSize: 1,
+		Resolve:   resolve,
+		Run: func(job *Job) (Result, error) {
+			started <- struct{}{}
+			<-block
+			return Result{}, nil
+		},
+	})
+	handler := s.Handler()
+	request := func(method, path, token, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   string
+		want   int
+	}{
+		{"no token", "GET", "/jobs", "", "", http.StatusUnauthorized},
+		{"wrong token", "GET", "/jobs", "guess", "", http.StatusUnauthorized},
+		{"list", "GET", "/jobs", "secret", "", http.StatusOK},
+		{"invalid body", "POST", "/jobs", "secret", "{", http.StatusBadRequest},
+		{"rejected request", "POST", "/jobs", "secret", `{"id":"1"}`, http.StatusBadRequest},
+		{"unknown job", "GET", "/jobs/404", "secret", "", http.StatusNotFound},
+		{"unknown job files", "GET", "/jobs/404/files", "secret", "", http.StatusNotFound},
+		{"cancel unknown job", "DELETE", "/jobs/404", "secret", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if got := request(tt.method, tt.path, tt.token, tt.body); got != tt.want {
+			t.Errorf("%s: %s %s = %d, want %d", tt.name, tt.method, tt.path, got, tt.want)
+		}
+	}
+
+	// one job runs and one waits, so the third does not fit
+	body := `{"url":"x"}`
+	if got := request("POST", "/jobs", "secret", body); got != http.StatusAccepted {
+		t.Fatalf("first job = %d", got)
+	}
+	<-started
+	if got := request("POST", "/jobs", "secret", body); got != http.StatusAccepted {
+		t.Fatalf("second job = %d", got)
+	}
+	if got := request("POST", "/jobs", "secret", body); got != http.StatusServiceUnavailable {
+		t.Errorf("job on a full queue = %d, want %d", got, http.StatusServiceUnavailable)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	tests := []struct {
+		finished, running int
+		kept              int
+	}{
+		{keepFinished, 0, keepFinished},
+		{keepFinished + 5, 0, keepFinished},
+		{keepFinished + 5, 3, keepFinished + 3},
+		{10, 3, 13},
+	}
+	for _, tt := range tests {
+		s := &Server{jobs: make(map[string]*Job)}
+		add := func(status string) {
+			s.seq++
+			id := fmt.Sprintf("%d", s.seq)
+			s.jobs[id] = &Job{ID: id, Status: status}
+			s.order = append(s.order, id)
+		}
+		// running jobs between old finished ones must survive
+		for i := 0; i < tt.running; i++ {
+			add(Done)
+			add(Running)
+		}
+		for i := tt.running; i < tt.finished; i++ {
+			add(Failed)
+		}
+		s.prune()
+		if len(s.order) != tt.kept || len(s.jobs) != tt.kept {
+			t.Errorf("%d finished, %d running: kept %d jobs (%d in order), want %d", tt.finished, tt.running, len(s.jobs), len(s.order), tt.kept)
+		}
+		running := 0
+		for _, id := range s.order {
+			if s.jobs[id].Status == Running {
+				running++
+			}
+		}
+		if running != tt.running {
+			t.Errorf("%d finished, %d running: %d running jobs left", tt.finished, tt.running, running)
+		}
+		if tt.finished > keepFinished && s.order[len(s.order)-1] != fmt.Sprintf("%d", s.seq) {
+			t.Errorf("prune dropped the newest job")
+		}
+	}
+}
@@ -0,0 +1,306 @@
+// Package sidecar writes album.nfo, artist.nfo and album.json next to downloaded albums, so media servers
+// such as Jellyfin, Kodi and Plex pick up the full Apple Music metadata without scraping.
+package sidecar
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"main/utils/ampapi"
+)
+
+// File names of the sidecars.
+const (
+	AlbumNFO  = "album.nfo"
+	ArtistNFO = "artist.nfo"
+	AlbumJSON = "album.json"
+)
+
+// Artwork is an image with its Apple Music colors. URL is the template with {w}x{h} filled in at full size.
+type Artwork struct {
+	URL        string `json:"url"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+	BgColor    string `json:"bg_color,omitempty"`
+	TextColor1 string `json:"text_color1,omitempty"`
+	TextColor2 string `json:"text_color2,omitempty"`
+	TextColor3 string `json:"text_color3,omitempty"`
+	TextColor4 string `json:"text_color4,omitempty"`
+	// File is the downloaded copy, relative to the folder of the sidecar.
+	File string `json:"file,omitempty"`
+}
+
+// Artist is an album artist.
+type Artist struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Artwork *Artwork `json:"artwork,omitempty"`
+}
+
+// Track is one track of the album.
+type Track struct {
+	ID             string `json:"id"`
+	Disc           int    `json:"disc"`
+	Number         int    `json:"number"`
+	Name           string `json:"name"`
+	Artist         string `json:"artist"`
+	Composer       string `json:"composer,omitempty"`
+	ISRC           string `json:"isrc,omitempty"`
+	DurationMillis int    `json:"duration_ms"`
+	ContentRating  string `json:"content_rating,omitempty"`
+}
+
+// Album is the metadata written to album.json.
+type Album struct {
+	ID                   string            `json:"id"`
+	Name                 string            `json:"name"`
+	Artist               string            `json:"artist"`
+	Artists              []Artist          `json:"artists,omitempty"`
+	URL                  string            `json:"url"`
+	UPC                  string            `json:"upc,omitempty"`
+	ReleaseDate          string            `json:"release_date,omitempty"`
+	RecordLabel          string            `json:"record_label,omitempty"`
+	Copyright            string            `json:"copyright,omitempty"`
+	Genres               []string          `json:"genres,omitempty"`
+	ContentRating        string            `json:"content_rating,omitempty"`
+	TrackCount           int               `json:"track_count"`
+	IsCompilation        bool              `json:"is_compilation"`
+	IsSingle             bool              `json:"is_single"`
+	IsComplete           bool              `json:"is_complete"`
+	IsMasteredForItunes  bool              `json:"is_mastered_for_itunes"`
+	IsAppleDigitalMaster bool              `json:"is_apple_digital_master"`
+	AudioTraits          []string          `json:"audio_traits,omitempty"`
+	Artwork              Artwork           `json:"artwork"`
+	EditorialVideos      map[string]string `json:"editorial_videos,omitempty"`
+	Tracks               []Track           `json:"tracks"`
+}
+
+// NewAlbum collects the metadata of an album response.
+func NewAlbum(data ampapi.AlbumRespData) Album {
+	attrs := data.Attributes
+	album := Album{
+		ID:                   data.ID,
+		Name:                 attrs.Name,
+		Artist:               attrs.ArtistName,
+		URL:                  attrs.URL,
+		UPC:                  attrs.Upc,
+		ReleaseDate:          attrs.ReleaseDate,
+		RecordLabel:          attrs.RecordLabel,
+		Copyright:            attrs.Copyright,
+		Genres:               attrs.GenreNames,
+		ContentRating:        attrs.ContentRating,
+		TrackCount:           attrs.TrackCount,
+		IsCompilation:        attrs.IsCompilation,
+		IsSingle:             attrs.IsSingle,
+		IsComplete:           attrs.IsComplete,
+		IsMasteredForItunes:  attrs.IsMasteredForItunes,
+		IsAppleDigitalMaster: attrs.IsAppleDigitalMaster,
+		AudioTraits:          attrs.AudioTraits,
+		Artwork: Artwork{
+			URL:        artworkURL(attrs.Artwork.URL, attrs.Artwork.Width, attrs.Artwork.Height),
+			Width:      attrs.Artwork.Width,
+			Height:     attrs.Artwork.Height,
+			BgColor:    attrs.Artwork.BgColor,
+			TextColor1: attrs.Artwork.TextColor1,
+			TextColor2: attrs.Artwork.TextColor2,
+			TextColor3: attrs.Artwork.TextColor3,
+			TextColor4: attrs.Artwork.TextColor4,
+		},
+	}
+	videos := map[string]string{
+		"motion_tall":          attrs.EditorialVideo.MotionTall.Video,
+		"motion_square":        attrs.EditorialVideo.MotionSquare.Video,
+		"motion_detail_tall":   attrs.EditorialVideo.MotionDetailTall.Video,
+		"motion_detail_square": attrs.EditorialVideo.MotionDetailSquare.Video,
+	}
+	for kind, video := range videos {
+		if video == "" {
+			delete(videos, kind)
+		}
+	}
+	if len(videos) > 0 {
+		album.EditorialVideos = videos
+	}
+	for _, artist := range data.Relationships.Artists.Data {
+		entry := Artist{ID: artist.ID, Name: artist.Attributes.Name}
+		if artist.Attributes.Artwork.Url != "" {
+			entry.Artwork = &Artwork{URL: artworkURL(artist.Attributes.Artwork.Url, 0, 0)}
+		}
+		album.Artists = append(album.Artists, entry)
+	}
+	for _, track := range data.Relationships.Tracks.Data {
+		album.Tracks = append(album.Tracks, Track{
+			ID:             track.ID,
+			Disc:           track.Attributes.DiscNumber,
+			Number:         track.Attributes.TrackNumber,
+			Name:           track.Attributes.Name,
+			Artist:         track.Attributes.ArtistName,
+			Composer:       track.Attributes.ComposerName,
+			ISRC:           track.Attributes.Isrc,
+			DurationMillis: track.Attributes.DurationInMillis,
+			ContentRating:  track.Attributes.ContentRating,
+		})
+	}
+	return album
+}
+
+// artworkURL fills the {w}x{h} of an artwork template; 0 sizes ask for the largest the server has.
+func artworkURL(template string, width int, height int) string {
+	if width <= 0 || height <= 0 {
+		width, height = 10000, 10000
+	}
+	return strings.Replace(template, "{w}x{h}", fmt.Sprintf("%dx%d", width, height), 1)
+}
+
+// Year returns the year of the release date.
+func (a Album) Year() string {
+	if len(a.ReleaseDate) >= 4 {
+		return a.ReleaseDate[:4]
+	}
+	return ""
+}
+
+// albumNFO is album.nfo in the format Kodi defines and Jellyfin reads.
+type albumNFO struct {
+	XMLName       xml.Name   `xml:"album"`
+	Title         string     `xml:"title"`
+	Artist        string     `xml:"artist"`
+	AlbumArtist   string     `xml:"albumartist"`
+	ArtistCredits []nfoName  `xml:"albumArtistCredits,omitempty"`
+	Genres        []string   `xml:"genre"`
+	Type          string     `xml:"type,omitempty"`
+	Compilation   bool       `xml:"compilation"`
+	ReleaseDate   string     `xml:"releasedate,omitempty"`
+	Year          string     `xml:"year,omitempty"`
+	Label         string     `xml:"label,omitempty"`
+	Copyright     string     `xml:"copyright,omitempty"`
+	Rating        string     `xml:"mpaa,omitempty"`
+	Thumb         string     `xml:"thumb,omitempty"`
+	UniqueIDs     []uniqueID `xml:"uniqueid"`
+	Tracks        []nfoTrack `xml:"track"`
+}
+
+type nfoName struct {
+	Artist string `xml:"artist"`
+}
+
+type uniqueID struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type nfoTrack struct {
+	Disc     int    `xml:"disc,omitempty"`
+	Position int    `xml:"position"`
+	Title    string `xml:"title"`
+	Duration string `xml:"duration"`
+}
+
+// artistNFO is artist.nfo in the format Kodi defines and Jellyfin reads.
+type artistNFO struct {
+	XMLName   xml.Name   `xml:"artist"`
+	Name      string     `xml:"name"`
+	Thumb     string     `xml:"thumb,omitempty"`
+	UniqueIDs []uniqueID `xml:"uniqueid"`
+}
+
+// WriteAlbum writes album.nfo and, with withJSON, album.json into folder. cover is the album artwork
+// downloaded into folder, or "".
+func WriteAlbum(folder string, album Album, cover string, withNFO bool, withJSON bool) error {
+	if cover != "" {
+		album.Artwork.File = filepath.Base(cover)
+	}
+	if withNFO {
+		nfo := albumNFO{
+			Title:       album.Name,
+			Artist:      album.Artist,
+			AlbumArtist: album.Artist,
+			Genres:      album.Genres,
+			Compilation: album.IsCompilation,
+			ReleaseDate: album.ReleaseDate,
+			Year:        album.Year(),
+			Label:       album.RecordLabel,
+			Copyright:   album.Copyright,
+			Rating:      album.ContentRating,
+			Thumb:       album.Artwork.File,
+			UniqueIDs: []uniqueID{
+				{Type: "applemusic", Value: album.ID},
+			},
+		}
+		if album.IsSingle {
+			nfo.Type = "single"
+		}
+		if album.UPC != "" {
+			nfo.UniqueIDs = append(nfo.UniqueIDs, uniqueID{Type: "upc", Value: album.UPC})
+		}
+		for _, artist := range album.Artists {
+			nfo.ArtistCredits = append(nfo.ArtistCredits, nfoName{Artist: artist.Name})
+		}
+		for _, track := range album.Tracks {
+			nfo.Tracks = append(nfo.Tracks, nfoTrack{
+				Disc:     track.Disc,
+				Position: track.Number,
+				Title:    track.Name,
+				Duration: duration(track.DurationMillis),
+			})
+		}
+		if err := writeXML(filepath.Join(folder, AlbumNFO), nfo); err != nil {
+			return err
+		}
+	}
+	if withJSON {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(album); err != nil {
+			return err
+		}
+		if err := writeFile(filepath.Join(folder, AlbumJSON), buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteArtist writes artist.nfo into the artist folder. cover is the artist artwork downloaded into folder
+// for save-artist-cover, or "".
+func WriteArtist(folder string, artist Artist, cover string) error {
+	nfo := artistNFO{
+		Name:      artist.Name,
+		UniqueIDs: []uniqueID{{Type: "applemusic", Value: artist.ID}},
+	}
+	if cover != "" {
+		nfo.Thumb = filepath.Base(cover)
+	}
+	return writeXML(filepath.Join(folder, ArtistNFO), nfo)
+}
+
+// duration formats milliseconds as m:ss, the form Kodi shows.
+func duration(millis int) string {
+	seconds := (millis + 500) / 1000
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+func writeXML(path string, v any) error {
+	data, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append([]byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>`+"\n"), data...)
+	return writeFile(path, append(data, '\n'))
+}
+
+// writeFile writes path through a temporary file so a media server never reads half a sidecar.
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
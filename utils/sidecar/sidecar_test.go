@@ -0,0 +1,152 @@
+package sidecar
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDuration(t *testing.T) {
+	tests := []struct {
+		millis int
+		want   string
+	}{
+		{0, "0:00"},
+		{499, "0:00"},
+		{500, "0:01"},
+		{59999, "1:00"},
+		{201400, "3:21"},
+		{3723000, "62:03"},
+	}
+	for _, tt := range tests {
+		if got := duration(tt.millis); got != tt.want {
+			t.Errorf("duration(%d) = %q, want %q", tt.millis, got, tt.want)
+		}
+	}
+}
+
+func TestArtworkURL(t *testing.T) {
+	template := "https://example.com/{w}x{h}bb.jpg"
+	tests := []struct {
+		width, height int
+		want          string
+	}{
+		{3000, 3000, "https://example.com/3000x3000bb.jpg"},
+		{0, 0, "https://example.com/10000x10000bb.jpg"},
+		{3000, 0, "https://example.com/10000x10000bb.jpg"},
+	}
+	for _, tt := range tests {
+		if got := artworkURL(template, tt.width, tt.height); got != tt.want {
+			t.Errorf("artworkURL(%d, %d) = %q, want %q", tt.width, tt.height, got, tt.want)
+		}
+	}
+}
+
+func TestWriteAlbum(t *testing.T) {
+	album := Album{
+		ID:          "1",
+		Name:        "Rock & Roll <Live>",
+		Artist:      "Artist",
+		Artists:     []Artist{{ID: "10", Name: "Artist"}, {ID: "11", Name: "Guest"}},
+		UPC:         "0123",
+		ReleaseDate: "2024-03-01",
+		Genres:      []string{"Rock", "Music"},
+		IsSingle:    true,
+		Tracks:      []Track{{Disc: 1, Number: 1, Name: "Song", DurationMillis: 201400}},
+	}
+	tests := []struct {
+		name     string
+		withNFO  bool
+		withJSON bool
+		files    []string
+	}{
+		{"nfo", true, false, []string{AlbumNFO}},
+		{"json", false, true, []string{AlbumJSON}},
+		{"both", true, true, []string{AlbumNFO, AlbumJSON}},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		if err := WriteAlbum(dir, album, filepath.Join(dir, "cover.jpg"), tt.withNFO, tt.withJSON); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		if len(names) != len(tt.files) {
+			t.Errorf("%s: wrote %v, want %v", tt.name, names, tt.files)
+		}
+		if tt.withNFO {
+			data, err := os.ReadFile(filepath.Join(dir, AlbumNFO))
+			if err != nil {
+				t.Fatal(err)
+			}
+			nfo := string(data)
+			for _, want := range []string{
+				`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>`,
+				"<title>Rock &amp; Roll &lt;Live&gt;</title>",
+				"<albumArtistCredits>\n    <artist>Guest</artist>\n  </albumArtistCredits>",
+				"<genre>Rock</genre>\n  <genre>Music</genre>",
+				"<type>single</type>",
+				"<year>2024</year>",
+				"<thumb>cover.jpg</thumb>",
+				`<uniqueid type="applemusic">1</uniqueid>`,
+				`<uniqueid type="upc">0123</uniqueid>`,
+				"<duration>3:21</duration>",
+			} {
+				if !strings.Contains(nfo, want) {
+					t.Errorf("%s: album.nfo has no %q:\n%s", tt.name, want, nfo)
+				}
+			}
+		}
+		if tt.withJSON {
+			data, err := os.ReadFile(filepath.Join(dir, AlbumJSON))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(data), `"name": "Rock & Roll <Live>"`) {
+				t.Errorf("%s: album.json escapes HTML:\n%s", tt.name, data)
+			}
+			var decoded Album
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if decoded.Artwork.File != "cover.jpg" || len(decoded.Tracks) != 1 || decoded.Tracks[0].DurationMillis != 201400 {
+				t.Errorf("%s: album.json = %+v", tt.name, decoded)
+			}
+		}
+	}
+}
+
+func TestWriteArtist(t *testing.T) {
+	tests := []struct {
+		cover string
+		thumb bool
+	}{
+		{"", false},
+		{"/music/Artist/folder.jpg", true},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		if err := WriteArtist(dir, Artist{ID: "10", Name: "Simon & Garfunkel"}, tt.cover); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, ArtistNFO))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nfo := string(data)
+		if !strings.Contains(nfo, "<name>Simon &amp; Garfunkel</name>") || !strings.Contains(nfo, `<uniqueid type="applemusic">10</uniqueid>`) {
+			t.Errorf("artist.nfo = %s", nfo)
+		}
+		if got := strings.Contains(nfo, "<thumb>folder.jpg</thumb>"); got != tt.thumb {
+			t.Errorf("WriteArtist(%q): thumb %v, want %v", tt.cover, got, tt.thumb)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileName is the name of the snapshot kept inside a synced playlist folder.
+const FileName = ".playlist-sync.json"
+
+// Track is one playlist entry as it was downloaded.
+type Track struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Position int    `json:"position"`
+	File     string `json:"file,omitempty"`
+}
+
+// Snapshot records the track order of a playlist at the last sync. File paths are relative to the playlist folder.
+type Snapshot struct {
+	PlaylistID string    `json:"playlist_id"`
+	Name       string    `json:"name"`
+	Codec      string    `json:"codec"`
+	SyncedAt   time.Time `json:"synced_at"`
+	Tracks     []Track   `json:"tracks"`
+}
+
+// Diff describes how a playlist changed since its snapshot.
+type Diff struct {
+	Added   []string
+	Removed []Track
+	Moved   []Track
+}
+
+// Path returns the snapshot path for a playlist folder.
+func Path(folder string) string {
+	return filepath.Join(folder, FileName)
+}
+
+// Load reads the snapshot at path. A missing file yields an empty snapshot.
+func Load(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &Snapshot{}, nil
+		}
+		return nil, err
+	}
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// Save writes the snapshot to path.
+func (s *Snapshot) Save(path string) error {
+	if s.SyncedAt.IsZero() {
+		s.SyncedAt = time.Now()
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Lookup returns the snapshot entry of a track.
+func (s *Snapshot) Lookup(id string) (Track, bool) {
+	for _, track := range s.Tracks {
+		if track.ID == id {
+			return track, true
+		}
+	}
+	return Track{}, false
+}
+
+// Compare returns the changes between the snapshot and the current track IDs in playlist order.
+// Moved holds the previous entries of tracks whose position changed.
+func (s *Snapshot) Compare(ids []string) Diff {
+	var diff Diff
+	current := make(map[string]int, len(ids))
+	for i, id := range ids {
+		current[id] = i + 1
+	}
+	for _, track := range s.Tracks {
+		position, ok := current[track.ID]
+		if !ok {
+			diff.Removed = append(diff.Removed, track)
+		} else if position != track.Position {
+			diff.Moved = append(diff.Moved, track)
+		}
+	}
+	for _, id := range ids {
+		if _, ok := s.Lookup(id); !ok {
+			diff.Added = append(diff.Added, id)
+		}
+	}
+	return diff
+}
@@ -0,0 +1,86 @@
+package snapshot
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func ids(tracks []Track) []string {
+	var out []string
+	for _, track := range tracks {
+		out = append(out, track.ID)
+	}
+	return out
+}
+
+func TestCompare(t *testing.T) {
+	snap := &Snapshot{Tracks: []Track{
+		{ID: "a", Position: 1, File: "01 A.m4a"},
+		{ID: "b", Position: 2, File: "02 B.m4a"},
+		{ID: "c", Position: 3, File: "03 C.m4a"},
+	}}
+	tests := []struct {
+		name    string
+		ids     []string
+		added   []string
+		removed []string
+		moved   []string
+	}{
+		{"unchanged", []string{"a", "b", "c"}, nil, nil, nil},
+		{"appended", []string{"a", "b", "c", "d"}, []string{"d"}, nil, nil},
+		{"removed from the end", []string{"a", "b"}, nil, []string{"c"}, nil},
+		{"removed from the start", []string{"b", "c"}, nil, []string{"a"}, []string{"b", "c"}},
+		{"swapped", []string{"b", "a", "c"}, nil, nil, []string{"a", "b"}},
+		{"inserted", []string{"a", "d", "b", "c"}, []string{"d"}, nil, []string{"b", "c"}},
+		{"replaced", []string{"a", "d", "c"}, []string{"d"}, []string{"b"}, nil},
+		{"emptied", nil, nil, []string{"a", "b", "c"}, nil},
+	}
+	for _, tt := range tests {
+		diff := snap.Compare(tt.ids)
+		if !reflect.DeepEqual(diff.Added, tt.added) {
+			t.Errorf("%s: added %v, want %v", tt.name, diff.Added, tt.added)
+		}
+		if got := ids(diff.Removed); !reflect.DeepEqual(got, tt.removed) {
+			t.Errorf("%s: removed %v, want %v", tt.name, got, tt.removed)
+		}
+		if got := ids(diff.Moved); !reflect.DeepEqual(got, tt.moved) {
+			t.Errorf("%s: moved %v, want %v", tt.name, got, tt.moved)
+		}
+	}
+}
+
+func TestCompareEmpty(t *testing.T) {
+	diff := (&Snapshot{}).Compare([]string{"a", "b"})
+	if !reflect.DeepEqual(diff.Added, []string{"a", "b"}) || diff.Removed != nil || diff.Moved != nil {
+		t.Errorf("first sync = %+v, want every track added", diff)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	path := Path(t.TempDir())
+	if filepath.Base(path) != FileName {
+		t.Fatalf("Path = %s", path)
+	}
+	empty, err := Load(path)
+	if err != nil || len(empty.Tracks) != 0 {
+		t.Fatalf("Load of a missing snapshot = %+v, %v", empty, err)
+	}
+	snap := &Snapshot{PlaylistID: "pl.1", Name: "Mix", Codec: "ALAC", Tracks: []Track{{ID: "a", Name: "A", Position: 1, File: "01 A.m4a"}}}
+	if err := snap.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.SyncedAt.Equal(snap.SyncedAt) || !reflect.DeepEqual(loaded.Tracks, snap.Tracks) || loaded.PlaylistID != "pl.1" {
+		t.Errorf("loaded %+v, want %+v", loaded, snap)
+	}
+	if track, ok := loaded.Lookup("a"); !ok || track.File != "01 A.m4a" {
+		t.Errorf("Lookup(a) = %+v, %v", track, ok)
+	}
+	if _, ok := loaded.Lookup("z"); ok {
+		t.Error("Lookup found a track that is not in the snapshot")
+	}
+}
@@ -55,6 +55,28 @@ type ConfigSet struct {
 	TelegramCacheFile          string  `yaml:"telegram-cache-file"`
 	TelegramAPIURL             string  `yaml:"telegram-api-url"`
 	TelegramDownloadMaxGB      int     `yaml:"telegram-download-max-gb"`
+	HistoryFile                string  `yaml:"history-file"`
+	DownloadConcurrency        int     `yaml:"download-concurrency"`
+	TelegramDownloadWorkers    int     `yaml:"telegram-download-workers"`
+	Retries                    int     `yaml:"retries"`
+	SyncRemoved                string  `yaml:"sync-removed"`
+	WatchArtists               []string `yaml:"watch-artists"`
+	WatchInterval              int      `yaml:"watch-interval"`
+	WatchStateFile             string   `yaml:"watch-state-file"`
+	FilenameProfile            string   `yaml:"filename-profile"`
+	MaxNameBytes               int      `yaml:"max-name-bytes"`
+	MaxPathBytes               int      `yaml:"max-path-bytes"`
+	QualityPreference          []string `yaml:"quality-preference"`
+	ServeListen                string   `yaml:"serve-listen"`
+	ServeToken                 string   `yaml:"serve-token"`
+	ServeWorkers               int      `yaml:"serve-workers"`
+	FallbackStorefronts        []string `yaml:"fallback-storefronts"`
+	VerifyDownloads            bool     `yaml:"verify-downloads"`
+	SaveManifest               bool     `yaml:"save-manifest"`
+	SavePlaylistM3u8           bool     `yaml:"save-playlist-m3u8"`
+	SaveAlbumM3u8              bool     `yaml:"save-album-m3u8"`
+	SaveNfo                    bool     `yaml:"save-nfo"`
+	SaveAlbumJson              bool     `yaml:"save-album-json"`
 }
 
 type Counter struct {
@@ -41,12 +41,18 @@ func NewAlbum(st string, id string) *Album {
 
 func (a *Album) GetResp(token, l string) error {
 	var err error
-	a.Language = l
-	resp, err := ampapi.GetAlbumResp(a.Storefront, a.ID, a.Language, token)
+	resp, err := ampapi.GetAlbumResp(a.Storefront, a.ID, l, token)
 	if err != nil {
 		return errors.New("error getting album response")
 	}
-	a.Resp = *resp
+	a.SetResp(*resp, l)
+	return nil
+}
+
+// SetResp 使用已获取的响应填充曲目，同一发行以多种编码下载时可共用一次请求
+func (a *Album) SetResp(resp ampapi.AlbumResp, l string) {
+	a.Language = l
+	a.Resp = resp
 	//简化高频调用名称
 	a.Name = a.Resp.Data[0].Attributes.Name
 	//fmt.Println("Getting album response")
@@ -75,7 +81,6 @@ func (a *Album) GetResp(token, l string) error {
 			AlbumData: a.Resp.Data[0],
 		})
 	}
-	return nil
 }
 
 func (a *Album) GetArtwork() string {
@@ -41,12 +41,18 @@ func NewPlaylist(st string, id string) *Playlist {
 
 func (a *Playlist) GetResp(token, l string) error {
 	var err error
-	a.Language = l
-	resp, err := ampapi.GetPlaylistResp(a.Storefront, a.ID, a.Language, token)
+	resp, err := ampapi.GetPlaylistResp(a.Storefront, a.ID, l, token)
 	if err != nil {
 		return errors.New("error getting album response")
 	}
-	a.Resp = *resp
+	a.SetResp(*resp, l)
+	return nil
+}
+
+// SetResp 使用已获取的响应填充曲目，同一发行以多种编码下载时可共用一次请求
+func (a *Playlist) SetResp(resp ampapi.PlaylistResp, l string) {
+	a.Language = l
+	a.Resp = resp
 
 	a.Resp.Data[0].Attributes.ArtistName = "Apple Music"
 	//简化高频调用名称
@@ -77,7 +83,6 @@ func (a *Playlist) GetResp(token, l string) error {
 			PlaylistData: a.Resp.Data[0],
 		})
 	}
-	return nil
 }
 
 func (a *Playlist) GetArtwork() string {
@@ -2,6 +2,7 @@ package task
 
 import (
 	"main/utils/ampapi"
+	"main/utils/manifest"
 )
 
 type Track struct {
@@ -13,6 +14,7 @@ type Track struct {
 
 	SaveDir    string
 	SaveName   string
+	NameSuffix string // 与同一专辑/歌单内曲目重名时追加的后缀
 	SavePath   string
 	Codec      string
 	TaskNum    int
@@ -21,6 +23,8 @@ type Track struct {
 	WebM3u8    string
 	DeviceM3u8 string
 	Quality    string
+	Preference string           // quality-preference 中实际选用的项
+	Variant    manifest.Variant // 实际下载的码流
 	CoverPath  string
 
 	Resp         ampapi.TrackRespData
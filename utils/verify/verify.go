@@ -0,0 +1,205 @@
+// Package verify checks that downloaded MP4 files are complete, playable and decrypted.
+package verify
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/itouakirai/mp4ff/mp4"
+)
+
+// DefaultTolerance is how far the duration of a file may be from the expected duration.
+// Encoder priming and the last partial frame make audio files differ by a fraction of a second.
+const DefaultTolerance = 2 * time.Second
+
+// Report describes one checked file.
+type Report struct {
+	Path     string
+	Samples  int
+	Duration time.Duration
+	Problems []string
+}
+
+// OK reports whether the file passed every check.
+func (r Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r Report) String() string {
+	if r.OK() {
+		return fmt.Sprintf("%s: ok, %d samples, %s", r.Path, r.Samples, r.Duration.Round(time.Millisecond))
+	}
+	return fmt.Sprintf("%s: %s", r.Path, strings.Join(r.Problems, "; "))
+}
+
+func (r *Report) problem(format string, args ...any) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// File checks the MP4 file at path: it must parse, every track must have samples that are no longer
+// encrypted, and the duration must match expected within tolerance. An expected duration of 0 compares
+// against the duration the file declares in its header instead, when it has one.
+func File(path string, expected time.Duration, tolerance time.Duration) Report {
+	report := Report{Path: path}
+	f, err := os.Open(path)
+	if err != nil {
+		report.problem("cannot open: %v", err)
+		return report
+	}
+	defer f.Close()
+	parsed, err := mp4.DecodeFile(f, mp4.WithDecodeMode(mp4.DecModeLazyMdat))
+	if err != nil {
+		report.problem("cannot parse MP4: %v", err)
+		return report
+	}
+	if info, err := f.Stat(); err == nil {
+		var size uint64
+		for _, box := range parsed.Children {
+			size += box.Size()
+		}
+		if size > uint64(info.Size()) {
+			report.problem("truncated: boxes need %d bytes, file has %d", size, info.Size())
+		}
+	}
+	moov := parsed.Moov
+	if parsed.IsFragmented() && parsed.Init != nil {
+		moov = parsed.Init.Moov
+	}
+	if moov == nil || len(moov.Traks) == 0 {
+		report.problem("no tracks")
+		return report
+	}
+	var declared time.Duration
+	if moov.Mvhd != nil && moov.Mvhd.Timescale > 0 {
+		declared = scale(moov.Mvhd.Duration, moov.Mvhd.Timescale)
+	}
+	if parsed.IsFragmented() && moov.Mvex != nil && moov.Mvex.Mehd != nil && moov.Mvhd != nil && moov.Mvhd.Timescale > 0 {
+		declared = scale(uint64(moov.Mvex.Mehd.FragmentDuration), moov.Mvhd.Timescale)
+	}
+	if len(moov.Psshs) > 0 {
+		report.problem("still carries DRM (pssh box)")
+	}
+	for _, trak := range moov.Traks {
+		if trak.Tkhd == nil || trak.Mdia == nil || trak.Mdia.Mdhd == nil || trak.Mdia.Minf == nil || trak.Mdia.Minf.Stbl == nil {
+			report.problem("track without sample table")
+			continue
+		}
+		stbl := trak.Mdia.Minf.Stbl
+		if stbl.Stsd != nil {
+			for _, entry := range stbl.Stsd.Children {
+				if entry.Type() == "enca" || entry.Type() == "encv" {
+					report.problem("samples are still encrypted (%s)", entry.Type())
+				}
+			}
+		}
+		var samples int
+		var duration uint64
+		if parsed.IsFragmented() {
+			samples, duration = fragmentedSamples(&report, parsed, moov, trak.Tkhd.TrackID)
+		} else {
+			if stbl.Stsz != nil {
+				samples = int(stbl.Stsz.SampleNumber)
+			}
+			if stbl.Stts != nil {
+				for i, count := range stbl.Stts.SampleCount {
+					duration += uint64(count) * uint64(stbl.Stts.SampleTimeDelta[i])
+				}
+			}
+		}
+		if samples == 0 {
+			report.problem("track %d has no samples", trak.Tkhd.TrackID)
+		}
+		report.Samples += samples
+		if d := scale(duration, trak.Mdia.Mdhd.Timescale); d > report.Duration {
+			report.Duration = d
+		}
+	}
+	if !parsed.IsFragmented() && parsed.Mdat == nil {
+		report.problem("no media data")
+	}
+	want := expected
+	if want == 0 {
+		want = declared
+	}
+	if want > 0 {
+		diff := report.Duration - want
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff > tolerance {
+			report.problem("duration %s, expected %s", report.Duration.Round(time.Millisecond), want.Round(time.Millisecond))
+		}
+	}
+	return report
+}
+
+// fragmentedSamples counts the samples and duration of one track over all fragments.
+func fragmentedSamples(report *Report, parsed *mp4.File, moov *mp4.MoovBox, trackID uint32) (int, uint64) {
+	var defaultDuration uint32
+	if moov.Mvex != nil {
+		if trex, ok := moov.Mvex.GetTrex(trackID); ok {
+			defaultDuration = trex.DefaultSampleDuration
+		}
+	}
+	samples := 0
+	var duration uint64
+	encrypted := false
+	for _, segment := range parsed.Segments {
+		for _, frag := range segment.Fragments {
+			if frag.Moof == nil {
+				continue
+			}
+			if frag.Mdat == nil {
+				report.problem("fragment without media data")
+			}
+			for _, traf := range frag.Moof.Trafs {
+				if traf.Tfhd == nil || traf.Tfhd.TrackID != trackID {
+					continue
+				}
+				if traf.Senc != nil || traf.UUIDSenc != nil {
+					encrypted = true
+				}
+				trafDuration := defaultDuration
+				if traf.Tfhd.DefaultSampleDuration != 0 {
+					trafDuration = traf.Tfhd.DefaultSampleDuration
+				}
+				for _, trun := range traf.Truns {
+					samples += int(trun.SampleCount())
+					duration += trun.Duration(trafDuration)
+				}
+			}
+		}
+	}
+	if encrypted {
+		report.problem("track %d has encrypted fragments", trackID)
+	}
+	return samples, duration
+}
+
+func scale(units uint64, timescale uint32) time.Duration {
+	if timescale == 0 {
+		return 0
+	}
+	return time.Duration(float64(units) / float64(timescale) * float64(time.Second))
+}
+
+// Walk checks every .m4a and .mp4 file under root and calls fn with each report.
+func Walk(root string, tolerance time.Duration, fn func(Report)) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".m4a", ".mp4":
+			fn(File(path, 0, tolerance))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,188 @@
+package verify
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"main/utils/remux"
+
+	"github.com/itouakirai/mp4ff/aac"
+	"github.com/itouakirai/mp4ff/mp4"
+)
+
+// fixture describes a small AAC file: 4 fragments of 47 samples of 1024 at 48 kHz, about 4 seconds.
+type fixture struct {
+	progressive bool
+	enca        bool
+	pssh        bool
+	senc        bool
+	truncate    int
+}
+
+const (
+	fragments       = 4
+	samplesPerFrag  = 47
+	sampleDuration  = 1024
+	fixtureDuration = time.Duration(fragments*samplesPerFrag*sampleDuration) * time.Second / 48000
+)
+
+func (f fixture) write(t *testing.T) string {
+	t.Helper()
+	init := mp4.CreateEmptyInit()
+	init.AddEmptyTrack(48000, "audio", "und")
+	if err := init.Moov.Trak.SetAACDescriptor(aac.AAClc, 48000); err != nil {
+		t.Fatal(err)
+	}
+	if f.enca {
+		init.Moov.Trak.Mdia.Minf.Stbl.Stsd.Mp4a.SetType("enca")
+	}
+	if f.pssh {
+		pssh, err := mp4.NewPsshBox(mp4.UUIDWidevine, nil, []byte{1, 2, 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		init.Moov.AddChild(pssh)
+	}
+	var buf bytes.Buffer
+	if err := init.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	decodeTime := uint64(0)
+	for i := 0; i < fragments; i++ {
+		frag, err := mp4.CreateFragment(uint32(i+1), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		senc := mp4.NewSencBox(0, 0)
+		for j := 0; j < samplesPerFrag; j++ {
+			frag.AddFullSample(mp4.FullSample{
+				Sample:     mp4.NewSample(mp4.SyncSampleFlags, sampleDuration, 16, 0),
+				DecodeTime: decodeTime,
+				Data:       make([]byte, 16),
+			})
+			decodeTime += sampleDuration
+			if err := senc.AddSample(mp4.SencSample{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if f.senc {
+			frag.Moof.Traf.AddChild(senc)
+		}
+		if err := frag.Encode(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "track.m4a")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if f.progressive {
+		if err := remux.File(path, remux.Tags{Title: "Track"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if f.truncate > 0 {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Truncate(path, info.Size()-int64(f.truncate)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		fixture  fixture
+		expected time.Duration
+		problems []string
+	}{
+		{name: "fragmented", fixture: fixture{}},
+		{name: "fragmented with expected duration", fixture: fixture{}, expected: fixtureDuration},
+		{name: "progressive", fixture: fixture{progressive: true}},
+		{name: "progressive with expected duration", fixture: fixture{progressive: true}, expected: fixtureDuration},
+		{name: "within tolerance", fixture: fixture{progressive: true}, expected: fixtureDuration + 1500*time.Millisecond},
+		{name: "too short", fixture: fixture{progressive: true}, expected: fixtureDuration + 3*time.Second, problems: []string{"duration"}},
+		{name: "too long", fixture: fixture{}, expected: fixtureDuration - 3*time.Second, problems: []string{"duration"}},
+		{name: "enca", fixture: fixture{enca: true}, problems: []string{"still encrypted (enca)"}},
+		{name: "pssh", fixture: fixture{pssh: true}, problems: []string{"pssh"}},
+		{name: "senc", fixture: fixture{senc: true}, problems: []string{"encrypted fragments"}},
+		{name: "truncated progressive", fixture: fixture{progressive: true, truncate: 100}, problems: []string{"truncated"}},
+	}
+	for _, tt := range tests {
+		path := tt.fixture.write(t)
+		report := File(path, tt.expected, DefaultTolerance)
+		if len(report.Problems) != len(tt.problems) {
+			t.Errorf("%s: problems %q, want %q", tt.name, report.Problems, tt.problems)
+			continue
+		}
+		for i, want := range tt.problems {
+			if !strings.Contains(report.Problems[i], want) {
+				t.Errorf("%s: problem %q, want %q", tt.name, report.Problems[i], want)
+			}
+		}
+		if report.OK() && (report.Samples != fragments*samplesPerFrag || report.Duration != fixtureDuration) {
+			t.Errorf("%s: %d samples, %s, want %d samples, %s", tt.name, report.Samples, report.Duration, fragments*samplesPerFrag, fixtureDuration)
+		}
+	}
+}
+
+func TestFileUnreadable(t *testing.T) {
+	dir := t.TempDir()
+	garbage := filepath.Join(dir, "garbage.m4a")
+	if err := os.WriteFile(garbage, []byte("not an mp4 file at all"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{filepath.Join(dir, "missing.m4a"), "cannot open"},
+		{garbage, "cannot parse MP4"},
+	}
+	for _, tt := range tests {
+		report := File(tt.path, 0, DefaultTolerance)
+		if report.OK() || !strings.Contains(report.String(), tt.want) {
+			t.Errorf("File(%s) = %s, want %q", filepath.Base(tt.path), report, tt.want)
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	dir := t.TempDir()
+	good := fixture{progressive: true}.write(t)
+	data, err := os.ReadFile(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.m4a", "sub/b.MP4", "cover.jpg"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var checked []string
+	err = Walk(dir, DefaultTolerance, func(report Report) {
+		if !report.OK() {
+			t.Errorf("%s", report)
+		}
+		rel, _ := filepath.Rel(dir, report.Path)
+		checked = append(checked, filepath.ToSlash(rel))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(checked, ",") != "a.m4a,sub/b.MP4" {
+		t.Errorf("Walk checked %v, want the two MP4 files", checked)
+	}
+}
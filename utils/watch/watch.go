@@ -0,0 +1,123 @@
+package watch
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Cursor remembers the newest release seen for one artist relationship. Seen holds the IDs released
+// on LastRelease, so releases sharing that date are not reported twice.
+type Cursor struct {
+	LastRelease string   `json:"last_release,omitempty"`
+	Seen        []string `json:"seen,omitempty"`
+}
+
+// IsNew reports whether a release with the given ID and date comes after the cursor.
+func (c *Cursor) IsNew(id, date string) bool {
+	if date > c.LastRelease {
+		return true
+	}
+	if date < c.LastRelease {
+		return false
+	}
+	for _, seen := range c.Seen {
+		if seen == id {
+			return false
+		}
+	}
+	return true
+}
+
+// Advance moves the cursor past a release.
+func (c *Cursor) Advance(id, date string) {
+	if date > c.LastRelease {
+		c.LastRelease = date
+		c.Seen = nil
+	}
+	if date == c.LastRelease && c.IsNew(id, date) {
+		c.Seen = append(c.Seen, id)
+	}
+}
+
+// Released reports whether a release dated date (YYYY-MM-DD) is out at now. Pre-releases are listed
+// with their future date and must stay ahead of the cursor until then.
+func Released(date string, now time.Time) bool {
+	return date <= now.Format("2006-01-02")
+}
+
+// Artist is the watch state of one artist.
+type Artist struct {
+	Albums      Cursor    `json:"albums"`
+	MusicVideos Cursor    `json:"music_videos"`
+	CheckedAt   time.Time `json:"checked_at"`
+}
+
+// Initialized reports whether the artist has been checked before.
+func (a *Artist) Initialized() bool {
+	return !a.CheckedAt.IsZero()
+}
+
+// Cursor returns the cursor for an artist relationship ("albums" or "music-videos").
+func (a *Artist) Cursor(relationship string) *Cursor {
+	if relationship == "music-videos" {
+		return &a.MusicVideos
+	}
+	return &a.Albums
+}
+
+// State is the persisted watch state, keyed by artist ID.
+type State struct {
+	path    string
+	Artists map[string]*Artist `json:"artists"`
+}
+
+// Load reads the state file at path, starting empty if it does not exist yet.
+func Load(path string) (*State, error) {
+	state := &State{path: path, Artists: make(map[string]*Artist)}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return state, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Artists == nil {
+		state.Artists = make(map[string]*Artist)
+	}
+	return state, nil
+}
+
+// Artist returns the state of an artist, adding it if needed.
+func (s *State) Artist(id string) *Artist {
+	artist, ok := s.Artists[id]
+	if !ok {
+		artist = &Artist{}
+		s.Artists[id] = artist
+	}
+	return artist
+}
+
+// Save writes the state back to its file.
+func (s *State) Save() error {
+	dir := filepath.Dir(s.path)
+	if dir != "." && dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
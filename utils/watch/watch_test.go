@@ -0,0 +1,53 @@
+package watch
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCursor(t *testing.T) {
+	c := Cursor{}
+	steps := []struct {
+		id, date string
+		isNew    bool
+		advance  bool
+	}{
+		{"1", "2024-01-01", true, true},
+		{"1", "2024-01-01", false, false},
+		{"2", "2024-01-01", true, true},
+		{"0", "2023-12-31", false, false},
+		{"3", "2024-02-01", true, true},
+		{"2", "2024-01-01", false, false},
+		{"4", "2024-02-01", true, false},
+	}
+	for i, step := range steps {
+		if got := c.IsNew(step.id, step.date); got != step.isNew {
+			t.Errorf("step %d: IsNew(%s, %s) = %v, want %v", i, step.id, step.date, got, step.isNew)
+		}
+		if step.advance {
+			c.Advance(step.id, step.date)
+		}
+	}
+	if c.LastRelease != "2024-02-01" || len(c.Seen) != 1 || c.Seen[0] != "3" {
+		t.Errorf("cursor = %+v, want 2024-02-01 with only release 3 seen", c)
+	}
+}
+
+func TestReleased(t *testing.T) {
+	now := time.Date(2024, 6, 15, 23, 30, 0, 0, time.UTC)
+	tests := []struct {
+		date string
+		want bool
+	}{
+		{"2024-06-14", true},
+		{"2024-06-15", true},
+		{"2024-06-16", false},
+		{"2025-01-01", false},
+		{"", true},
+	}
+	for _, tt := range tests {
+		if got := Released(tt.date, now); got != tt.want {
+			t.Errorf("Released(%q) = %v, want %v", tt.date, got, tt.want)
+		}
+	}
+}